@@ -4,9 +4,9 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
-	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"golang.org/x/exp/slices"
 
@@ -20,26 +20,55 @@ const (
 	// AdditionalFilesDir is the archive's directory for all additional files
 	// beside the init file.
 	FilesDir = "files"
-	// LibSearchPath defines the directories to lookup linked libraries.
+	// LibSearchPath defines the directories to lookup linked libraries on
+	// x86_64 hosts.
+	//
+	// Deprecated: [Archive.ResolveLinkedLibs] derives the default search paths
+	// from the machine of the ELF files.
 	LibSearchPath = "/lib:/lib64:/usr/lib:/usr/lib64:/lib/x86_64-linux-gnu:/usr/lib/x86_64-linux-gnu"
+	// FileMode is the default mode for regular files without source file.
+	FileMode fs.FileMode = 0644
+	// DirMode is the default mode for directories.
+	DirMode fs.FileMode = 0755
+	// DeviceMode is the default mode for device nodes, named pipes and
+	// sockets.
+	DeviceMode fs.FileMode = 0600
 )
 
+// modeMask are the mode bits that can be set for entries.
+const modeMask = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
 // Archive represents a file tree that can be used as an initramfs for the
 // Linux kernel.
 //
-// Create a new instance using [New]. Additional files can be added with
-// [Archive.AddFiles]. Dynamically linked ELF libraries can be resolved and
-// added for all already added files by calling [Archive.ResolveLinkedLibs].
-// Once ready, write the [Archive] with [Archive.WriteCPIO].
+// Create a new instance using [New] or [NewWithFS]. Additional files can be
+// added with [Archive.AddFiles]. Dynamically linked ELF libraries can be
+// resolved and added for all already added files by calling
+// [Archive.ResolveLinkedLibs]. Once ready, write the [Archive] with
+// [Archive.WriteCPIO].
 type Archive struct {
-	fileTree files.Tree
-	sourceFS fs.FS
+	fileTree     files.Tree
+	sourceFS     fs.FS
+	dependencies []Dependency
 }
 
 // New creates a new [Archive] with the given file added as "/init".
-// The file path must be absolute or relative to "/".
+// The file path must be absolute or relative to "/". All source files are read
+// from the host's file system.
 func New(initFilePath string) *Archive {
-	a := Archive{sourceFS: os.DirFS("/")}
+	return NewWithFS(files.DirFS("/"), initFilePath)
+}
+
+// NewWithFS creates a new [Archive] with the given file added as "/init". All
+// source file paths, including the init file path, are paths in the given
+// file system, like an [embed.FS], a sysroot directory or a
+// [testing/fstest.MapFS]. They must be absolute or relative to the root of the
+// file system. Linked ELF libraries are resolved in the file system as well.
+//
+// Adding symbolic links with [Archive.AddDir] requires the file system to
+// implement a "ReadLink(name string) (string, error)" method.
+func NewWithFS(fsys fs.FS, initFilePath string) *Archive {
+	a := Archive{sourceFS: fsys}
 	// This can never fail on a new tree.
 	_, _ = a.fileTree.GetRoot().AddFile("init", initFilePath)
 	return &a
@@ -70,38 +99,412 @@ func (a *Archive) AddFiles(paths ...string) error {
 	})
 }
 
+// AddFileAt adds the file at the given source path to the given absolute path
+// in the archive. Non existing parent directories are created. If the archive
+// path ends with a path separator, the base name of the source file is used
+// as name in that directory.
+// The source path must be absolute or relative to "/".
+func (a *Archive) AddFileAt(archivePath, sourcePath string) error {
+	dir, name := filepath.Split(archivePath)
+	if name == "" {
+		name = filepath.Base(sourcePath)
+	}
+	return a.withDirEntry(dir, func(dirEntry *files.Entry) error {
+		return addFile(dirEntry, name, sourcePath)
+	})
+}
+
+// AddContent adds a regular file with the given content at the given absolute
+// path in the archive. Non existing parent directories are created. If the
+// mode has no permission bits set, [FileMode] is used.
+//
+// The data is not copied, so it must not be modified until the archive is
+// written.
+func (a *Archive) AddContent(path string, data []byte, mode fs.FileMode) error {
+	return a.addContent(path, files.BytesContent(data), mode)
+}
+
+// AddContentString adds a regular file with the given string content at the
+// given absolute path in the archive, like [Archive.AddContent].
+func (a *Archive) AddContentString(path, data string, mode fs.FileMode) error {
+	return a.addContent(path, files.StringContent(data), mode)
+}
+
+// AddContentFunc adds a regular file at the given absolute path in the
+// archive, whose content is provided by the given function once the archive is
+// written. The function must return a reader for the content and the exact
+// size of the content. The reader is closed after the content has been
+// written. Non existing parent directories are created. If the mode has no
+// permission bits set, [FileMode] is used.
+func (a *Archive) AddContentFunc(
+	path string,
+	fn func() (io.ReadCloser, int64, error),
+	mode fs.FileMode,
+) error {
+	return a.addContent(path, fn, mode)
+}
+
+func (a *Archive) addContent(path string, content files.Content, mode fs.FileMode) error {
+	if mode&^modeMask != 0 {
+		return fmt.Errorf("invalid mode for %s: %s", path, mode)
+	}
+	dir, name := filepath.Split(path)
+	return a.withDirEntry(dir, func(dirEntry *files.Entry) error {
+		entry, err := dirEntry.AddContent(name, content)
+		if err != nil {
+			return fmt.Errorf("add content %s: %v", path, err)
+		}
+		if mode != 0 {
+			entry.SetMode(mode)
+		}
+		return nil
+	})
+}
+
+// AddLink adds a symbolic link at the given absolute path in the archive
+// pointing to the given target. Non existing parent directories are created.
+// The target is not required to exist in the archive.
+func (a *Archive) AddLink(path, target string) error {
+	dir, name := filepath.Split(path)
+	return a.withDirEntry(dir, func(dirEntry *files.Entry) error {
+		if _, err := dirEntry.AddLink(name, target); err != nil {
+			return fmt.Errorf("add link %s: %v", path, err)
+		}
+		return nil
+	})
+}
+
+// AddDirectory adds a directory at the given absolute path in the archive.
+// Non existing parent directories are created. It is not an error if the
+// directory exists already.
+func (a *Archive) AddDirectory(path string) error {
+	_, err := a.fileTree.Mkdir(path)
+	if err != nil {
+		return fmt.Errorf("add dir %s: %v", path, err)
+	}
+	return nil
+}
+
+// DirOptions are options for adding directory trees with [Archive.AddDir].
+type DirOptions struct {
+	// Include limits the added files to the ones matching any of the glob
+	// patterns. If empty, all files are included. Directories are not
+	// matched against it. If set, empty directories are not added.
+	Include []string
+	// Exclude skips all files and directories matching any of the glob
+	// patterns. Directories are skipped with all their content.
+	Exclude []string
+}
+
+// AddDir adds the directory tree at the given source path recursively at the
+// given destination path in the archive. The source path must be absolute or
+// relative to "/". Regular files, directories and symbolic links are added
+// with their structure preserved. Any other file type results in an error,
+// unless excluded.
+//
+// Patterns in [DirOptions] have the syntax of [filepath.Match]. Patterns
+// containing a path separator are matched against the path relative to the
+// source directory, all other patterns against the base name.
+func (a *Archive) AddDir(src, dest string, opts DirOptions) error {
+	for _, pattern := range append(opts.Include, opts.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %s: %v", pattern, err)
+		}
+	}
+
+	// Cut leading / since fs.FS considers it invalid.
+	root := strings.TrimPrefix(filepath.Clean(src), "/")
+	if root == "" {
+		root = "."
+	}
+
+	return fs.WalkDir(a.sourceFS, root, func(srcPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(root, srcPath)
+		if err != nil {
+			return err
+		}
+		if relPath != "." && opts.matchesAny(opts.Exclude, relPath) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		destPath := filepath.Join(dest, relPath)
+		if d.IsDir() {
+			if len(opts.Include) > 0 && relPath != "." {
+				return nil
+			}
+			if _, err := a.fileTree.Mkdir(destPath); err != nil {
+				return fmt.Errorf("add dir %s: %v", destPath, err)
+			}
+			return nil
+		}
+
+		if len(opts.Include) > 0 && !opts.matchesAny(opts.Include, relPath) {
+			return nil
+		}
+
+		dir, name := filepath.Split(destPath)
+		switch d.Type() {
+		case 0:
+			return a.withDirEntry(dir, func(dirEntry *files.Entry) error {
+				return addFile(dirEntry, name, "/"+srcPath)
+			})
+		case fs.ModeSymlink:
+			target, err := files.ReadLink(a.sourceFS, srcPath)
+			if err != nil {
+				return err
+			}
+			return a.withDirEntry(dir, func(dirEntry *files.Entry) error {
+				if _, err := dirEntry.AddLink(name, target); err != nil {
+					return fmt.Errorf("add link %s: %v", destPath, err)
+				}
+				return nil
+			})
+		default:
+			return fmt.Errorf("unsupported file type %s: %s", d.Type(), srcPath)
+		}
+	})
+}
+
+// matchesAny returns true if the given path matches any of the patterns.
+func (DirOptions) matchesAny(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		name := path
+		if !strings.ContainsRune(pattern, filepath.Separator) {
+			name = filepath.Base(path)
+		}
+		// Patterns are validated already, so errors can be ignored.
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// AddDevice adds a device node at the given absolute path in the archive.
+// Non existing parent directories are created. The mode must have
+// [fs.ModeDevice] set. If [fs.ModeCharDevice] is set as well, a character
+// device is added, a block device otherwise. If the mode has no permission
+// bits set, [DeviceMode] is used.
+//
+// Device nodes are created by the kernel when unpacking the archive, so no
+// privileges are required for building the archive.
+func (a *Archive) AddDevice(path string, mode fs.FileMode, major, minor uint32) error {
+	if mode&fs.ModeDevice == 0 {
+		return fmt.Errorf("not a device mode for %s: %s", path, mode)
+	}
+	if mode&^(modeMask|fs.ModeDevice|fs.ModeCharDevice) != 0 {
+		return fmt.Errorf("invalid mode for %s: %s", path, mode)
+	}
+	return a.addNode(path, mode, func(dirEntry *files.Entry, name string) (*files.Entry, error) {
+		if mode&fs.ModeCharDevice != 0 {
+			return dirEntry.AddCharDevice(name, major, minor)
+		}
+		return dirEntry.AddBlockDevice(name, major, minor)
+	})
+}
+
+// AddFIFO adds a named pipe at the given absolute path in the archive.
+// Non existing parent directories are created. If the mode has no permission
+// bits set, [DeviceMode] is used.
+func (a *Archive) AddFIFO(path string, mode fs.FileMode) error {
+	if mode&^modeMask != 0 {
+		return fmt.Errorf("invalid mode for %s: %s", path, mode)
+	}
+	return a.addNode(path, mode, func(dirEntry *files.Entry, name string) (*files.Entry, error) {
+		return dirEntry.AddFIFO(name)
+	})
+}
+
+// AddSocket adds a unix socket file at the given absolute path in the
+// archive. Non existing parent directories are created. If the mode has no
+// permission bits set, [DeviceMode] is used.
+func (a *Archive) AddSocket(path string, mode fs.FileMode) error {
+	if mode&^modeMask != 0 {
+		return fmt.Errorf("invalid mode for %s: %s", path, mode)
+	}
+	return a.addNode(path, mode, func(dirEntry *files.Entry, name string) (*files.Entry, error) {
+		return dirEntry.AddSocket(name)
+	})
+}
+
+// addNode adds the special file created by the given function and sets its
+// mode.
+func (a *Archive) addNode(
+	path string,
+	mode fs.FileMode,
+	add func(dirEntry *files.Entry, name string) (*files.Entry, error),
+) error {
+	dir, name := filepath.Split(path)
+	return a.withDirEntry(dir, func(dirEntry *files.Entry) error {
+		entry, err := add(dirEntry, name)
+		if err != nil {
+			return fmt.Errorf("add node %s: %v", path, err)
+		}
+		if mode&modeMask != 0 {
+			entry.SetMode(mode & modeMask)
+		}
+		return nil
+	})
+}
+
+// AddHardLink adds a hard link at the given absolute path in the archive that
+// links to the regular file at the given absolute target path in the archive.
+// Non existing parent directories are created.
+//
+// Hard linked files share their inode, mode and owner and their content is
+// written only once. Regular files added multiple times from the same source
+// file with the same mode and owner are written as hard links automatically.
+func (a *Archive) AddHardLink(path, target string) error {
+	targetEntry, err := a.fileTree.GetEntry(target)
+	if err != nil {
+		return fmt.Errorf("get target %s: %v", target, err)
+	}
+	switch targetEntry.Type {
+	case files.TypeRegular:
+	case files.TypeHardLink:
+		target = targetEntry.RelatedPath
+	default:
+		return fmt.Errorf("target %s: not a regular file", target)
+	}
+
+	dir, name := filepath.Split(path)
+	return a.withDirEntry(dir, func(dirEntry *files.Entry) error {
+		if _, err := dirEntry.AddHardLink(name, target); err != nil {
+			return fmt.Errorf("add hard link %s: %v", path, err)
+		}
+		return nil
+	})
+}
+
+// SetMode sets the permission bits of the entry at the given path in the
+// [Archive]. The setuid, setgid and sticky bits can be set as well. Mode bits
+// of symbolic links can not be changed. Mode 0 is set as is, like for
+// "/etc/shadow".
+//
+// Without explicit mode, regular files have the mode of their source file and
+// directories [DirMode].
+func (a *Archive) SetMode(path string, mode fs.FileMode) error {
+	if mode&^modeMask != 0 {
+		return fmt.Errorf("invalid mode for %s: %s", path, mode)
+	}
+	entry, err := a.fileTree.GetEntry(path)
+	if err != nil {
+		return fmt.Errorf("get entry %s: %v", path, err)
+	}
+	if entry.IsLink() {
+		return fmt.Errorf("set mode of link %s: not supported", path)
+	}
+	if entry.Type == files.TypeHardLink {
+		return fmt.Errorf("set mode of hard link %s: set on target %s", path, entry.RelatedPath)
+	}
+	entry.SetMode(mode)
+	return nil
+}
+
+// SetOwner sets the numeric user and group ID of the entry at the given path
+// in the [Archive].
+//
+// Without explicit owner, regular files are owned by the owner of their
+// source file and all other entries by root. Source file owners are not used
+// if the archive is written with [WithReproducible].
+func (a *Archive) SetOwner(path string, uid, gid int) error {
+	if uid < 0 || gid < 0 {
+		return fmt.Errorf("invalid owner for %s: %d:%d", path, uid, gid)
+	}
+	entry, err := a.fileTree.GetEntry(path)
+	if err != nil {
+		return fmt.Errorf("get entry %s: %v", path, err)
+	}
+	if entry.Type == files.TypeHardLink {
+		return fmt.Errorf("set owner of hard link %s: set on target %s", path, entry.RelatedPath)
+	}
+	entry.Owner = &files.Owner{UID: uid, GID: gid}
+	return nil
+}
+
 // ResolveLinkedLibs recursively resolves the dynamically linked libraries of
-// all regular files in the [Archive].
+// all regular ELF files in the [Archive]. Other files, like scripts and data
+// files, are skipped.
 //
-// If the given searchPath string is empty the default [LibSearchPath] is used.
-// Resolved libraries are added to [LibsDir]. For each search path a symoblic
-// link is added pointiong to [LibsDir].
-func (a *Archive) ResolveLinkedLibs(searchPath string) error {
-	if searchPath == "" {
-		searchPath = LibSearchPath
+// Libraries are looked up like the dynamic linker does: in the DT_RPATH of
+// the requesting files, the given searchPath like LD_LIBRARY_PATH, their
+// DT_RUNPATH, and the default search paths for the machine of each ELF file,
+// like "/lib/aarch64-linux-gnu" for arm64 files. Resolved libraries are added
+// to [LibsDir] once by the name of their real file. Symbolic links they have
+// been found by, like "libfoo.so.1" pointing to "libfoo.so.1.2.3", are
+// recreated in [LibsDir]. Different files with the same name are an error.
+// For the searchPath and the default search paths a symbolic link is added
+// pointing to [LibsDir]. The program interpreters of the ELF files are added
+// to [LibsDir] as well and are available at the exact path the files
+// request, like "/lib64/ld-linux-x86-64.so.2". The resolution can be modified
+// by passing [ResolveOption]s, like [WithScripts] for resolving the
+// interpreters of scripts or [WithKeepGoing] for collecting all libraries
+// that can not be resolved. The dependency graph of the resolved files is
+// available by [Archive.Dependencies] afterwards.
+func (a *Archive) ResolveLinkedLibs(searchPath string, opts ...ResolveOption) error {
+	var options resolveOptions
+	for _, opt := range opts {
+		opt(&options)
 	}
+
 	searchPaths := filepath.SplitList(searchPath)
 	searchPaths = slices.DeleteFunc(searchPaths, func(e string) bool { return e == "" })
 
 	resolver := files.ELFLibResolver{
-		SearchPaths: searchPaths,
+		FS:             a.sourceFS,
+		Root:           options.sysroot,
+		SearchPaths:    searchPaths,
+		DLOpenPriority: options.dlopenPriority,
+		Hints:          options.hints,
+		AllowMissing:   options.allowMissing,
+		KeepGoing:      options.keepGoing,
+		Scripts:        options.scripts,
+	}
+	if options.ldConfig {
+		if err := resolver.LoadLDConfig(); err != nil {
+			return fmt.Errorf("load ld config: %v", err)
+		}
 	}
 
 	err := a.fileTree.Walk(func(path string, entry *files.Entry) error {
-		if entry.Type != files.TypeRegular {
+		// Only files with source file in the source file system can be
+		// resolved.
+		if entry.Type != files.TypeRegular || entry.Content != nil || entry.SourceFS != nil {
 			return nil
 		}
-		return resolver.Resolve(entry.RelatedPath)
+		if options.scripts {
+			// Interpreters present in the archive already are resolved on
+			// their own.
+			kind, interp, err := files.DetectKind(a.sourceFS, entry.RelatedPath)
+			if err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+			if _, err := a.fileTree.GetEntry(interp); kind == files.KindScript && err == nil {
+				return nil
+			}
+		}
+		return resolver.ResolveFile(entry.RelatedPath)
 	})
 	if err != nil {
 		return fmt.Errorf("resolve: %v", err)
 	}
+	a.addDependencies(resolver.Dependencies)
 
 	if err := a.withDirEntry(LibsDir, func(dirEntry *files.Entry) error {
-		for _, lib := range resolver.Libs {
-			name := filepath.Base(lib)
-			if _, err := dirEntry.AddFile(name, lib); err != nil {
-				return fmt.Errorf("add lib %s: %v", name, err)
+		// The interpreter might be linked by some lib as well already.
+		for _, libs := range [][]string{resolver.Libs, resolver.Interpreters} {
+			for _, lib := range libs {
+				names := resolver.LinkNames(lib)
+				if err := addLib(dirEntry, names, resolver.RealPath(lib)); err != nil {
+					return fmt.Errorf("add lib %s: %v", names[0], err)
+				}
 			}
 		}
 		return nil
@@ -110,45 +513,264 @@ func (a *Archive) ResolveLinkedLibs(searchPath string) error {
 	}
 
 	absLibDir := filepath.Join(string(filepath.Separator), LibsDir)
-	for _, searchPath := range searchPaths {
+	for _, searchPath := range resolver.LookupPaths() {
 		err := a.fileTree.Ln(absLibDir, searchPath)
 		if err != nil && err != files.ErrEntryExists {
 			return fmt.Errorf("add link %s: %v", searchPath, err)
 		}
 	}
 
+	// The interpreter must be present at the exact path the ELF files
+	// request, unless its directory is linked to LibsDir already.
+	for _, interp := range resolver.Interpreters {
+		dir := filepath.Dir(interp)
+		if dir == absLibDir {
+			continue
+		}
+		if entry, err := a.fileTree.GetEntry(dir); err == nil &&
+			entry.IsLink() && entry.RelatedPath == absLibDir {
+			continue
+		}
+		target := filepath.Join(absLibDir, filepath.Base(interp))
+		if err := a.fileTree.Ln(target, interp); err != nil {
+			return fmt.Errorf("add interpreter link %s: %v", interp, err)
+		}
+	}
+
+	// Script interpreters must be present at the exact path of the shebang
+	// line.
+	for _, interp := range resolver.ScriptInterpreters {
+		err := a.withDirEntry(filepath.Dir(interp), func(dirEntry *files.Entry) error {
+			return addLib(dirEntry, resolver.LinkNames(interp), resolver.RealPath(interp))
+		})
+		if err != nil {
+			return fmt.Errorf("add script interpreter %s: %v", interp, err)
+		}
+	}
+
+	if len(resolver.Unresolved) > 0 {
+		unresolvedErr := UnresolvedLibsError{}
+		for _, unresolved := range resolver.Unresolved {
+			unresolvedErr.Libs = append(unresolvedErr.Libs, UnresolvedLib(unresolved))
+		}
+		return &unresolvedErr
+	}
+
 	return nil
 }
 
-// WriteCPIO writes the [Archive] as CPIO archive to the given writer.
-func (a *Archive) WriteCPIO(writer io.Writer) error {
-	w := archive.NewCPIOWriter(writer)
-	defer w.Close()
-	return a.writeTo(w)
+// addLib adds the real file of a resolved lib with the last of the given
+// names to the given directory entry and recreates the chain of symbolic
+// links with the other names pointing to it, like "libfoo.so.1" pointing to
+// "libfoo.so.1.2.3". Entries that exist already for the same file or link
+// are kept. Any other existing entry is a name collision.
+func addLib(dirEntry *files.Entry, names []string, realPath string) error {
+	realName := names[len(names)-1]
+	entry, err := dirEntry.AddFile(realName, realPath)
+	if err == files.ErrEntryExists {
+		if entry.Type != files.TypeRegular || entry.RelatedPath != realPath {
+			return fmt.Errorf("name collision %s: %s and %s", realName, realPath, entry.RelatedPath)
+		}
+	} else if err != nil {
+		return err
+	}
+
+	for idx := len(names) - 2; idx >= 0; idx-- {
+		name, target := names[idx], names[idx+1]
+		if name == target {
+			continue
+		}
+		entry, err := dirEntry.AddLink(name, target)
+		if err == files.ErrEntryExists {
+			if !entry.IsLink() || entry.RelatedPath != target {
+				return fmt.Errorf("name collision %s: link to %s and %s", name, target, describeEntry(entry))
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// describeEntry returns a short description of an existing lib entry for
+// error messages.
+func describeEntry(entry *files.Entry) string {
+	if entry.IsLink() {
+		return "link to " + entry.RelatedPath
+	}
+	return entry.RelatedPath
+}
+
+// WriteCPIO writes the [Archive] as CPIO archive to the given writer. The
+// output can be modified by passing [WriteOption]s.
+func (a *Archive) WriteCPIO(writer io.Writer, opts ...WriteOption) error {
+	var options writeOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	var modTime time.Time
+	if options.reproducible {
+		var err error
+		modTime, err = sourceDateEpoch()
+		if err != nil {
+			return err
+		}
+	}
+
+	compressor, err := options.compression.NewWriter(writer)
+	if err != nil {
+		return fmt.Errorf("create compressor: %v", err)
+	}
+
+	w := archive.NewCPIOWriter(compressor)
+	if options.reproducible {
+		w.SetModTime(modTime)
+	}
+	if err := a.writeTo(w, options); err != nil {
+		_ = w.Close()
+		_ = compressor.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		_ = compressor.Close()
+		return fmt.Errorf("close archive: %v", err)
+	}
+	if err := compressor.Close(); err != nil {
+		return fmt.Errorf("close compressor: %v", err)
+	}
+	return nil
 }
 
-func (a *Archive) writeTo(writer archive.Writer) error {
+func (a *Archive) writeTo(writer archive.Writer, options writeOptions) error {
+	hardLinks, err := a.hardLinkGroups()
+	if err != nil {
+		return err
+	}
+
 	return a.fileTree.Walk(func(path string, entry *files.Entry) error {
+		name := archiveName(path)
+		var owner archive.Owner
+		if entry.Owner != nil {
+			owner = archive.Owner(*entry.Owner)
+		}
+
 		switch entry.Type {
-		case files.TypeRegular:
-			// Cut leading / since fs.FS considers it invalid.
-			relPath := strings.TrimPrefix(entry.RelatedPath, "/")
-			source, err := a.sourceFS.Open(relPath)
-			if err != nil {
-				return err
+		case files.TypeRegular, files.TypeHardLink:
+			group, exists := hardLinks[path]
+			if !exists {
+				return a.writeRegular(writer, []string{path}, entry, options)
+			}
+			// All hard links are written together once the last one is
+			// reached, so all their parent directories exist already.
+			if path != group.paths[len(group.paths)-1] {
+				return nil
 			}
-			defer source.Close()
-			return writer.WriteRegular(path, source, 0755)
+			return a.writeRegular(writer, group.paths, group.entry, options)
 		case files.TypeDirectory:
-			return writer.WriteDirectory(path)
+			mode := DirMode
+			if entry.Mode != nil {
+				mode = *entry.Mode
+			}
+			return writer.WriteDirectory(name, mode, owner)
 		case files.TypeLink:
-			return writer.WriteLink(path, entry.RelatedPath)
+			return writer.WriteLink(name, entry.RelatedPath, owner)
+		case files.TypeCharDevice, files.TypeBlockDevice:
+			mode := DeviceMode
+			if entry.Mode != nil {
+				mode = *entry.Mode
+			}
+			mode |= fs.ModeDevice
+			if entry.Type == files.TypeCharDevice {
+				mode |= fs.ModeCharDevice
+			}
+			return writer.WriteDevice(name, mode, entry.Major, entry.Minor, owner)
+		case files.TypeFIFO, files.TypeSocket:
+			mode := DeviceMode
+			if entry.Mode != nil {
+				mode = *entry.Mode
+			}
+			if entry.Type == files.TypeFIFO {
+				mode |= fs.ModeNamedPipe
+			} else {
+				mode |= fs.ModeSocket
+			}
+			return writer.WriteSpecial(name, mode, owner)
 		default:
 			return fmt.Errorf("unknown file type %d", entry.Type)
 		}
 	})
 }
 
+// writeRegular writes the given regular file entry for all given paths. If
+// there is more than one path, they are written as hard links.
+func (a *Archive) writeRegular(
+	writer archive.Writer,
+	paths []string,
+	entry *files.Entry,
+	options writeOptions,
+) error {
+	source, err := a.openSource(entry)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	info, err := source.Stat()
+	if err != nil {
+		return fmt.Errorf("read info: %v", err)
+	}
+
+	mode := info.Mode() & modeMask
+	if entry.Mode != nil {
+		mode = *entry.Mode
+	}
+
+	var owner archive.Owner
+	if entry.Owner != nil {
+		owner = archive.Owner(*entry.Owner)
+	} else if !options.reproducible {
+		// Host owners are not used for reproducible archives as they
+		// differ between build environments.
+		owner = fileOwner(info)
+	}
+
+	names := make([]string, len(paths))
+	for idx, path := range paths {
+		names[idx] = archiveName(path)
+	}
+	if len(names) > 1 {
+		return writer.WriteHardLinks(names, source, mode, owner)
+	}
+	return writer.WriteRegular(names[0], source, mode, owner)
+}
+
+// openSource opens the source of the given regular file entry. This is either
+// its [files.Content] or the source file in its own or the archive's source
+// file system.
+func (a *Archive) openSource(entry *files.Entry) (fs.File, error) {
+	if entry.Content != nil {
+		reader, size, err := entry.Content()
+		if err != nil {
+			return nil, fmt.Errorf("open content: %v", err)
+		}
+		// Content of files, like of images or merged archives, provides
+		// the mode, owner and modification time of the file.
+		if file, ok := reader.(fs.File); ok {
+			return file, nil
+		}
+		return &contentFile{ReadCloser: reader, size: size}, nil
+	}
+	sourceFS := a.sourceFS
+	if entry.SourceFS != nil {
+		sourceFS = entry.SourceFS
+	}
+	// Cut leading / since fs.FS considers it invalid.
+	relPath := strings.TrimPrefix(entry.RelatedPath, "/")
+	return sourceFS.Open(relPath)
+}
+
 func (a *Archive) withDirEntry(dir string, fn func(*files.Entry) error) error {
 	dirEntry, err := a.fileTree.Mkdir(dir)
 	if err != nil {
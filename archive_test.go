@@ -1,20 +1,26 @@
 package initramfs
 
 import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"testing"
 	"testing/fstest"
+	"time"
 
 	"github.com/aibor/initramfs/internal/archive"
 	"github.com/aibor/initramfs/internal/files"
+	"github.com/cavaliergopher/cpio"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func TestArchiveNew(t *testing.T) {
 	archive := New("first")
-	assert.Equal(t, os.DirFS("/"), archive.sourceFS)
+	assert.Equal(t, files.DirFS("/"), archive.sourceFS)
 	entry, err := archive.fileTree.GetEntry("/init")
 	require.NoError(t, err)
 	assert.Equal(t, "first", entry.RelatedPath)
@@ -64,6 +70,305 @@ func TestArchiveAddFiles(t *testing.T) {
 	}
 }
 
+func TestArchiveAddFileAt(t *testing.T) {
+	archive := New("first")
+
+	require.NoError(t, archive.AddFileAt("/etc/passwd", "/src/passwd"))
+	require.NoError(t, archive.AddFileAt("/usr/bin/", "/bin/tool"))
+	require.NoError(t, archive.AddFileAt("sbin/init", "rel/init"))
+
+	expected := map[string]string{
+		"/etc/passwd":   "/src/passwd",
+		"/usr/bin/tool": "/bin/tool",
+		"/sbin/init":    "rel/init",
+	}
+	for path, relPath := range expected {
+		e, err := archive.fileTree.GetEntry(path)
+		require.NoError(t, err, path)
+		assert.Equal(t, files.TypeRegular, e.Type, path)
+		assert.Equal(t, relPath, e.RelatedPath, path)
+	}
+
+	err := archive.AddFileAt("/etc/passwd", "/other")
+	assert.ErrorContains(t, err, "add file /other: entry exists")
+	err = archive.AddFileAt("/etc/passwd/sub", "/other")
+	assert.ErrorContains(t, err, "add dir /etc/passwd/:")
+}
+
+func TestArchiveAddContent(t *testing.T) {
+	archive := New("first")
+
+	require.NoError(t, archive.AddContent("/etc/fstab", []byte("fstab"), 0))
+	require.NoError(t, archive.AddContentFunc("/etc/init.sh", func() (io.ReadCloser, int64, error) {
+		return io.NopCloser(bytes.NewBufferString("init")), 4, nil
+	}, 0755))
+	require.NoError(t, archive.AddContentString("/etc/hostname", "test", 0644))
+
+	e, err := archive.fileTree.GetEntry("/etc/fstab")
+	require.NoError(t, err)
+	assert.Equal(t, files.TypeRegular, e.Type)
+	assert.Nil(t, e.Mode)
+	require.NotNil(t, e.Content)
+	e, err = archive.fileTree.GetEntry("/etc/init.sh")
+	require.NoError(t, err)
+	assert.Equal(t, modePtr(0755), e.Mode)
+	require.NotNil(t, e.Content)
+	e, err = archive.fileTree.GetEntry("/etc/hostname")
+	require.NoError(t, err)
+	assert.Equal(t, modePtr(0644), e.Mode)
+	reader, size, err := e.Content()
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "test", string(data))
+	assert.EqualValues(t, 4, size)
+
+	err = archive.AddContent("/etc/fstab", nil, 0)
+	assert.ErrorContains(t, err, "add content /etc/fstab: entry exists")
+	err = archive.AddContent("/etc/other", nil, fs.ModeDir)
+	assert.ErrorContains(t, err, "invalid mode for /etc/other")
+}
+
+func TestArchiveAddLink(t *testing.T) {
+	archive := New("first")
+
+	require.NoError(t, archive.AddLink("/bin/sh", "busybox"))
+	e, err := archive.fileTree.GetEntry("/bin/sh")
+	require.NoError(t, err)
+	assert.Equal(t, files.TypeLink, e.Type)
+	assert.Equal(t, "busybox", e.RelatedPath)
+
+	err = archive.AddLink("/bin/sh", "bash")
+	assert.ErrorContains(t, err, "add link /bin/sh: entry exists")
+}
+
+func TestArchiveAddDirectory(t *testing.T) {
+	archive := New("first")
+
+	require.NoError(t, archive.AddDirectory("/usr/lib/modules"))
+	require.NoError(t, archive.AddDirectory("/usr/lib"))
+	e, err := archive.fileTree.GetEntry("/usr/lib/modules")
+	require.NoError(t, err)
+	assert.Equal(t, files.TypeDirectory, e.Type)
+
+	err = archive.AddDirectory("/init/sub")
+	assert.ErrorContains(t, err, "add dir /init/sub:")
+}
+
+func TestArchiveAddDir(t *testing.T) {
+	src := t.TempDir()
+	for _, dir := range []string{"bin", "etc/conf.d", "empty", ".git"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(src, dir), 0755))
+	}
+	for _, file := range []string{"bin/tool", "etc/conf.d/a.conf", "etc/notes.txt", ".git/HEAD"} {
+		require.NoError(t, os.WriteFile(filepath.Join(src, file), nil, 0644))
+	}
+	require.NoError(t, os.Symlink("tool", filepath.Join(src, "bin", "alias")))
+
+	type expectedEntries map[string]files.Entry
+
+	tests := []struct {
+		name     string
+		opts     DirOptions
+		expected expectedEntries
+		missing  []string
+	}{
+		{
+			name: "all",
+			expected: expectedEntries{
+				"/data/bin":               {Type: files.TypeDirectory},
+				"/data/bin/tool":          {Type: files.TypeRegular, RelatedPath: filepath.Join(src, "bin/tool")},
+				"/data/bin/alias":         {Type: files.TypeLink, RelatedPath: "tool"},
+				"/data/etc/conf.d/a.conf": {Type: files.TypeRegular, RelatedPath: filepath.Join(src, "etc/conf.d/a.conf")},
+				"/data/empty":             {Type: files.TypeDirectory},
+				"/data/.git/HEAD":         {Type: files.TypeRegular, RelatedPath: filepath.Join(src, ".git/HEAD")},
+			},
+		},
+		{
+			name: "exclude",
+			opts: DirOptions{Exclude: []string{".git", "*.txt", "etc/conf.d"}},
+			expected: expectedEntries{
+				"/data/bin/tool": {Type: files.TypeRegular, RelatedPath: filepath.Join(src, "bin/tool")},
+				"/data/etc":      {Type: files.TypeDirectory},
+			},
+			missing: []string{"/data/.git", "/data/etc/notes.txt", "/data/etc/conf.d"},
+		},
+		{
+			name: "include",
+			opts: DirOptions{Include: []string{"*.conf", "bin/*"}, Exclude: []string{"alias"}},
+			expected: expectedEntries{
+				"/data/bin/tool":          {Type: files.TypeRegular, RelatedPath: filepath.Join(src, "bin/tool")},
+				"/data/etc/conf.d/a.conf": {Type: files.TypeRegular, RelatedPath: filepath.Join(src, "etc/conf.d/a.conf")},
+			},
+			missing: []string{"/data/bin/alias", "/data/empty", "/data/etc/notes.txt", "/data/.git"},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			archive := New("first")
+			require.NoError(t, archive.AddDir(src, "/data", tt.opts))
+
+			for path, e := range tt.expected {
+				entry, err := archive.fileTree.GetEntry(path)
+				require.NoError(t, err, path)
+				assert.Equal(t, e.Type, entry.Type, path)
+				assert.Equal(t, e.RelatedPath, entry.RelatedPath, path)
+			}
+			for _, path := range tt.missing {
+				_, err := archive.fileTree.GetEntry(path)
+				assert.ErrorIs(t, err, files.ErrEntryNotExists, path)
+			}
+		})
+	}
+
+	t.Run("invalid pattern", func(t *testing.T) {
+		archive := New("first")
+		err := archive.AddDir(src, "/data", DirOptions{Exclude: []string{"["}})
+		assert.ErrorContains(t, err, "invalid pattern [")
+	})
+
+	t.Run("nonexisting", func(t *testing.T) {
+		archive := New("first")
+		err := archive.AddDir(filepath.Join(src, "nonexisting"), "/data", DirOptions{})
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("readlink not supported", func(t *testing.T) {
+		// Wrap, so only the fs.FS interface is exposed.
+		sourceFS := struct{ fs.FS }{fstest.MapFS{
+			"src/link": &fstest.MapFile{Mode: fs.ModeSymlink},
+		}}
+		archive := Archive{sourceFS: sourceFS}
+		err := archive.AddDir("/src", "/data", DirOptions{})
+		assert.ErrorContains(t, err, "readlink src/link: not supported by file system")
+	})
+}
+
+func TestArchiveAddDevice(t *testing.T) {
+	archive := New("first")
+
+	require.NoError(t, archive.AddDevice("/dev/console", fs.ModeDevice|fs.ModeCharDevice|0600, 5, 1))
+	require.NoError(t, archive.AddDevice("/dev/null", fs.ModeDevice|fs.ModeCharDevice|0666, 1, 3))
+	require.NoError(t, archive.AddDevice("/dev/sda", fs.ModeDevice, 8, 0))
+
+	expected := map[string]files.Entry{
+		"/dev/console": {Type: files.TypeCharDevice, Mode: modePtr(0600), Major: 5, Minor: 1},
+		"/dev/null":    {Type: files.TypeCharDevice, Mode: modePtr(0666), Major: 1, Minor: 3},
+		"/dev/sda":     {Type: files.TypeBlockDevice, Major: 8},
+	}
+	for path, e := range expected {
+		entry, err := archive.fileTree.GetEntry(path)
+		require.NoError(t, err, path)
+		assert.Equal(t, e, *entry, path)
+	}
+
+	err := archive.AddDevice("/dev/null", fs.ModeDevice|fs.ModeCharDevice, 1, 3)
+	assert.ErrorContains(t, err, "add node /dev/null: entry exists")
+	err = archive.AddDevice("/dev/tty", fs.ModeCharDevice, 5, 0)
+	assert.ErrorContains(t, err, "not a device mode for /dev/tty")
+	err = archive.AddDevice("/dev/tty", fs.ModeDevice|fs.ModeDir, 5, 0)
+	assert.ErrorContains(t, err, "invalid mode for /dev/tty")
+}
+
+func TestArchiveAddFIFO(t *testing.T) {
+	archive := New("first")
+
+	require.NoError(t, archive.AddFIFO("/run/log.fifo", 0620))
+	entry, err := archive.fileTree.GetEntry("/run/log.fifo")
+	require.NoError(t, err)
+	assert.Equal(t, files.Entry{Type: files.TypeFIFO, Mode: modePtr(0620)}, *entry)
+
+	err = archive.AddFIFO("/run/log.fifo", 0620)
+	assert.ErrorContains(t, err, "add node /run/log.fifo: entry exists")
+	err = archive.AddFIFO("/run/other", fs.ModeNamedPipe)
+	assert.ErrorContains(t, err, "invalid mode for /run/other")
+}
+
+func TestArchiveAddSocket(t *testing.T) {
+	archive := New("first")
+
+	require.NoError(t, archive.AddSocket("/run/init.sock", 0))
+	entry, err := archive.fileTree.GetEntry("/run/init.sock")
+	require.NoError(t, err)
+	assert.Equal(t, files.Entry{Type: files.TypeSocket}, *entry)
+
+	err = archive.AddSocket("/run/other", fs.ModeSocket)
+	assert.ErrorContains(t, err, "invalid mode for /run/other")
+}
+
+func TestArchiveAddHardLink(t *testing.T) {
+	archive := New("first")
+	require.NoError(t, archive.AddFile("busybox", "/bin/busybox"))
+	require.NoError(t, archive.fileTree.Ln("/files", "/link"))
+
+	require.NoError(t, archive.AddHardLink("/bin/sh", "/files/busybox"))
+	require.NoError(t, archive.AddHardLink("/bin/ls", "/bin/sh"))
+
+	for _, path := range []string{"/bin/sh", "/bin/ls"} {
+		entry, err := archive.fileTree.GetEntry(path)
+		require.NoError(t, err, path)
+		assert.Equal(t, files.TypeHardLink, entry.Type, path)
+		assert.Equal(t, "/files/busybox", entry.RelatedPath, path)
+	}
+
+	err := archive.AddHardLink("/bin/sh", "/init")
+	assert.ErrorContains(t, err, "add hard link /bin/sh: entry exists")
+	err = archive.AddHardLink("/bin/cat", "/link")
+	assert.ErrorContains(t, err, "target /link: not a regular file")
+	err = archive.AddHardLink("/bin/cat", "/nonexisting")
+	assert.ErrorContains(t, err, "get target /nonexisting: entry does not exist")
+	err = archive.SetMode("/bin/sh", 0755)
+	assert.ErrorContains(t, err, "set mode of hard link /bin/sh")
+	err = archive.SetOwner("/bin/sh", 0, 0)
+	assert.ErrorContains(t, err, "set owner of hard link /bin/sh")
+}
+
+func TestArchiveSetMode(t *testing.T) {
+	archive := New("first")
+	require.NoError(t, archive.AddFile("secret", "/etc/secret"))
+	require.NoError(t, archive.fileTree.Ln("/files", "/link"))
+	_, err := archive.fileTree.Mkdir("/tmp")
+	require.NoError(t, err)
+
+	require.NoError(t, archive.SetMode("/files/secret", 0600))
+	require.NoError(t, archive.SetMode("/tmp", fs.ModeSticky|0777))
+	require.NoError(t, archive.AddFile("shadow", "/etc/shadow"))
+	require.NoError(t, archive.SetMode("/files/shadow", 0))
+
+	e, err := archive.fileTree.GetEntry("/files/secret")
+	require.NoError(t, err)
+	assert.Equal(t, modePtr(0600), e.Mode)
+	e, err = archive.fileTree.GetEntry("/tmp")
+	require.NoError(t, err)
+	assert.Equal(t, modePtr(fs.ModeSticky|0777), e.Mode)
+	e, err = archive.fileTree.GetEntry("/files/shadow")
+	require.NoError(t, err)
+	assert.Equal(t, modePtr(0), e.Mode)
+
+	err = archive.SetMode("/link", 0644)
+	assert.ErrorContains(t, err, "set mode of link /link: not supported")
+	err = archive.SetMode("/nonexisting", 0644)
+	assert.ErrorContains(t, err, "entry does not exist")
+	err = archive.SetMode("/tmp", fs.ModeDir|0755)
+	assert.ErrorContains(t, err, "invalid mode for /tmp")
+}
+
+func TestArchiveSetOwner(t *testing.T) {
+	archive := New("first")
+	require.NoError(t, archive.SetOwner("/init", 1000, 100))
+
+	e, err := archive.fileTree.GetEntry("/init")
+	require.NoError(t, err)
+	assert.Equal(t, &files.Owner{UID: 1000, GID: 100}, e.Owner)
+
+	err = archive.SetOwner("/nonexisting", 0, 0)
+	assert.ErrorContains(t, err, "entry does not exist")
+	err = archive.SetOwner("/init", -1, 0)
+	assert.ErrorContains(t, err, "invalid owner for /init: -1:0")
+}
+
 func TestArchiveWriteTo(t *testing.T) {
 	testFS := fstest.MapFS{
 		"input": &fstest.MapFile{},
@@ -75,7 +380,7 @@ func TestArchiveWriteTo(t *testing.T) {
 		i := Archive{sourceFS: testFS}
 		_, err := i.fileTree.GetRoot().AddEntry("init", entry)
 		require.NoError(t, err)
-		return i.writeTo(w)
+		return i.writeTo(w, writeOptions{})
 	}
 
 	t.Run("unknown file type", func(t *testing.T) {
@@ -92,6 +397,15 @@ func TestArchiveWriteTo(t *testing.T) {
 		assert.ErrorContains(t, err, "open nonexisting: file does not exist")
 	})
 
+	t.Run("dangling hard link", func(t *testing.T) {
+		entry := &files.Entry{
+			Type:        files.TypeHardLink,
+			RelatedPath: "/nonexisting",
+		}
+		err := test(entry, &archive.MockWriter{})
+		assert.ErrorContains(t, err, "hard link /init: get target: entry does not exist")
+	})
+
 	t.Run("existing files", func(t *testing.T) {
 		tests := []struct {
 			name  string
@@ -107,7 +421,43 @@ func TestArchiveWriteTo(t *testing.T) {
 				mock: archive.MockWriter{
 					Path:   "/init",
 					Source: testFile,
-					Mode:   0755,
+				},
+			},
+			{
+				name: "regular with mode and owner",
+				entry: files.Entry{
+					Type:        files.TypeRegular,
+					RelatedPath: "/input",
+					Mode:        modePtr(0600),
+					Owner:       &files.Owner{UID: 1000, GID: 100},
+				},
+				mock: archive.MockWriter{
+					Path:   "/init",
+					Source: testFile,
+					Mode:   0600,
+					Owner:  archive.Owner{UID: 1000, GID: 100},
+				},
+			},
+			{
+				name: "regular with mode 0",
+				entry: files.Entry{
+					Type:        files.TypeRegular,
+					RelatedPath: "/input",
+					Mode:        modePtr(0),
+				},
+				mock: archive.MockWriter{
+					Path:   "/init",
+					Source: testFile,
+				},
+			},
+			{
+				name: "directory with mode 0",
+				entry: files.Entry{
+					Type: files.TypeDirectory,
+					Mode: modePtr(0),
+				},
+				mock: archive.MockWriter{
+					Path: "/init",
 				},
 			},
 			{
@@ -117,6 +467,66 @@ func TestArchiveWriteTo(t *testing.T) {
 				},
 				mock: archive.MockWriter{
 					Path: "/init",
+					Mode: 0755,
+				},
+			},
+			{
+				name: "directory with mode",
+				entry: files.Entry{
+					Type: files.TypeDirectory,
+					Mode: modePtr(fs.ModeSticky | 0777),
+				},
+				mock: archive.MockWriter{
+					Path: "/init",
+					Mode: fs.ModeSticky | 0777,
+				},
+			},
+			{
+				name: "char device",
+				entry: files.Entry{
+					Type:  files.TypeCharDevice,
+					Major: 5,
+					Minor: 1,
+				},
+				mock: archive.MockWriter{
+					Path:  "/init",
+					Mode:  fs.ModeDevice | fs.ModeCharDevice | 0600,
+					Major: 5,
+					Minor: 1,
+				},
+			},
+			{
+				name: "block device",
+				entry: files.Entry{
+					Type:  files.TypeBlockDevice,
+					Mode:  modePtr(0660),
+					Major: 8,
+				},
+				mock: archive.MockWriter{
+					Path:  "/init",
+					Mode:  fs.ModeDevice | 0660,
+					Major: 8,
+				},
+			},
+			{
+				name: "fifo",
+				entry: files.Entry{
+					Type: files.TypeFIFO,
+				},
+				mock: archive.MockWriter{
+					Path: "/init",
+					Mode: fs.ModeNamedPipe | 0600,
+				},
+			},
+			{
+				name: "socket",
+				entry: files.Entry{
+					Type: files.TypeSocket,
+					Mode: modePtr(0755),
+				},
+				mock: archive.MockWriter{
+					Path: "/init",
+					Mode: fs.ModeSocket | 0755,
 				},
 			},
 			{
@@ -140,7 +550,7 @@ func TestArchiveWriteTo(t *testing.T) {
 					_, err := i.fileTree.GetRoot().AddEntry("init", &tt.entry)
 					require.NoError(t, err)
 					mock := archive.MockWriter{}
-					err = i.writeTo(&mock)
+					err = i.writeTo(&mock, writeOptions{})
 					require.NoError(t, err)
 					assert.Equal(t, tt.mock, mock)
 				})
@@ -149,7 +559,7 @@ func TestArchiveWriteTo(t *testing.T) {
 					_, err := i.fileTree.GetRoot().AddEntry("init", &tt.entry)
 					require.NoError(t, err)
 					mock := archive.MockWriter{Err: assert.AnError}
-					err = i.writeTo(&mock)
+					err = i.writeTo(&mock, writeOptions{})
 					assert.Error(t, err, assert.AnError)
 				})
 			})
@@ -157,8 +567,205 @@ func TestArchiveWriteTo(t *testing.T) {
 	})
 }
 
+func TestArchiveWriteCPIO(t *testing.T) {
+	testFS := fstest.MapFS{
+		"input": &fstest.MapFile{Data: []byte("content")},
+	}
+	a := Archive{sourceFS: testFS}
+	_, err := a.fileTree.GetRoot().AddFile("init", "/input")
+	require.NoError(t, err)
+
+	t.Run("uncompressed", func(t *testing.T) {
+		var b bytes.Buffer
+		require.NoError(t, a.WriteCPIO(&b))
+		h, err := cpio.NewReader(&b).Next()
+		require.NoError(t, err)
+		assert.Equal(t, "/init", h.Name)
+	})
+
+	t.Run("gzip", func(t *testing.T) {
+		var b bytes.Buffer
+		require.NoError(t, a.WriteCPIO(&b, WithCompression(CompressionGzip)))
+		gr, err := gzip.NewReader(&b)
+		require.NoError(t, err)
+		r := cpio.NewReader(gr)
+		h, err := r.Next()
+		require.NoError(t, err)
+		assert.Equal(t, "/init", h.Name)
+		_, err = r.Next()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("unknown compression", func(t *testing.T) {
+		err := a.WriteCPIO(&bytes.Buffer{}, WithCompression(Compression(99)))
+		assert.ErrorContains(t, err, "unknown compression 99")
+	})
+}
+
+func TestArchiveWriteCPIOReproducible(t *testing.T) {
+	build := func(t *testing.T, modTime time.Time, opts ...WriteOption) []byte {
+		testFS := fstest.MapFS{
+			"input": &fstest.MapFile{Data: []byte("content"), ModTime: modTime},
+		}
+		a := Archive{sourceFS: testFS}
+		_, err := a.fileTree.GetRoot().AddFile("init", "/input")
+		require.NoError(t, err)
+		require.NoError(t, a.AddFiles("/input"))
+		require.NoError(t, a.AddFile("other", "/input"))
+		require.NoError(t, a.fileTree.Ln("/files", "/lib"))
+
+		var b bytes.Buffer
+		require.NoError(t, a.WriteCPIO(&b, opts...))
+		return b.Bytes()
+	}
+
+	t.Run("byte-identical", func(t *testing.T) {
+		first := build(t, time.Unix(1000, 0), WithReproducible())
+		second := build(t, time.Unix(2000, 0), WithReproducible())
+		assert.Equal(t, first, second)
+	})
+
+	t.Run("differs without", func(t *testing.T) {
+		first := build(t, time.Unix(1000, 0))
+		second := build(t, time.Unix(2000, 0))
+		assert.NotEqual(t, first, second)
+	})
+
+	t.Run("source date epoch", func(t *testing.T) {
+		t.Setenv(SourceDateEpochEnv, "1700000000")
+		r := cpio.NewReader(bytes.NewReader(build(t, time.Now(), WithReproducible())))
+		var names []string
+		for {
+			h, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			names = append(names, h.Name)
+			assert.Equal(t, time.Unix(1700000000, 0), h.ModTime, h.Name)
+			assert.Zero(t, h.Uid, h.Name)
+			assert.Zero(t, h.Guid, h.Name)
+		}
+		expected := []string{"/files", "/files/input", "/files/other", "/init", "/lib"}
+		assert.Equal(t, expected, names)
+	})
+
+	t.Run("invalid source date epoch", func(t *testing.T) {
+		t.Setenv(SourceDateEpochEnv, "yesterday")
+		a := Archive{sourceFS: fstest.MapFS{}}
+		err := a.WriteCPIO(&bytes.Buffer{}, WithReproducible())
+		assert.ErrorContains(t, err, "invalid SOURCE_DATE_EPOCH: yesterday")
+	})
+}
+
+func TestArchiveWriteCPIOContent(t *testing.T) {
+	a := Archive{sourceFS: fstest.MapFS{}}
+	require.NoError(t, a.AddContent("/init", []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, a.AddContent("/etc/a", []byte("same"), 0))
+	require.NoError(t, a.AddContent("/etc/b", []byte("same"), 0))
+	require.NoError(t, a.AddHardLink("/etc/c", "/etc/b"))
+
+	var b bytes.Buffer
+	require.NoError(t, a.WriteCPIO(&b))
+
+	type result struct {
+		inode int64
+		mode  cpio.FileMode
+		links int
+		body  string
+	}
+	results := make(map[string]result)
+	r := cpio.NewReader(&b)
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		body, err := io.ReadAll(r)
+		require.NoError(t, err)
+		results[h.Name] = result{h.Inode, h.Mode, h.Links, string(body)}
+	}
+
+	assert.Equal(t, "#!/bin/sh\n", results["/init"].body)
+	assert.EqualValues(t, 0755|cpio.TypeReg, results["/init"].mode)
+	assert.Equal(t, "same", results["/etc/a"].body)
+	assert.EqualValues(t, 0644|cpio.TypeReg, results["/etc/a"].mode)
+	assert.Equal(t, 1, results["/etc/a"].links)
+	assert.NotEqual(t, results["/etc/a"].inode, results["/etc/b"].inode)
+	assert.Equal(t, results["/etc/b"].inode, results["/etc/c"].inode)
+	assert.Equal(t, 2, results["/etc/c"].links)
+	assert.Equal(t, "same", results["/etc/c"].body)
+
+	t.Run("content error", func(t *testing.T) {
+		a := Archive{sourceFS: fstest.MapFS{}}
+		require.NoError(t, a.AddContentFunc("/init", func() (io.ReadCloser, int64, error) {
+			return nil, 0, assert.AnError
+		}, 0))
+		err := a.WriteCPIO(&bytes.Buffer{})
+		assert.ErrorContains(t, err, "open content: "+assert.AnError.Error())
+	})
+}
+
+func TestArchiveWriteCPIOHardLinks(t *testing.T) {
+	testFS := fstest.MapFS{
+		"busybox": &fstest.MapFile{Data: []byte("busybox"), Mode: 0755},
+	}
+	a := Archive{sourceFS: testFS}
+	_, err := a.fileTree.GetRoot().AddFile("init", "/busybox")
+	require.NoError(t, err)
+	require.NoError(t, a.AddFile("", "/busybox"))
+	require.NoError(t, a.AddHardLink("/bin/sh", "/init"))
+	require.NoError(t, a.AddFile("copy", "/busybox"))
+	require.NoError(t, a.SetMode("/files/copy", 0700))
+
+	var b bytes.Buffer
+	require.NoError(t, a.WriteCPIO(&b, WithReproducible()))
+
+	type result struct {
+		inode int64
+		links int
+		size  int64
+	}
+	results := make(map[string]result)
+	r := cpio.NewReader(&b)
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		results[h.Name] = result{h.Inode, h.Links, h.Size}
+	}
+
+	linked := []string{"/bin/sh", "/files/busybox", "/init"}
+	for _, name := range linked {
+		assert.Equal(t, results[linked[0]].inode, results[name].inode, name)
+		assert.Equal(t, 3, results[name].links, name)
+	}
+	assert.Zero(t, results["/bin/sh"].size)
+	assert.Zero(t, results["/files/busybox"].size)
+	assert.EqualValues(t, 7, results["/init"].size)
+
+	// Different mode, so not linked.
+	assert.NotEqual(t, results["/init"].inode, results["/files/copy"].inode)
+	assert.Equal(t, 1, results["/files/copy"].links)
+	assert.EqualValues(t, 7, results["/files/copy"].size)
+}
+
+func TestArchiveNewWithFS(t *testing.T) {
+	testFS := fstest.MapFS{}
+	archive := NewWithFS(testFS, "/bin/init")
+	assert.Equal(t, testFS, archive.sourceFS)
+	entry, err := archive.fileTree.GetEntry("/init")
+	require.NoError(t, err)
+	assert.Equal(t, "/bin/init", entry.RelatedPath)
+	assert.Equal(t, files.TypeRegular, entry.Type)
+}
+
 func TestArchiveResolveLinkedLibs(t *testing.T) {
-	archive := New("internal/files/testdata/bin/main")
+	// Resolve in the repository directory as root.
+	archive := NewWithFS(os.DirFS("."), "internal/files/testdata/bin/main")
 	err := archive.ResolveLinkedLibs("internal/files/testdata/lib")
 	require.NoError(t, err)
 
@@ -191,6 +798,16 @@ func TestArchiveResolveLinkedLibs(t *testing.T) {
 			Type:        files.TypeLink,
 			RelatedPath: "/lib",
 		},
+		// Interpreter is found in the search path, but must be present at the
+		// path main requests. The default search path "/lib64" is linked.
+		"/lib/ld-linux-x86-64.so.2": {
+			Type:        files.TypeRegular,
+			RelatedPath: "internal/files/testdata/lib/ld-linux-x86-64.so.2",
+		},
+		"/lib64": {
+			Type:        files.TypeLink,
+			RelatedPath: "/lib",
+		},
 	}
 
 	for f, e := range expectedFiles {
@@ -199,4 +816,320 @@ func TestArchiveResolveLinkedLibs(t *testing.T) {
 		assert.Equal(t, e.Type, entry.Type)
 		assert.Equal(t, e.RelatedPath, entry.RelatedPath)
 	}
+
+	// All files must be readable from the source file system.
+	require.NoError(t, archive.WriteCPIO(io.Discard))
+}
+
+func TestArchiveDependencies(t *testing.T) {
+	archive := NewWithFS(os.DirFS("."), "internal/files/testdata/bin/main")
+	require.NoError(t, archive.ResolveLinkedLibs("internal/files/testdata/lib"))
+	// Resolving again must not duplicate the graph.
+	require.NoError(t, archive.ResolveLinkedLibs("internal/files/testdata/lib"))
+
+	lib := "internal/files/testdata/lib/"
+	expected := []Dependency{
+		{
+			Requester:   "internal/files/testdata/bin/main",
+			Name:        "/lib64/ld-linux-x86-64.so.2",
+			Path:        lib + "ld-linux-x86-64.so.2",
+			Interpreter: true,
+		},
+		{Requester: "internal/files/testdata/bin/main", Name: "libfunc2.so", Path: lib + "libfunc2.so"},
+		{Requester: "internal/files/testdata/bin/main", Name: "libfunc3.so", Path: lib + "libfunc3.so"},
+		{Requester: lib + "libfunc3.so", Name: "libfunc1.so", Path: lib + "libfunc1.so"},
+	}
+	assert.Equal(t, expected, archive.Dependencies())
+}
+
+func TestArchiveResolveLinkedLibsMapFS(t *testing.T) {
+	testFS := fstest.MapFS{}
+	for _, file := range []string{"bin/main", "lib/libfunc1.so", "lib/libfunc2.so", "lib/libfunc3.so", "lib/ld-linux-x86-64.so.2"} {
+		data, err := os.ReadFile(filepath.Join("internal/files/testdata", file))
+		require.NoError(t, err)
+		testFS["usr/"+file] = &fstest.MapFile{Data: data, Mode: 0755}
+	}
+
+	archive := NewWithFS(testFS, "/usr/bin/main")
+	require.NoError(t, archive.ResolveLinkedLibs("/usr/lib"))
+
+	for _, lib := range []string{"libfunc1.so", "libfunc2.so", "libfunc3.so", "ld-linux-x86-64.so.2"} {
+		entry, err := archive.fileTree.GetEntry(filepath.Join("/lib", lib))
+		require.NoError(t, err, lib)
+		assert.Equal(t, "/usr/lib/"+lib, entry.RelatedPath)
+	}
+	require.NoError(t, archive.WriteCPIO(io.Discard))
+}
+
+func TestArchiveResolveLinkedLibsKeepGoing(t *testing.T) {
+	// libfunc1.so, required by libfunc3.so, and the interpreter are missing.
+	testFS := fstest.MapFS{}
+	for _, file := range []string{"bin/main", "lib/libfunc2.so", "lib/libfunc3.so"} {
+		data, err := os.ReadFile(filepath.Join("internal/files/testdata", file))
+		require.NoError(t, err)
+		testFS["usr/"+file] = &fstest.MapFile{Data: data, Mode: 0755}
+	}
+
+	t.Run("abort", func(t *testing.T) {
+		archive := NewWithFS(testFS, "/usr/bin/main")
+		err := archive.ResolveLinkedLibs("/usr/lib")
+		assert.ErrorContains(t, err, "resolve: interpreter could not be resolved")
+	})
+
+	t.Run("keep going", func(t *testing.T) {
+		archive := NewWithFS(testFS, "/usr/bin/main")
+		err := archive.ResolveLinkedLibs("/usr/lib", WithKeepGoing(), WithAllowMissing("ld-linux-*"))
+
+		var unresolvedErr *UnresolvedLibsError
+		require.ErrorAs(t, err, &unresolvedErr)
+		require.Len(t, unresolvedErr.Libs, 1)
+		assert.Equal(t, "/usr/lib/libfunc3.so", unresolvedErr.Libs[0].Requester)
+		assert.Equal(t, "libfunc1.so", unresolvedErr.Libs[0].Name)
+		assert.EqualError(t, err, "1 libs could not be resolved: "+
+			"/usr/lib/libfunc3.so: lib could not be resolved: libfunc1.so")
+
+		// Resolved libs are added nevertheless.
+		for _, lib := range []string{"libfunc2.so", "libfunc3.so"} {
+			_, err := archive.fileTree.GetEntry(filepath.Join("/lib", lib))
+			require.NoError(t, err, lib)
+		}
+		require.NoError(t, archive.WriteCPIO(io.Discard))
+	})
+}
+
+func TestArchiveResolveLinkedLibsSysroot(t *testing.T) {
+	// Libraries are installed in "/opt/libs" of the sysroot and linked with
+	// absolute links that must not be followed on the host.
+	root := filepath.Join(t.TempDir(), "sysroot")
+	libDir := filepath.Join(root, "usr", "lib", "x86_64-linux-gnu")
+	optDir := filepath.Join(root, "opt", "libs")
+	require.NoError(t, os.MkdirAll(libDir, 0755))
+	require.NoError(t, os.MkdirAll(optDir, 0755))
+	interp := "ld-linux-x86-64.so.2"
+	for _, lib := range []string{"libfunc1.so", "libfunc2.so", "libfunc3.so", interp} {
+		data, err := os.ReadFile(filepath.Join("internal/files/testdata/lib", lib))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(optDir, lib), data, 0755))
+	}
+	for _, lib := range []string{"libfunc1.so", "libfunc2.so", "libfunc3.so"} {
+		require.NoError(t, os.Symlink("/opt/libs/"+lib, filepath.Join(libDir, lib)))
+	}
+	// Interpreter is only present at the path main requests.
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "lib64"), 0755))
+	require.NoError(t, os.Symlink("/opt/libs/"+interp, filepath.Join(root, "lib64", interp)))
+
+	initFile, err := filepath.Abs("internal/files/testdata/bin/main")
+	require.NoError(t, err)
+
+	archive := NewWithFS(files.DirFS("/"), initFile)
+	require.NoError(t, archive.ResolveLinkedLibs("", WithSysroot(root)))
+
+	for _, lib := range []string{"libfunc1.so", "libfunc2.so", "libfunc3.so", interp} {
+		entry, err := archive.fileTree.GetEntry(filepath.Join("/lib", lib))
+		require.NoError(t, err, lib)
+		assert.Equal(t, filepath.Join(optDir, lib), entry.RelatedPath)
+	}
+
+	// Default search paths of the machine are linked to the libs directory.
+	for _, path := range []string{"/lib/x86_64-linux-gnu", "/usr/lib/x86_64-linux-gnu", "/lib64"} {
+		entry, err := archive.fileTree.GetEntry(path)
+		require.NoError(t, err, path)
+		assert.Equal(t, files.TypeLink, entry.Type, path)
+		assert.Equal(t, "/lib", entry.RelatedPath, path)
+	}
+
+	require.NoError(t, archive.WriteCPIO(io.Discard))
+}
+
+func TestArchiveResolveLinkedLibsLinkChain(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "sysroot")
+	libDir := filepath.Join(root, "lib")
+	require.NoError(t, os.MkdirAll(libDir, 0755))
+	copyLib := func(t *testing.T, lib, name string) {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join("internal/files/testdata/lib", lib))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(libDir, name), data, 0755))
+	}
+	for _, lib := range []string{"libfunc1.so", "libfunc3.so", "ld-linux-x86-64.so.2"} {
+		copyLib(t, lib, lib)
+	}
+	copyLib(t, "libfunc2.so", "libfunc2.so.1.0.0")
+	require.NoError(t, os.Symlink("libfunc2.so.1.0.0", filepath.Join(libDir, "libfunc2.so.1")))
+	require.NoError(t, os.Symlink("libfunc2.so.1", filepath.Join(libDir, "libfunc2.so")))
+
+	initFile, err := filepath.Abs("internal/files/testdata/bin/main")
+	require.NoError(t, err)
+
+	archive := NewWithFS(files.DirFS("/"), initFile)
+	require.NoError(t, archive.ResolveLinkedLibs("", WithSysroot(root)))
+
+	entry, err := archive.fileTree.GetEntry("/lib/libfunc2.so.1.0.0")
+	require.NoError(t, err)
+	assert.Equal(t, files.TypeRegular, entry.Type)
+	assert.Equal(t, filepath.Join(libDir, "libfunc2.so.1.0.0"), entry.RelatedPath)
+
+	for link, target := range map[string]string{
+		"/lib/libfunc2.so":   "libfunc2.so.1",
+		"/lib/libfunc2.so.1": "libfunc2.so.1.0.0",
+	} {
+		entry, err := archive.fileTree.GetEntry(link)
+		require.NoError(t, err, link)
+		assert.Equal(t, files.TypeLink, entry.Type, link)
+		assert.Equal(t, target, entry.RelatedPath, link)
+	}
+
+	require.NoError(t, archive.WriteCPIO(io.Discard))
+}
+
+func TestArchiveResolveLinkedLibsNameCollision(t *testing.T) {
+	// libfunc2.so links to a different file with the name of libfunc1.so.
+	root := filepath.Join(t.TempDir(), "sysroot")
+	for _, dir := range []string{"lib", "opt"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0755))
+	}
+	for lib, path := range map[string]string{
+		"libfunc1.so":          "lib/libfunc1.so",
+		"libfunc2.so":          "opt/libfunc1.so",
+		"libfunc3.so":          "lib/libfunc3.so",
+		"ld-linux-x86-64.so.2": "lib/ld-linux-x86-64.so.2",
+	} {
+		data, err := os.ReadFile(filepath.Join("internal/files/testdata/lib", lib))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(root, path), data, 0755))
+	}
+	require.NoError(t, os.Symlink("/opt/libfunc1.so", filepath.Join(root, "lib", "libfunc2.so")))
+
+	initFile, err := filepath.Abs("internal/files/testdata/bin/main")
+	require.NoError(t, err)
+
+	archive := NewWithFS(files.DirFS("/"), initFile)
+	err = archive.ResolveLinkedLibs("", WithSysroot(root))
+	assert.ErrorContains(t, err, "name collision libfunc1.so")
+}
+
+func TestArchiveResolveLinkedLibsDLOpen(t *testing.T) {
+	archive := NewWithFS(os.DirFS("."), "internal/files/testdata/bin/main_dlopen")
+	err := archive.ResolveLinkedLibs("internal/files/testdata/lib",
+		WithDLOpen(DLOpenRecommended),
+		WithHints(map[string][]string{"libfunc2.so": {"ld-linux-x86-64.so.2"}}),
+	)
+	require.NoError(t, err)
+
+	for _, lib := range []string{"libfunc1.so", "libfunc2.so", "libfunc3.so", "ld-linux-x86-64.so.2"} {
+		entry, err := archive.fileTree.GetEntry(filepath.Join("/lib", lib))
+		require.NoError(t, err, lib)
+		assert.Equal(t, files.TypeRegular, entry.Type, lib)
+	}
+	assert.Contains(t, archive.Dependencies(), Dependency{
+		Requester: "internal/files/testdata/bin/main_dlopen",
+		Name:      "libfunc3.so",
+		Path:      "internal/files/testdata/lib/libfunc3.so",
+		DLOpen:    true,
+	})
+
+	require.NoError(t, archive.WriteCPIO(io.Discard))
+}
+
+func TestArchiveResolveLinkedLibsScripts(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "sysroot")
+	for _, dir := range []string{"lib", "bin"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0755))
+	}
+	for _, lib := range []string{"libfunc1.so", "libfunc2.so", "libfunc3.so", "ld-linux-x86-64.so.2"} {
+		data, err := os.ReadFile(filepath.Join("internal/files/testdata/lib", lib))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(root, "lib", lib), data, 0755))
+	}
+	data, err := os.ReadFile("internal/files/testdata/bin/main")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(root, "bin", "busybox"), data, 0755))
+	require.NoError(t, os.Symlink("busybox", filepath.Join(root, "bin", "sh")))
+
+	dir := t.TempDir()
+	initFile := filepath.Join(dir, "init")
+	dataFile := filepath.Join(dir, "data")
+	require.NoError(t, os.WriteFile(initFile, []byte("#!/bin/sh\nexec /bin/sh\n"), 0755))
+	require.NoError(t, os.WriteFile(dataFile, []byte("data\n"), 0644))
+
+	t.Run("skipped", func(t *testing.T) {
+		archive := NewWithFS(files.DirFS("/"), initFile)
+		require.NoError(t, archive.AddFile("", dataFile))
+		require.NoError(t, archive.ResolveLinkedLibs("", WithSysroot(root)))
+
+		_, err := archive.fileTree.GetEntry("/bin/sh")
+		assert.ErrorIs(t, err, files.ErrEntryNotExists)
+	})
+
+	t.Run("interpreter", func(t *testing.T) {
+		archive := NewWithFS(files.DirFS("/"), initFile)
+		require.NoError(t, archive.AddFile("", dataFile))
+		require.NoError(t, archive.ResolveLinkedLibs("", WithSysroot(root), WithScripts()))
+
+		entry, err := archive.fileTree.GetEntry("/bin/busybox")
+		require.NoError(t, err)
+		assert.Equal(t, files.TypeRegular, entry.Type)
+		assert.Equal(t, filepath.Join(root, "bin", "busybox"), entry.RelatedPath)
+
+		entry, err = archive.fileTree.GetEntry("/bin/sh")
+		require.NoError(t, err)
+		assert.Equal(t, files.TypeLink, entry.Type)
+		assert.Equal(t, "busybox", entry.RelatedPath)
+
+		for _, lib := range []string{"libfunc1.so", "libfunc2.so", "libfunc3.so", "ld-linux-x86-64.so.2"} {
+			_, err := archive.fileTree.GetEntry(filepath.Join("/lib", lib))
+			require.NoError(t, err, lib)
+		}
+		require.NoError(t, archive.WriteCPIO(io.Discard))
+	})
+
+	t.Run("interpreter in archive", func(t *testing.T) {
+		archive := NewWithFS(files.DirFS("/"), initFile)
+		require.NoError(t, archive.AddFileAt("/bin/sh", dataFile))
+		require.NoError(t, archive.ResolveLinkedLibs("", WithSysroot(root), WithScripts()))
+
+		_, err := archive.fileTree.GetEntry("/bin/busybox")
+		assert.ErrorIs(t, err, files.ErrEntryNotExists)
+		_, err = archive.fileTree.GetEntry("/lib/libfunc1.so")
+		assert.ErrorIs(t, err, files.ErrEntryNotExists)
+	})
+}
+
+func TestArchiveResolveLinkedLibsLDConfig(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "sysroot")
+	libs := []string{"libfunc1.so", "libfunc2.so", "libfunc3.so", "ld-linux-x86-64.so.2"}
+	for _, dir := range []string{"etc", "lib64", "opt/func"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0755))
+	}
+	for _, lib := range libs {
+		data, err := os.ReadFile(filepath.Join("internal/files/testdata/lib", lib))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(root, "opt/func", lib), data, 0755))
+	}
+	require.NoError(t, os.Symlink("/opt/func/ld-linux-x86-64.so.2", filepath.Join(root, "lib64/ld-linux-x86-64.so.2")))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "etc/ld.so.conf"), []byte("/opt/func\n"), 0644))
+
+	initFile, err := filepath.Abs("internal/files/testdata/bin/main")
+	require.NoError(t, err)
+
+	t.Run("without", func(t *testing.T) {
+		archive := NewWithFS(files.DirFS("/"), initFile)
+		err := archive.ResolveLinkedLibs("", WithSysroot(root))
+		assert.ErrorContains(t, err, "lib could not be resolved: libfunc2.so")
+	})
+
+	t.Run("with", func(t *testing.T) {
+		archive := NewWithFS(files.DirFS("/"), initFile)
+		require.NoError(t, archive.ResolveLinkedLibs("", WithSysroot(root), WithLDConfig()))
+		for _, lib := range libs {
+			entry, err := archive.fileTree.GetEntry(filepath.Join("/lib", lib))
+			require.NoError(t, err, lib)
+			assert.Equal(t, filepath.Join(root, "opt/func", lib), entry.RelatedPath)
+		}
+	})
+}
+
+// modePtr returns a pointer to the given mode for [files.Entry.Mode].
+func modePtr(mode fs.FileMode) *fs.FileMode {
+	return &mode
 }
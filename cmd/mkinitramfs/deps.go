@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/aibor/initramfs"
+)
+
+// depsFormats are the formats supported by [writeDeps].
+var depsFormats = []string{"text", "json", "dot"}
+
+// writeDeps writes the given dependency graph in the given format: "text" for
+// a tree like lddtree prints, "json" for the list of edges or "dot" for a
+// Graphviz digraph.
+func writeDeps(w io.Writer, format string, deps []initramfs.Dependency) error {
+	switch format {
+	case "text":
+		return writeDepsText(w, deps)
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if deps == nil {
+			deps = []initramfs.Dependency{}
+		}
+		return encoder.Encode(deps)
+	case "dot":
+		return writeDepsDOT(w, deps)
+	default:
+		return fmt.Errorf("unknown deps format: %s", format)
+	}
+}
+
+// writeDepsText writes a tree for each file that is not required by any
+// other. The dependencies of each library are printed on its first
+// occurrence only.
+func writeDepsText(w io.Writer, deps []initramfs.Dependency) error {
+	var (
+		roots    []string
+		required = make(map[string]bool)
+		children = make(map[string][]initramfs.Dependency)
+	)
+	for _, dep := range deps {
+		required[dep.Path] = true
+	}
+	for _, dep := range deps {
+		if _, exists := children[dep.Requester]; !exists && !required[dep.Requester] {
+			roots = append(roots, dep.Requester)
+		}
+		children[dep.Requester] = append(children[dep.Requester], dep)
+	}
+
+	var builder strings.Builder
+	printed := make(map[string]bool)
+	var walk func(path string, depth int)
+	walk = func(path string, depth int) {
+		if printed[path] {
+			return
+		}
+		printed[path] = true
+		for _, dep := range children[path] {
+			fmt.Fprintf(&builder, "%s%s => %s", strings.Repeat("    ", depth), dep.Name, dep.Path)
+			switch {
+			case dep.Interpreter:
+				builder.WriteString(" (interpreter)")
+			case dep.DLOpen:
+				builder.WriteString(" (dlopen)")
+			}
+			builder.WriteString("\n")
+			walk(dep.Path, depth+1)
+		}
+	}
+	for _, root := range roots {
+		builder.WriteString(root + "\n")
+		walk(root, 1)
+	}
+
+	_, err := io.WriteString(w, builder.String())
+	return err
+}
+
+// writeDepsDOT writes a Graphviz digraph with an edge labeled with the
+// required name for each dependency. Edges to program interpreters are
+// dashed, edges to libraries loaded with dlopen are dotted.
+func writeDepsDOT(w io.Writer, deps []initramfs.Dependency) error {
+	var builder strings.Builder
+	builder.WriteString("digraph dependencies {\n")
+	for _, dep := range deps {
+		attrs := "label=" + strconv.Quote(dep.Name)
+		switch {
+		case dep.Interpreter:
+			attrs += ", style=dashed"
+		case dep.DLOpen:
+			attrs += ", style=dotted"
+		}
+		fmt.Fprintf(&builder, "\t%s -> %s [%s];\n",
+			strconv.Quote(dep.Requester), strconv.Quote(dep.Path), attrs)
+	}
+	builder.WriteString("}\n")
+
+	_, err := io.WriteString(w, builder.String())
+	return err
+}
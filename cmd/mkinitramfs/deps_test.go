@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aibor/initramfs"
+)
+
+func TestWriteDeps(t *testing.T) {
+	deps := []initramfs.Dependency{
+		{Requester: "/bin/main", Name: "libfunc1.so", Path: "/lib/libfunc1.so"},
+		{Requester: "/lib/libfunc1.so", Name: "libfunc2.so", Path: "/lib/libfunc2.so"},
+		{
+			Requester:   "/bin/main",
+			Name:        "/lib64/ld-linux-x86-64.so.2",
+			Path:        "/lib/ld-linux-x86-64.so.2",
+			Interpreter: true,
+		},
+		{Requester: "/bin/main", Name: "libfunc3.so", Path: "/lib/libfunc3.so", DLOpen: true},
+		{Requester: `/bin/"quoted" tool`, Name: "libfunc1.so", Path: "/lib/libfunc1.so"},
+	}
+
+	tests := []struct {
+		format   string
+		deps     []initramfs.Dependency
+		expected string
+	}{
+		{
+			format: "text",
+			deps:   deps,
+			expected: "" +
+				"/bin/main\n" +
+				"    libfunc1.so => /lib/libfunc1.so\n" +
+				"        libfunc2.so => /lib/libfunc2.so\n" +
+				"    /lib64/ld-linux-x86-64.so.2 => /lib/ld-linux-x86-64.so.2 (interpreter)\n" +
+				"    libfunc3.so => /lib/libfunc3.so (dlopen)\n" +
+				"/bin/\"quoted\" tool\n" +
+				"    libfunc1.so => /lib/libfunc1.so\n",
+		},
+		{
+			format: "json",
+			deps:   deps[2:4],
+			expected: "" +
+				"[\n" +
+				"  {\n" +
+				"    \"requester\": \"/bin/main\",\n" +
+				"    \"name\": \"/lib64/ld-linux-x86-64.so.2\",\n" +
+				"    \"path\": \"/lib/ld-linux-x86-64.so.2\",\n" +
+				"    \"interpreter\": true\n" +
+				"  },\n" +
+				"  {\n" +
+				"    \"requester\": \"/bin/main\",\n" +
+				"    \"name\": \"libfunc3.so\",\n" +
+				"    \"path\": \"/lib/libfunc3.so\",\n" +
+				"    \"dlopen\": true\n" +
+				"  }\n" +
+				"]\n",
+		},
+		{
+			format:   "json",
+			expected: "[]\n",
+		},
+		{
+			format: "dot",
+			deps:   deps,
+			expected: "" +
+				"digraph dependencies {\n" +
+				"\t\"/bin/main\" -> \"/lib/libfunc1.so\" [label=\"libfunc1.so\"];\n" +
+				"\t\"/lib/libfunc1.so\" -> \"/lib/libfunc2.so\" [label=\"libfunc2.so\"];\n" +
+				"\t\"/bin/main\" -> \"/lib/ld-linux-x86-64.so.2\" [label=\"/lib64/ld-linux-x86-64.so.2\", style=dashed];\n" +
+				"\t\"/bin/main\" -> \"/lib/libfunc3.so\" [label=\"libfunc3.so\", style=dotted];\n" +
+				"\t\"/bin/\\\"quoted\\\" tool\" -> \"/lib/libfunc1.so\" [label=\"libfunc1.so\"];\n" +
+				"}\n",
+		},
+		{
+			format:   "dot",
+			expected: "digraph dependencies {\n}\n",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.format, func(t *testing.T) {
+			var b bytes.Buffer
+			require.NoError(t, writeDeps(&b, tt.format, tt.deps))
+			assert.Equal(t, tt.expected, b.String())
+		})
+	}
+
+	t.Run("unknown format", func(t *testing.T) {
+		err := writeDeps(&bytes.Buffer{}, "yaml", deps)
+		assert.ErrorContains(t, err, "unknown deps format: yaml")
+	})
+}
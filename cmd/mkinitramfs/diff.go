@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/aibor/initramfs"
+)
+
+// diffFormats are the formats supported by [writeDiff].
+var diffFormats = []string{"text", "json"}
+
+// errImagesDiffer is returned by the diff subcommand if the images differ, so
+// it exits with status 1 like diff(1).
+var errImagesDiffer = errors.New("images differ")
+
+func runDiff(args []string) error {
+	flagSet := newSubcommandFlagSet("diff", "old-image new-image",
+		"Compares the files of the images by type, mode, owner, size, content, "+
+			"symbolic link target and device numbers. Modification times are ignored. "+
+			"Exits with status 1 if the images differ.\n"+
+			"Use \"-\" to read one of the images from stdin.")
+	format := flagSet.String("format", "text", "output format: text or json")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 2 {
+		return fmt.Errorf("expected two image files, got %d arguments", flagSet.NArg())
+	}
+	if !slices.Contains(diffFormats, *format) {
+		return fmt.Errorf("unknown diff format: %s", *format)
+	}
+
+	oldImg, err := readImage(flagSet.Arg(0))
+	if err != nil {
+		return fmt.Errorf("read %s: %v", flagSet.Arg(0), err)
+	}
+	newImg, err := readImage(flagSet.Arg(1))
+	if err != nil {
+		return fmt.Errorf("read %s: %v", flagSet.Arg(1), err)
+	}
+
+	changes := initramfs.DiffImages(oldImg, newImg)
+	if err := writeDiff(os.Stdout, *format, changes); err != nil {
+		return err
+	}
+	if len(changes) > 0 {
+		return errImagesDiffer
+	}
+	return nil
+}
+
+// writeDiff writes the given changes in the given format: "text" for a line
+// per change followed by a summary or "json" for the list of changes.
+func writeDiff(w io.Writer, format string, changes []initramfs.ImageChange) error {
+	switch format {
+	case "text":
+		return writeDiffText(w, changes)
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		jsonChanges := make([]diffJSONChange, 0, len(changes))
+		for _, change := range changes {
+			jsonChanges = append(jsonChanges, diffJSONChange{
+				Path:       change.Path,
+				Kind:       string(change.Kind),
+				Attributes: change.Attributes,
+				Old:        newDiffJSONEntry(change.Old),
+				New:        newDiffJSONEntry(change.New),
+			})
+		}
+		return encoder.Encode(jsonChanges)
+	default:
+		return fmt.Errorf("unknown diff format: %s", format)
+	}
+}
+
+// writeDiffText writes a line for each change, prefixed with "+" for added,
+// "-" for removed and "~" for modified entries, followed by a summary line.
+func writeDiffText(w io.Writer, changes []initramfs.ImageChange) error {
+	var (
+		builder strings.Builder
+		counts  = make(map[initramfs.ChangeKind]int)
+		delta   int64
+	)
+	for _, change := range changes {
+		counts[change.Kind]++
+		switch change.Kind {
+		case initramfs.ChangeAdded:
+			delta += change.New.Size
+			fmt.Fprintf(&builder, "+ %s\n", listEntry(change.New))
+		case initramfs.ChangeRemoved:
+			delta -= change.Old.Size
+			fmt.Fprintf(&builder, "- %s\n", listEntry(change.Old))
+		case initramfs.ChangeModified:
+			delta += change.New.Size - change.Old.Size
+			details := make([]string, 0, len(change.Attributes))
+			for _, attribute := range change.Attributes {
+				details = append(details, diffAttribute(attribute, change.Old, change.New))
+			}
+			fmt.Fprintf(&builder, "~ %s: %s\n", change.Path, strings.Join(details, ", "))
+		}
+	}
+	fmt.Fprintf(&builder, "%d added, %d removed, %d modified, size %+d bytes\n",
+		counts[initramfs.ChangeAdded], counts[initramfs.ChangeRemoved],
+		counts[initramfs.ChangeModified], delta)
+
+	_, err := io.WriteString(w, builder.String())
+	return err
+}
+
+// diffAttribute describes the change of the given attribute from the old to
+// the new entry, like "mode -rwxr-xr-x -> -rwx------".
+func diffAttribute(attribute string, oldEntry, newEntry *initramfs.ImageEntry) string {
+	var oldValue, newValue string
+	switch attribute {
+	case initramfs.DiffType, initramfs.DiffMode:
+		oldValue, newValue = lsMode(oldEntry.Mode), lsMode(newEntry.Mode)
+	case initramfs.DiffOwner:
+		oldValue = fmt.Sprintf("%d:%d", oldEntry.UID, oldEntry.GID)
+		newValue = fmt.Sprintf("%d:%d", newEntry.UID, newEntry.GID)
+	case initramfs.DiffSize:
+		oldValue, newValue = fmt.Sprint(oldEntry.Size), fmt.Sprint(newEntry.Size)
+	case initramfs.DiffContent:
+		oldValue, newValue = shortDigest(oldEntry.Digest()), shortDigest(newEntry.Digest())
+	case initramfs.DiffTarget:
+		oldValue, newValue = oldEntry.LinkTarget, newEntry.LinkTarget
+	case initramfs.DiffDevice:
+		oldValue = fmt.Sprintf("%d,%d", oldEntry.Major, oldEntry.Minor)
+		newValue = fmt.Sprintf("%d,%d", newEntry.Major, newEntry.Minor)
+	}
+	return fmt.Sprintf("%s %s -> %s", attribute, oldValue, newValue)
+}
+
+// shortDigest returns the first 12 characters of the given digest.
+func shortDigest(digest string) string {
+	if len(digest) > 12 {
+		return digest[:12]
+	}
+	return digest
+}
+
+// diffJSONChange is the JSON representation of an [initramfs.ImageChange].
+type diffJSONChange struct {
+	Path       string         `json:"path"`
+	Kind       string         `json:"kind"`
+	Attributes []string       `json:"attributes,omitempty"`
+	Old        *diffJSONEntry `json:"old,omitempty"`
+	New        *diffJSONEntry `json:"new,omitempty"`
+}
+
+// diffJSONEntry is the JSON representation of an [initramfs.ImageEntry].
+type diffJSONEntry struct {
+	Mode   string `json:"mode"`
+	UID    int    `json:"uid"`
+	GID    int    `json:"gid"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	Target string `json:"target,omitempty"`
+	Device string `json:"device,omitempty"`
+}
+
+func newDiffJSONEntry(entry *initramfs.ImageEntry) *diffJSONEntry {
+	if entry == nil {
+		return nil
+	}
+	jsonEntry := &diffJSONEntry{
+		Mode:   lsMode(entry.Mode),
+		UID:    entry.UID,
+		GID:    entry.GID,
+		Size:   entry.Size,
+		SHA256: entry.Digest(),
+		Target: entry.LinkTarget,
+	}
+	if entry.Major != 0 || entry.Minor != 0 {
+		jsonEntry.Device = fmt.Sprintf("%d,%d", entry.Major, entry.Minor)
+	}
+	return jsonEntry
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunDiff(t *testing.T) {
+	image, offset := writeTestImage(t)
+	data, err := os.ReadFile(image)
+	require.NoError(t, err)
+	// The first segment only.
+	first := filepath.Join(t.TempDir(), "first.img")
+	require.NoError(t, os.WriteFile(first, data[:offset], 0644))
+
+	t.Run("equal", func(t *testing.T) {
+		stdout, _, err := runOutput(t, "diff", image, image)
+		require.NoError(t, err)
+		assert.Equal(t, "0 added, 0 removed, 0 modified, size +0 bytes\n", stdout)
+	})
+
+	t.Run("differ", func(t *testing.T) {
+		stdout, _, err := runOutput(t, "diff", first, image)
+		assert.ErrorIs(t, err, errImagesDiffer)
+		assert.Equal(t, ""+
+			"+ -rw-r--r--     0     0          6 1970-01-01 00:00 /etc/motd\n"+
+			"~ /init: mode -rwxr-xr-x -> -rwx------, size 7 -> 4, content 9d75f0d7c398 -> bb54068aea85\n"+
+			"1 added, 0 removed, 1 modified, size +3 bytes\n",
+			stdout)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		stdout, _, err := runOutput(t, "diff", "-format", "json", image, first)
+		assert.ErrorIs(t, err, errImagesDiffer)
+		assert.Contains(t, stdout, `"path": "/etc/motd",`)
+		assert.Contains(t, stdout, `"kind": "removed",`)
+	})
+
+	t.Run("missing image", func(t *testing.T) {
+		_, _, err := runOutput(t, "diff", image, filepath.Join(t.TempDir(), "missing"))
+		assert.ErrorContains(t, err, "no such file or directory")
+		assert.NotErrorIs(t, err, errImagesDiffer)
+	})
+}
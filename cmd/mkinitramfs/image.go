@@ -0,0 +1,303 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aibor/initramfs"
+)
+
+// subcommands are the commands operating on existing images. They are run
+// if the first argument matches their name.
+var subcommands = map[string]func(args []string) error{
+	"list":    runList,
+	"extract": runExtract,
+	"cat":     runCat,
+	"diff":    runDiff,
+}
+
+// newSubcommandFlagSet returns a new [flag.FlagSet] for the subcommand with
+// the given name and usage of its arguments.
+func newSubcommandFlagSet(name, usage, description string) *flag.FlagSet {
+	flagSet := flag.NewFlagSet("mkinitramfs "+name, flag.ContinueOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: %s [flags] %s\n\n", flagSet.Name(), usage)
+		fmt.Fprintln(flagSet.Output(), description)
+		fmt.Fprintln(flagSet.Output())
+		flagSet.PrintDefaults()
+	}
+	return flagSet
+}
+
+func runList(args []string) error {
+	flagSet := newSubcommandFlagSet("list", "image",
+		"Lists the files of the image like \"ls -l\". Use \"-\" to read the image from stdin.")
+	segments := flagSet.Bool("segments", false,
+		"list the segments of the image with their offset and compression instead")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 1 {
+		return fmt.Errorf("expected image file, got %d arguments", flagSet.NArg())
+	}
+
+	img, err := readImage(flagSet.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	var builder strings.Builder
+	if *segments {
+		for _, segment := range img.Segments() {
+			fmt.Fprintf(&builder, "%10d %s\n", segment.Offset, segment.Compression)
+		}
+	} else {
+		for _, entry := range img.Entries() {
+			builder.WriteString(listEntry(entry) + "\n")
+		}
+	}
+	_, err = io.WriteString(os.Stdout, builder.String())
+	return err
+}
+
+// listEntry formats the given entry like "ls -l" does.
+func listEntry(entry *initramfs.ImageEntry) string {
+	size := fmt.Sprint(entry.Size)
+	if entry.Mode&fs.ModeDevice != 0 {
+		size = fmt.Sprintf("%d, %d", entry.Major, entry.Minor)
+	}
+	line := fmt.Sprintf("%s %5d %5d %10s %s %s",
+		lsMode(entry.Mode), entry.UID, entry.GID, size,
+		entry.ModTime.UTC().Format("2006-01-02 15:04"), entry.Path)
+	if entry.Mode.Type() == fs.ModeSymlink {
+		line += " -> " + entry.LinkTarget
+	}
+	return line
+}
+
+// lsMode formats the given mode like "ls -l" does, which differs from
+// [fs.FileMode.String] for file types and special bits.
+func lsMode(mode fs.FileMode) string {
+	buf := []byte("-rwxrwxrwx")
+	switch mode.Type() {
+	case fs.ModeDir:
+		buf[0] = 'd'
+	case fs.ModeSymlink:
+		buf[0] = 'l'
+	case fs.ModeDevice:
+		buf[0] = 'b'
+	case fs.ModeDevice | fs.ModeCharDevice:
+		buf[0] = 'c'
+	case fs.ModeNamedPipe:
+		buf[0] = 'p'
+	case fs.ModeSocket:
+		buf[0] = 's'
+	}
+	for idx := 0; idx < 9; idx++ {
+		if mode&(1<<uint(8-idx)) == 0 {
+			buf[idx+1] = '-'
+		}
+	}
+
+	special := []struct {
+		bit   fs.FileMode
+		idx   int
+		upper byte
+	}{
+		{fs.ModeSetuid, 3, 'S'},
+		{fs.ModeSetgid, 6, 'S'},
+		{fs.ModeSticky, 9, 'T'},
+	}
+	for _, s := range special {
+		if mode&s.bit == 0 {
+			continue
+		}
+		if buf[s.idx] == '-' {
+			buf[s.idx] = s.upper
+		} else {
+			buf[s.idx] = s.upper + 'a' - 'A'
+		}
+	}
+
+	return string(buf)
+}
+
+func runExtract(args []string) error {
+	flagSet := newSubcommandFlagSet("extract", "image dir",
+		"Extracts the files of the image into the directory, which must be empty or not exist. "+
+			"Owners are not set. Device nodes are skipped, unless -devices is given.\n"+
+			"Use \"-\" to read the image from stdin.")
+	devices := flagSet.Bool("devices", false,
+		"create device nodes; they are skipped with a warning, if not permitted")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 2 {
+		return fmt.Errorf("expected image file and directory, got %d arguments", flagSet.NArg())
+	}
+	dir := flagSet.Arg(1)
+
+	img, err := readImage(flagSet.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case len(dirEntries) > 0:
+		return fmt.Errorf("directory is not empty: %s", dir)
+	}
+
+	entries := img.Entries()
+	// Parents sort before their children.
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+
+	var dirs []*initramfs.ImageEntry
+	for _, entry := range entries {
+		if entry.Path == "/" {
+			continue
+		}
+		target := filepath.Join(dir, filepath.FromSlash(entry.Path))
+		created, err := extractEntry(img, entry, target, *devices)
+		if err != nil {
+			return fmt.Errorf("extract %s: %v", entry.Path, err)
+		}
+		switch {
+		case !created:
+			fmt.Fprintf(os.Stderr, "Warning: skipped device node %s\n", entry.Path)
+		case entry.Mode.IsDir():
+			dirs = append(dirs, entry)
+		}
+	}
+
+	// Set the mode of directories last, so read-only directories can be
+	// populated.
+	for idx := len(dirs) - 1; idx >= 0; idx-- {
+		target := filepath.Join(dir, filepath.FromSlash(dirs[idx].Path))
+		if err := setMetadata(target, dirs[idx]); err != nil {
+			return fmt.Errorf("extract %s: %v", dirs[idx].Path, err)
+		}
+	}
+
+	return nil
+}
+
+// extractEntry creates the given entry at the given target path. The
+// metadata of directories is not set. It returns false if a device node has
+// been skipped.
+func extractEntry(img *initramfs.Image, entry *initramfs.ImageEntry, target string, devices bool) (bool, error) {
+	switch entry.Mode.Type() {
+	case fs.ModeDir:
+		return true, os.Mkdir(target, 0700)
+	case fs.ModeSymlink:
+		return true, os.Symlink(entry.LinkTarget, target)
+	case fs.ModeDevice, fs.ModeDevice | fs.ModeCharDevice:
+		if !devices {
+			return false, nil
+		}
+		err := mknod(target, entry.Mode, entry.Major, entry.Minor)
+		if errors.Is(err, fs.ErrPermission) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	case fs.ModeNamedPipe, fs.ModeSocket:
+		if err := mknod(target, entry.Mode, 0, 0); err != nil {
+			return false, err
+		}
+	default:
+		if err := extractFile(img, entry, target); err != nil {
+			return false, err
+		}
+	}
+	return true, setMetadata(target, entry)
+}
+
+// extractFile writes the content of the given regular file entry to a new
+// file at the given target path.
+func extractFile(img *initramfs.Image, entry *initramfs.ImageEntry, target string) error {
+	source, err := img.Open(entry.Path[1:])
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, source); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// setMetadata sets the mode and modification time of the given entry for the
+// file at the given target path.
+func setMetadata(target string, entry *initramfs.ImageEntry) error {
+	mode := entry.Mode & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+	if err := os.Chmod(target, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(target, entry.ModTime, entry.ModTime)
+}
+
+func runCat(args []string) error {
+	flagSet := newSubcommandFlagSet("cat", "image file",
+		"Prints the content of the file in the image. Symbolic links are followed. "+
+			"Use \"-\" to read the image from stdin.")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	if flagSet.NArg() != 2 {
+		return fmt.Errorf("expected image file and file path, got %d arguments", flagSet.NArg())
+	}
+
+	img, err := readImage(flagSet.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+flagSet.Arg(1)), "/")
+	if name == "" {
+		name = "."
+	}
+	file, err := img.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(os.Stdout, file)
+	return err
+}
+
+// readImage reads the image from the given file or from stdin, if it is "-".
+// The file is not closed, as the content of files is read from it while the
+// image is used.
+func readImage(name string) (*initramfs.Image, error) {
+	if name == "-" {
+		return initramfs.ReadImage(os.Stdin)
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return initramfs.ReadImage(file)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aibor/initramfs"
+)
+
+// writeTestImage writes an image of an uncompressed and a gzip compressed
+// segment into a temporary file and returns its path and the offset of the
+// second segment.
+func writeTestImage(t *testing.T) (string, int) {
+	t.Helper()
+	t.Setenv(initramfs.SourceDateEpochEnv, "0")
+	testFS := fstest.MapFS{
+		"busybox": &fstest.MapFile{Data: []byte("busybox"), Mode: 0755},
+		"init":    &fstest.MapFile{Data: []byte("init"), Mode: 0700},
+	}
+
+	a := initramfs.NewWithFS(testFS, "/busybox")
+	require.NoError(t, a.AddHardLink("/bin/sh", "/init"))
+	require.NoError(t, a.AddLink("/bin/ash", "sh"))
+	require.NoError(t, a.AddContent("/etc/hostname", []byte("test\n"), 0640))
+	require.NoError(t, a.SetOwner("/etc/hostname", 1, 2))
+	require.NoError(t, a.AddDevice("/dev/console", fs.ModeDevice|fs.ModeCharDevice|0600, 5, 1))
+	var b bytes.Buffer
+	require.NoError(t, a.WriteCPIO(&b, initramfs.WithReproducible()))
+	offset := b.Len()
+
+	// Replaces the init file, but not its hard link.
+	second := initramfs.NewWithFS(testFS, "/init")
+	require.NoError(t, second.AddContent("/etc/motd", []byte("hello\n"), 0))
+	require.NoError(t, second.WriteCPIO(&b,
+		initramfs.WithReproducible(), initramfs.WithCompression(initramfs.CompressionGzip)))
+
+	name := filepath.Join(t.TempDir(), "initramfs.img")
+	require.NoError(t, os.WriteFile(name, b.Bytes(), 0644))
+	return name, offset
+}
+
+// runOutput runs the command with the given arguments and returns what it
+// wrote to stdout and stderr.
+func runOutput(t *testing.T, args ...string) (string, string, error) {
+	t.Helper()
+	dir := t.TempDir()
+	stdout, err := os.Create(filepath.Join(dir, "stdout"))
+	require.NoError(t, err)
+	defer stdout.Close()
+	stderr, err := os.Create(filepath.Join(dir, "stderr"))
+	require.NoError(t, err)
+	defer stderr.Close()
+
+	origStdout, origStderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = stdout, stderr
+	runErr := run(args)
+	os.Stdout, os.Stderr = origStdout, origStderr
+
+	stdoutData, err := os.ReadFile(stdout.Name())
+	require.NoError(t, err)
+	stderrData, err := os.ReadFile(stderr.Name())
+	require.NoError(t, err)
+	return string(stdoutData), string(stderrData), runErr
+}
+
+func TestRunList(t *testing.T) {
+	image, offset := writeTestImage(t)
+
+	t.Run("entries", func(t *testing.T) {
+		stdout, _, err := runOutput(t, "list", image)
+		require.NoError(t, err)
+		assert.Equal(t, ""+
+			"drwxr-xr-x     0     0          0 1970-01-01 00:00 /bin\n"+
+			"lrwxrwxrwx     0     0          2 1970-01-01 00:00 /bin/ash -> sh\n"+
+			"drwxr-xr-x     0     0          0 1970-01-01 00:00 /dev\n"+
+			"crw-------     0     0       5, 1 1970-01-01 00:00 /dev/console\n"+
+			"-rw-r-----     1     2          5 1970-01-01 00:00 /etc/hostname\n"+
+			"-rwxr-xr-x     0     0          7 1970-01-01 00:00 /bin/sh\n"+
+			"drwxr-xr-x     0     0          0 1970-01-01 00:00 /etc\n"+
+			"-rw-r--r--     0     0          6 1970-01-01 00:00 /etc/motd\n"+
+			"-rwx------     0     0          4 1970-01-01 00:00 /init\n",
+			stdout)
+	})
+
+	t.Run("segments", func(t *testing.T) {
+		stdout, _, err := runOutput(t, "list", "-segments", image)
+		require.NoError(t, err)
+		assert.Equal(t, ""+
+			"         0 none\n"+
+			fmt.Sprintf("%10d gzip\n", offset),
+			stdout)
+	})
+
+	t.Run("missing image", func(t *testing.T) {
+		_, _, err := runOutput(t, "list", filepath.Join(t.TempDir(), "missing"))
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+	})
+}
+
+func TestLSMode(t *testing.T) {
+	tests := []struct {
+		mode     fs.FileMode
+		expected string
+	}{
+		{mode: 0644, expected: "-rw-r--r--"},
+		{mode: fs.ModeDir | 0755, expected: "drwxr-xr-x"},
+		{mode: fs.ModeSymlink | 0777, expected: "lrwxrwxrwx"},
+		{mode: fs.ModeDevice | 0660, expected: "brw-rw----"},
+		{mode: fs.ModeDevice | fs.ModeCharDevice | 0600, expected: "crw-------"},
+		{mode: fs.ModeNamedPipe | 0600, expected: "prw-------"},
+		{mode: fs.ModeSocket | 0755, expected: "srwxr-xr-x"},
+		{mode: fs.ModeSetuid | 0755, expected: "-rwsr-xr-x"},
+		{mode: fs.ModeSetuid | 0644, expected: "-rwSr--r--"},
+		{mode: fs.ModeSetgid | 0750, expected: "-rwxr-s---"},
+		{mode: fs.ModeSetgid | 0740, expected: "-rwxr-S---"},
+		{mode: fs.ModeDir | fs.ModeSticky | 0777, expected: "drwxrwxrwt"},
+		{mode: fs.ModeDir | fs.ModeSticky | 0770, expected: "drwxrwx--T"},
+		{mode: 0, expected: "----------"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.expected, func(t *testing.T) {
+			assert.Equal(t, tt.expected, lsMode(tt.mode))
+		})
+	}
+}
+
+func TestRunExtract(t *testing.T) {
+	image, _ := writeTestImage(t)
+
+	assertFiles := func(t *testing.T, dir string) {
+		t.Helper()
+		expected := map[string]string{
+			"init":         "init",
+			"bin/sh":       "busybox",
+			"etc/hostname": "test\n",
+			"etc/motd":     "hello\n",
+			"bin/ash":      "busybox",
+		}
+		for name, content := range expected {
+			actual, err := os.ReadFile(filepath.Join(dir, name))
+			require.NoError(t, err, name)
+			assert.Equal(t, content, string(actual), name)
+		}
+		target, err := os.Readlink(filepath.Join(dir, "bin/ash"))
+		require.NoError(t, err)
+		assert.Equal(t, "sh", target)
+		info, err := os.Stat(filepath.Join(dir, "etc/hostname"))
+		require.NoError(t, err)
+		assert.Equal(t, fs.FileMode(0640), info.Mode())
+	}
+
+	t.Run("skip devices", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "root")
+		_, stderr, err := runOutput(t, "extract", image, dir)
+		require.NoError(t, err)
+		assertFiles(t, dir)
+		assert.Equal(t, "Warning: skipped device node /dev/console\n", stderr)
+		_, err = os.Lstat(filepath.Join(dir, "dev/console"))
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("devices", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("device nodes are only supported on linux")
+		}
+		dir := t.TempDir()
+		_, stderr, err := runOutput(t, "extract", "-devices", image, dir)
+		require.NoError(t, err)
+		assertFiles(t, dir)
+
+		info, err := os.Lstat(filepath.Join(dir, "dev/console"))
+		if os.Geteuid() != 0 {
+			assert.Equal(t, "Warning: skipped device node /dev/console\n", stderr)
+			assert.ErrorIs(t, err, fs.ErrNotExist)
+			return
+		}
+		require.NoError(t, err)
+		assert.Empty(t, stderr)
+		assert.Equal(t, fs.ModeDevice|fs.ModeCharDevice|0600, info.Mode())
+	})
+
+	t.Run("not empty", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "file"), nil, 0644))
+		_, _, err := runOutput(t, "extract", image, dir)
+		assert.ErrorContains(t, err, "directory is not empty")
+	})
+}
+
+func TestRunCat(t *testing.T) {
+	image, _ := writeTestImage(t)
+
+	tests := []struct {
+		name     string
+		expected string
+		errMsg   string
+	}{
+		{name: "/etc/hostname", expected: "test\n"},
+		{name: "etc/motd", expected: "hello\n"},
+		{name: "/bin/sh", expected: "busybox"},
+		{name: "/init", expected: "init"},
+		{name: "/bin/ash", expected: "busybox"},
+		{name: "/etc", errMsg: "is a directory"},
+		{name: "/missing", errMsg: "file does not exist"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, _, err := runOutput(t, "cat", image, tt.name)
+			if tt.errMsg != "" {
+				assert.ErrorContains(t, err, tt.errMsg)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, stdout)
+		})
+	}
+}
@@ -1,48 +1,272 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/slices"
 
 	"github.com/aibor/initramfs"
 )
 
 func run(args []string) error {
+	if len(args) > 0 {
+		if subcommand, exists := subcommands[args[0]]; exists {
+			return subcommand(args[1:])
+		}
+	}
+
+	flagSet := flag.NewFlagSet("mkinitramfs", flag.ContinueOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: %s [flags] init [file|src:dest]...\n", flagSet.Name())
+		fmt.Fprintf(flagSet.Output(), "       %s list|extract|cat|diff [flags] image [args]...\n\n", flagSet.Name())
+		fmt.Fprintln(flagSet.Output(), "Additional files are added to \"/"+initramfs.FilesDir+"\", "+
+			"unless given as \"src:dest\" with an absolute destination path in the archive. "+
+			"The subcommands operate on existing images instead, see \"-h\" of each. "+
+			"Use \"./list\" for an init file named like a subcommand.")
+		fmt.Fprintln(flagSet.Output())
+		flagSet.PrintDefaults()
+	}
+	compress := flagSet.String("compress", "none",
+		"compression algorithm: none, gzip, zstd, xz or lz4")
+	reproducible := flagSet.Bool("reproducible", false,
+		"write byte-identical archives for identical input, using "+
+			initramfs.SourceDateEpochEnv+" as modification time")
+	sysroot := flagSet.String("sysroot", "",
+		"directory linked libraries are resolved in, for building images for another architecture")
+	ldConfig := flagSet.Bool("ldconfig", false,
+		"look up linked libraries in /etc/ld.so.cache and /etc/ld.so.conf, in the sysroot if given")
+	dlopen := flagSet.String("dlopen", "",
+		"resolve libraries listed in .note.dlopen notes with at least the given priority: "+
+			"required, recommended or suggested")
+	hints := hintsFlag{}
+	flagSet.Var(hints, "hint",
+		"additional libraries required by a file, like ones loaded with dlopen, as \"file=lib[,lib...]\", "+
+			"where file is a path or base name; can be repeated")
+	scripts := flagSet.Bool("scripts", false,
+		"add the interpreters of scripts given by their shebang line and resolve their libraries")
+	keepGoing := flagSet.Bool("keep-going", false,
+		"continue if libraries can not be resolved and print them as warnings")
+	allowMissing := flagSet.String("allow-missing", "",
+		"comma separated patterns of libraries that may be missing, like linux-vdso.so.1")
+	deps := flagSet.String("deps", "",
+		"print the dependency graph of the resolved libraries instead of the archive: text, json or dot")
+	microcode := make(map[string][]string)
+	flagSet.Func("microcode",
+		"add CPU microcode updates to an uncompressed early segment as \"vendor=file[,file...]\", "+
+			"like GenuineIntel or AuthenticAMD; can be repeated", func(value string) error {
+			vendor, files, found := strings.Cut(value, "=")
+			if !found || vendor == "" || files == "" {
+				return fmt.Errorf("invalid microcode, must be vendor=file[,file...]: %s", value)
+			}
+			microcode[vendor] = append(microcode[vendor], strings.Split(files, ",")...)
+			return nil
+		})
+	var acpiTables []string
+	flagSet.Func("acpi-table",
+		"add an ACPI table override to an uncompressed early segment; can be repeated", func(value string) error {
+			acpiTables = append(acpiTables, value)
+			return nil
+		})
+	base := flagSet.String("base", "",
+		"existing image the files are added to, like a distribution's initramfs; "+
+			"written as a single segment with the given compression")
+	conflict := flagSet.String("conflict", "replace",
+		"how to handle files already present in the base image: error, keep or replace")
+	if err := flagSet.Parse(args); err != nil {
+		return err
+	}
+	args = flagSet.Args()
+
 	if len(args) == 0 {
 		return fmt.Errorf("no init file given")
 	}
 
-	initFile, err := absPath(args[0])
+	compression, err := initramfs.ParseCompression(*compress)
 	if err != nil {
 		return err
 	}
 
-	additionalFiles := make([]string, 0)
-	for _, file := range args[1:] {
-		path, err := absPath(file)
-		if err != nil {
-			return err
-		}
-		additionalFiles = append(additionalFiles, path)
+	if *deps != "" && !slices.Contains(depsFormats, *deps) {
+		return fmt.Errorf("unknown deps format: %s", *deps)
+	}
+
+	conflictPolicy, err := initramfs.ParseConflictPolicy(*conflict)
+	if err != nil {
+		return err
+	}
+
+	initFile, err := absPath(args[0])
+	if err != nil {
+		return err
 	}
 
 	libSearchPath := os.Getenv("LD_LIBRARY_PATH")
 
 	initRamFS := initramfs.New(initFile)
-	if err := initRamFS.AddFiles(additionalFiles...); err != nil {
-		return fmt.Errorf("add files: %v", err)
+	for _, arg := range args[1:] {
+		if err := addFile(initRamFS, arg); err != nil {
+			return fmt.Errorf("add files: %v", err)
+		}
+	}
+	var resolveOpts []initramfs.ResolveOption
+	if *sysroot != "" {
+		root, err := absPath(*sysroot)
+		if err != nil {
+			return err
+		}
+		resolveOpts = append(resolveOpts, initramfs.WithSysroot(root))
+	}
+	if *ldConfig {
+		resolveOpts = append(resolveOpts, initramfs.WithLDConfig())
+	}
+	if *dlopen != "" {
+		resolveOpts = append(resolveOpts, initramfs.WithDLOpen(*dlopen))
+	}
+	if len(hints) > 0 {
+		resolveOpts = append(resolveOpts, initramfs.WithHints(hints))
 	}
-	if err := initRamFS.ResolveLinkedLibs(libSearchPath); err != nil {
+	if *scripts {
+		resolveOpts = append(resolveOpts, initramfs.WithScripts())
+	}
+	if *keepGoing {
+		resolveOpts = append(resolveOpts, initramfs.WithKeepGoing())
+	}
+	if *allowMissing != "" {
+		resolveOpts = append(resolveOpts, initramfs.WithAllowMissing(strings.Split(*allowMissing, ",")...))
+	}
+	err = initRamFS.ResolveLinkedLibs(libSearchPath, resolveOpts...)
+	var unresolvedErr *initramfs.UnresolvedLibsError
+	if errors.As(err, &unresolvedErr) {
+		for _, lib := range unresolvedErr.Libs {
+			fmt.Fprintf(os.Stderr, "Warning: %s: %v\n", lib.Requester, lib.Err)
+		}
+	} else if err != nil {
 		return fmt.Errorf("add linked libs: %v", err)
 	}
-	if err := initRamFS.WriteCPIO(os.Stdout); err != nil {
+	if *deps != "" {
+		return writeDeps(os.Stdout, *deps, initRamFS.Dependencies())
+	}
+	if *base != "" {
+		merged, err := baseArchive(*base)
+		if err != nil {
+			return fmt.Errorf("base image: %v", err)
+		}
+		if err := merged.Merge(initRamFS, conflictPolicy); err != nil {
+			return err
+		}
+		initRamFS = merged
+	}
+	writeOpts := []initramfs.WriteOption{initramfs.WithCompression(compression)}
+	if *reproducible {
+		writeOpts = append(writeOpts, initramfs.WithReproducible())
+	}
+	parts := []initramfs.ImagePart{{Archive: initRamFS, Options: writeOpts}}
+	if len(microcode) > 0 || len(acpiTables) > 0 {
+		early, err := earlySegment(microcode, acpiTables)
+		if err != nil {
+			return fmt.Errorf("early segment: %v", err)
+		}
+		var earlyOpts []initramfs.WriteOption
+		if *reproducible {
+			earlyOpts = append(earlyOpts, initramfs.WithReproducible())
+		}
+		parts = append([]initramfs.ImagePart{{Archive: early, Options: earlyOpts}}, parts...)
+	}
+	if err := initramfs.WriteImage(os.Stdout, parts...); err != nil {
 		return fmt.Errorf("write: %v", err)
 	}
 
 	return nil
 }
 
+// addFile adds the file given by arg to the archive. The arg is either a
+// path that is added to [initramfs.FilesDir] or a "src:dest" pair, where dest
+// is the path in the archive.
+func addFile(initRamFS *initramfs.Archive, arg string) error {
+	src, dest, hasDest := strings.Cut(arg, ":")
+	path, err := absPath(src)
+	if err != nil {
+		return err
+	}
+	if !hasDest {
+		return initRamFS.AddFiles(path)
+	}
+	if !filepath.IsAbs(dest) {
+		return fmt.Errorf("destination path must be absolute: %s", arg)
+	}
+	return initRamFS.AddFileAt(dest, path)
+}
+
+// baseArchive returns an archive with the entries of the given image, see
+// [readImage].
+func baseArchive(name string) (*initramfs.Archive, error) {
+	img, err := readImage(name)
+	if err != nil {
+		return nil, err
+	}
+	return initramfs.NewFromImage(img)
+}
+
+// earlySegment returns an archive with the given microcode updates per
+// vendor and ACPI table overrides for the early segment of the image.
+func earlySegment(microcode map[string][]string, acpiTables []string) (*initramfs.Archive, error) {
+	early := initramfs.NewSegment()
+	vendors := make([]string, 0, len(microcode))
+	for vendor := range microcode {
+		vendors = append(vendors, vendor)
+	}
+	slices.Sort(vendors)
+	for _, vendor := range vendors {
+		paths := make([]string, 0, len(microcode[vendor]))
+		for _, file := range microcode[vendor] {
+			path, err := absPath(file)
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, path)
+		}
+		if err := early.AddMicrocode(vendor, paths...); err != nil {
+			return nil, err
+		}
+	}
+	for _, file := range acpiTables {
+		path, err := absPath(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := early.AddACPITable(path); err != nil {
+			return nil, err
+		}
+	}
+	return early, nil
+}
+
+// hintsFlag collects the libraries given by repeated "file=lib[,lib...]"
+// flags.
+type hintsFlag map[string][]string
+
+func (h hintsFlag) String() string {
+	var hints []string
+	for file, libs := range h {
+		hints = append(hints, file+"="+strings.Join(libs, ","))
+	}
+	return strings.Join(hints, " ")
+}
+
+func (h hintsFlag) Set(value string) error {
+	file, libs, found := strings.Cut(value, "=")
+	if !found || file == "" || libs == "" {
+		return fmt.Errorf("invalid hint, must be file=lib[,lib...]: %s", value)
+	}
+	h[file] = append(h[file], strings.Split(libs, ",")...)
+	return nil
+}
+
 func absPath(file string) (string, error) {
 	path, err := filepath.Abs(file)
 	if err != nil {
@@ -53,6 +277,12 @@ func absPath(file string) (string, error) {
 
 func main() {
 	if err := run(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		if errors.Is(err, errImagesDiffer) {
+			os.Exit(1)
+		}
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
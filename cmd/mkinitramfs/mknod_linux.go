@@ -0,0 +1,26 @@
+package main
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// mknod creates a device node, named pipe or socket with the given mode and
+// device numbers.
+func mknod(path string, mode fs.FileMode, major, minor uint32) error {
+	var typ uint32
+	switch mode.Type() {
+	case fs.ModeDevice:
+		typ = syscall.S_IFBLK
+	case fs.ModeDevice | fs.ModeCharDevice:
+		typ = syscall.S_IFCHR
+	case fs.ModeNamedPipe:
+		typ = syscall.S_IFIFO
+	case fs.ModeSocket:
+		typ = syscall.S_IFSOCK
+	}
+	// Encoding of dev_t as by glibc's makedev.
+	dev := uint64(minor&0xff) | uint64(major&0xfff)<<8 |
+		uint64(minor&^0xff)<<12 | uint64(major&^0xfff)<<32
+	return syscall.Mknod(path, typ|uint32(mode.Perm()), int(dev))
+}
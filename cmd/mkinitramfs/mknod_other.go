@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+)
+
+// mknod fails, as device nodes, named pipes and sockets can not be created
+// on this platform.
+func mknod(_ string, _ fs.FileMode, _, _ uint32) error {
+	return errors.New("mknod not supported on this platform")
+}
@@ -0,0 +1,75 @@
+package initramfs
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/aibor/initramfs/internal/files"
+)
+
+// Dependency is an edge of the dependency graph of the files resolved by
+// [Archive.ResolveLinkedLibs]. All paths are paths of source files, not of
+// archive entries.
+type Dependency struct {
+	// Requester is the path of the ELF file requiring the dependency.
+	Requester string `json:"requester"`
+	// Name is the name the dependency is required by: the DT_NEEDED entry
+	// for libraries or the PT_INTERP path for program interpreters.
+	Name string `json:"name"`
+	// Path is the path the dependency has been resolved to.
+	Path string `json:"path"`
+	// Interpreter is true, if the dependency is the program interpreter of
+	// the requester.
+	Interpreter bool `json:"interpreter,omitempty"`
+	// DLOpen is true, if the dependency is loaded at runtime with dlopen, see
+	// [WithDLOpen] and [WithHints].
+	DLOpen bool `json:"dlopen,omitempty"`
+}
+
+// Dependencies returns the dependency graph of all files resolved by
+// [Archive.ResolveLinkedLibs] as list of edges, in the order they have been
+// resolved. Each library is listed for every file requiring it, so it can be
+// traced why it has been added to the [Archive].
+func (a *Archive) Dependencies() []Dependency {
+	return slices.Clone(a.dependencies)
+}
+
+// addDependencies adds the given edges, unless present already.
+func (a *Archive) addDependencies(deps []files.Dependency) {
+	for _, dep := range deps {
+		dependency := Dependency(dep)
+		if !slices.Contains(a.dependencies, dependency) {
+			a.dependencies = append(a.dependencies, dependency)
+		}
+	}
+}
+
+// UnresolvedLib is a library or program interpreter required by a file that
+// could not be resolved by [Archive.ResolveLinkedLibs].
+type UnresolvedLib struct {
+	// Requester is the source path of the file requiring the library.
+	Requester string
+	// Name is the name the library is required by. The alternatives of
+	// .note.dlopen entries are joined by ", ".
+	Name string
+	// Err describes why the library could not be resolved.
+	Err error
+}
+
+// UnresolvedLibsError is returned by [Archive.ResolveLinkedLibs] with
+// [WithKeepGoing], if any libraries could not be resolved. All libraries that
+// could be resolved are added to the [Archive] nevertheless.
+type UnresolvedLibsError struct {
+	Libs []UnresolvedLib
+}
+
+// Error returns all unresolved libraries with the files requiring them.
+func (e *UnresolvedLibsError) Error() string {
+	msgs := make([]string, 0, len(e.Libs))
+	for _, lib := range e.Libs {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", lib.Requester, lib.Err))
+	}
+	return fmt.Sprintf("%d libs could not be resolved: %s", len(e.Libs), strings.Join(msgs, "; "))
+}
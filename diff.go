@@ -0,0 +1,172 @@
+package initramfs
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sort"
+
+	"github.com/aibor/initramfs/internal/files"
+)
+
+// ChangeKind is the kind of an [ImageChange].
+type ChangeKind string
+
+const (
+	// ChangeAdded is an entry that is only present in the new image.
+	ChangeAdded ChangeKind = "added"
+	// ChangeRemoved is an entry that is only present in the old image.
+	ChangeRemoved ChangeKind = "removed"
+	// ChangeModified is an entry that is present in both images but differs.
+	ChangeModified ChangeKind = "modified"
+)
+
+// Attributes of entries compared by [DiffImages].
+const (
+	DiffType    = "type"
+	DiffMode    = "mode"
+	DiffOwner   = "owner"
+	DiffSize    = "size"
+	DiffContent = "content"
+	DiffTarget  = "target"
+	DiffDevice  = "device"
+)
+
+// ImageChange is the difference of an entry between two images.
+type ImageChange struct {
+	// Path is the absolute path of the entry.
+	Path string
+	// Kind is the kind of the change.
+	Kind ChangeKind
+	// Attributes are the differing attributes of modified entries, like
+	// [DiffMode] and [DiffContent].
+	Attributes []string
+	// Old is the entry in the old image. It is nil for added entries.
+	Old *ImageEntry
+	// New is the entry in the new image. It is nil for removed entries.
+	New *ImageEntry
+}
+
+// DiffImages compares the entries of the given images by path and returns
+// the changes from the old to the new image sorted by path. Entries are
+// compared by type, mode, owner, size, content, symbolic link target and
+// device numbers. Modification times and inode numbers are ignored, as well
+// as the root directory, if it is not present in the images.
+func DiffImages(oldImg, newImg *Image) []ImageChange {
+	oldTree, oldEntries := imageTree(oldImg)
+	newTree, newEntries := imageTree(newImg)
+
+	var changes []ImageChange
+	addChange := func(path string, oldEntry, newEntry *ImageEntry) {
+		switch {
+		case oldEntry == nil && newEntry == nil:
+		case newEntry == nil:
+			changes = append(changes, ImageChange{Path: path, Kind: ChangeRemoved, Old: oldEntry})
+		case oldEntry == nil:
+			changes = append(changes, ImageChange{Path: path, Kind: ChangeAdded, New: newEntry})
+		default:
+			if attributes := diffEntries(oldEntry, newEntry); len(attributes) > 0 {
+				changes = append(changes, ImageChange{
+					Path:       path,
+					Kind:       ChangeModified,
+					Attributes: attributes,
+					Old:        oldEntry,
+					New:        newEntry,
+				})
+			}
+		}
+	}
+
+	// The root directory is not visited by the walk.
+	addChange("/", oldEntries[oldTree.GetRoot()], newEntries[newTree.GetRoot()])
+	_ = oldTree.Walk(func(path string, entry *files.Entry) error {
+		var newEntry *ImageEntry
+		if newTreeEntry, err := newTree.GetEntry(path); err == nil {
+			newEntry = newEntries[newTreeEntry]
+		}
+		addChange(path, oldEntries[entry], newEntry)
+		return nil
+	})
+	_ = newTree.Walk(func(path string, entry *files.Entry) error {
+		if _, err := oldTree.GetEntry(path); err != nil {
+			addChange(path, nil, newEntries[entry])
+		}
+		return nil
+	})
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
+
+// imageTree returns the entries of the given [Image] as [files.Tree] along
+// with the [ImageEntry] of each of its entries. The root directory has an
+// [ImageEntry] only, if it is present in the image.
+func imageTree(img *Image) (*files.Tree, map[*files.Entry]*ImageEntry) {
+	imgEntries := img.Entries()
+	// Parents sort before their children.
+	sort.Slice(imgEntries, func(i, j int) bool {
+		return imgEntries[i].Path < imgEntries[j].Path
+	})
+
+	var tree files.Tree
+	treeEntries := make(map[*files.Entry]*ImageEntry)
+	for _, imgEntry := range imgEntries {
+		if imgEntry.Path == "/" {
+			treeEntries[tree.GetRoot()] = imgEntry
+			continue
+		}
+		entry := &files.Entry{Type: files.TypeRegular}
+		if imgEntry.Mode.IsDir() {
+			entry.Type = files.TypeDirectory
+		}
+		dir, name := filepath.Split(imgEntry.Path)
+		if dirEntry, err := tree.GetEntry(dir); err == nil {
+			_, _ = dirEntry.AddEntry(name, entry)
+		}
+		treeEntries[entry] = imgEntry
+	}
+	return &tree, treeEntries
+}
+
+// diffEntries returns the attributes the given entries differ in.
+func diffEntries(oldEntry, newEntry *ImageEntry) []string {
+	if oldEntry.Mode.Type() != newEntry.Mode.Type() {
+		return []string{DiffType}
+	}
+
+	var attributes []string
+	if oldEntry.Mode != newEntry.Mode {
+		attributes = append(attributes, DiffMode)
+	}
+	if oldEntry.UID != newEntry.UID || oldEntry.GID != newEntry.GID {
+		attributes = append(attributes, DiffOwner)
+	}
+	switch oldEntry.Mode.Type() {
+	case 0:
+		if oldEntry.Size != newEntry.Size {
+			attributes = append(attributes, DiffSize)
+		}
+		if oldEntry.Digest() != newEntry.Digest() {
+			attributes = append(attributes, DiffContent)
+		}
+	case fs.ModeSymlink:
+		if oldEntry.LinkTarget != newEntry.LinkTarget {
+			attributes = append(attributes, DiffTarget)
+		}
+	case fs.ModeDevice, fs.ModeDevice | fs.ModeCharDevice:
+		if oldEntry.Major != newEntry.Major || oldEntry.Minor != newEntry.Minor {
+			attributes = append(attributes, DiffDevice)
+		}
+	}
+	return attributes
+}
+
+// Digest returns the hex encoded SHA-256 hash of the content of regular
+// files. It is empty for all other entries.
+func (e *ImageEntry) Digest() string {
+	if !e.Mode.IsRegular() || e.content == nil {
+		return ""
+	}
+	return e.content.digest
+}
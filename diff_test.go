@@ -0,0 +1,95 @@
+package initramfs
+
+import (
+	"bytes"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffImages(t *testing.T) {
+	type params struct {
+		hostname string
+		target   string
+		minor    uint32
+		extra    string
+	}
+	build := func(t *testing.T, p params, fn func(a *Archive)) *Image {
+		t.Helper()
+		a := Archive{sourceFS: fstest.MapFS{}}
+		require.NoError(t, a.AddContent("/init", []byte("init"), 0755))
+		require.NoError(t, a.AddContent("/etc/hostname", []byte(p.hostname), 0))
+		require.NoError(t, a.AddLink("/bin/sh", p.target))
+		require.NoError(t, a.AddDevice("/dev/console", fs.ModeDevice|fs.ModeCharDevice|0600, 5, p.minor))
+		require.NoError(t, a.AddContent(p.extra, nil, 0))
+		fn(&a)
+		var b bytes.Buffer
+		require.NoError(t, a.WriteCPIO(&b))
+		img, err := ReadImage(&b)
+		require.NoError(t, err)
+		return img
+	}
+
+	oldImg := build(t, params{"test", "busybox", 1, "/etc/removed"}, func(*Archive) {})
+	newImg := build(t, params{"other!", "dash", 2, "/etc/added"}, func(a *Archive) {
+		require.NoError(t, a.SetMode("/init", 0700))
+		require.NoError(t, a.SetOwner("/init", 1, 2))
+	})
+
+	changes := DiffImages(oldImg, newImg)
+	type change struct {
+		path       string
+		kind       ChangeKind
+		attributes []string
+	}
+	var actual []change
+	for _, c := range changes {
+		actual = append(actual, change{c.Path, c.Kind, c.Attributes})
+	}
+	assert.Equal(t, []change{
+		{"/bin/sh", ChangeModified, []string{DiffTarget}},
+		{"/dev/console", ChangeModified, []string{DiffDevice}},
+		{"/etc/added", ChangeAdded, nil},
+		{"/etc/hostname", ChangeModified, []string{DiffSize, DiffContent}},
+		{"/etc/removed", ChangeRemoved, nil},
+		{"/init", ChangeModified, []string{DiffMode, DiffOwner}},
+	}, actual)
+	assert.Nil(t, changes[2].Old)
+	assert.Nil(t, changes[4].New)
+
+	assert.Empty(t, DiffImages(oldImg, oldImg))
+
+	t.Run("file replaced by directory", func(t *testing.T) {
+		fileImg := build(t, params{"test", "busybox", 1, "/etc/conf"}, func(*Archive) {})
+		dirImg := build(t, params{"test", "busybox", 1, "/etc/conf/a"}, func(*Archive) {})
+
+		var actual []change
+		for _, c := range DiffImages(fileImg, dirImg) {
+			actual = append(actual, change{c.Path, c.Kind, c.Attributes})
+		}
+		assert.Equal(t, []change{
+			{"/etc/conf", ChangeModified, []string{DiffType}},
+			{"/etc/conf/a", ChangeAdded, nil},
+		}, actual)
+	})
+}
+
+func TestImageEntryDigest(t *testing.T) {
+	a := Archive{sourceFS: fstest.MapFS{}}
+	require.NoError(t, a.AddContentString("/hello", "hello", 0))
+	var b bytes.Buffer
+	require.NoError(t, a.WriteCPIO(&b, WithCompression(CompressionGzip)))
+	img, err := ReadImage(&b)
+	require.NoError(t, err)
+
+	info, err := img.Lstat("hello")
+	require.NoError(t, err)
+	assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		info.Sys().(*ImageEntry).Digest())
+	info, err = img.Lstat(".")
+	require.NoError(t, err)
+	assert.Empty(t, info.Sys().(*ImageEntry).Digest())
+}
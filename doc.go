@@ -4,7 +4,34 @@
 // A simple program creating an initramfs archive and writing it to stdout can
 // be found in "cmd/mkinitramfs".
 //
-// Only regular files are copied from the local file system. Mode is always set
-// to 0755. For all added ELF file, the linked libraries can be resolved and
-// added to the archive by calling [Archive.ResolveLinkedLibs].
+// Regular files and symbolic links are copied from the local file system,
+// either individually or as complete directory trees with [Archive.AddDir].
+// Files generated at build time can be added from memory with
+// [Archive.AddContent] without writing them to disk first.
+// The mode and owner of regular files are taken from the source file, unless
+// set explicitly with [Archive.SetMode] and [Archive.SetOwner]. Device nodes
+// like "/dev/console" can be added with [Archive.AddDevice], named pipes and
+// sockets with [Archive.AddFIFO] and [Archive.AddSocket].
+//
+// For all added ELF file, the linked libraries can be resolved and added to
+// the archive by calling [Archive.ResolveLinkedLibs]. Other files are skipped,
+// unless the interpreters of scripts are requested by [WithScripts].
+// Libraries for images of another architecture can be resolved in a sysroot,
+// see [WithSysroot], also using its dynamic linker configuration, see
+// [WithLDConfig]. Libraries loaded at runtime with dlopen can be resolved as
+// well, see [WithDLOpen] and [WithHints]. Why a library has been added can be
+// traced with [Archive.Dependencies]. The archive can be compressed with any
+// of the algorithms supported by the kernel, see [WithCompression]. Images of
+// multiple segments with independent compression are written with
+// [WriteImage], like with an uncompressed early segment for CPU microcode
+// updates and ACPI table overrides, see [Archive.AddMicrocode] and
+// [Archive.AddACPITable].
+//
+// Existing images, including compressed and concatenated ones, can be read
+// with [ReadImage]. The returned [Image] is an [io/fs.FS] of the unpacked file
+// tree, so it can be inspected or used as source of a new [Archive]. Two
+// images can be compared with [DiffImages]. To add files on top of an existing
+// image, like a distribution's initramfs, create an [Archive] from it with
+// [NewFromImage], which reads the original content from the image when written,
+// and combine archives with [Archive.Merge] using a [ConflictPolicy].
 package initramfs
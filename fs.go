@@ -0,0 +1,26 @@
+package initramfs
+
+import (
+	"io"
+	"io/fs"
+	"time"
+)
+
+// contentFile is an [fs.File] for in-memory content of regular files. It has
+// mode [FileMode] and no modification time.
+type contentFile struct {
+	io.ReadCloser
+	size int64
+}
+
+// Stat returns the [fs.FileInfo] of the content.
+func (f *contentFile) Stat() (fs.FileInfo, error) {
+	return f, nil
+}
+
+func (f *contentFile) Name() string       { return "content" }
+func (f *contentFile) Size() int64        { return f.size }
+func (f *contentFile) Mode() fs.FileMode  { return FileMode }
+func (f *contentFile) ModTime() time.Time { return time.Time{} }
+func (f *contentFile) IsDir() bool        { return false }
+func (f *contentFile) Sys() any           { return nil }
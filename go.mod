@@ -4,7 +4,10 @@ go 1.18
 
 require (
 	github.com/cavaliergopher/cpio v1.0.1
+	github.com/klauspost/compress v1.17.0
+	github.com/pierrec/lz4/v4 v4.1.21
 	github.com/stretchr/testify v1.8.4
+	github.com/ulikunitz/xz v0.5.11
 	golang.org/x/exp v0.0.0-20231006140011-7918f672742d
 )
 
@@ -0,0 +1,99 @@
+package initramfs
+
+import (
+	"fmt"
+	"io/fs"
+
+	"github.com/aibor/initramfs/internal/files"
+)
+
+// hardLinkKey identifies regular file entries that can be written as hard
+// links of each other. This is the case if they have the same source file in
+// the same source file system and the same metadata. Entries with
+// [files.Content] are unique.
+type hardLinkKey struct {
+	source   string
+	sourceFS fs.FS
+	content  *files.Entry
+	mode     fs.FileMode
+	hasMode  bool
+	owner    files.Owner
+	hasOwner bool
+}
+
+func newHardLinkKey(entry *files.Entry) hardLinkKey {
+	key := hardLinkKey{
+		source:   entry.RelatedPath,
+		sourceFS: entry.SourceFS,
+	}
+	if entry.Mode != nil {
+		key.mode = *entry.Mode
+		key.hasMode = true
+	}
+	if entry.Content != nil {
+		key.content = entry
+	}
+	if entry.Owner != nil {
+		key.owner = *entry.Owner
+		key.hasOwner = true
+	}
+	return key
+}
+
+// hardLinkGroup is a set of archive paths that are written as hard links of
+// the same file.
+type hardLinkGroup struct {
+	// Archive paths in walk order.
+	paths []string
+	// Regular file entry all paths link to.
+	entry *files.Entry
+}
+
+// hardLinkGroups collects all regular files and hard links that link to the
+// same file. The returned map contains the group for each path of groups with
+// more than one path.
+func (a *Archive) hardLinkGroups() (map[string]*hardLinkGroup, error) {
+	groups := make(map[hardLinkKey]*hardLinkGroup)
+
+	err := a.fileTree.Walk(func(path string, entry *files.Entry) error {
+		switch entry.Type {
+		case files.TypeRegular:
+		case files.TypeHardLink:
+			target, err := a.fileTree.GetEntry(entry.RelatedPath)
+			if err != nil {
+				return fmt.Errorf("hard link %s: get target: %v", path, err)
+			}
+			if !target.IsRegular() {
+				return fmt.Errorf("hard link %s: target %s is not a regular file",
+					path, entry.RelatedPath)
+			}
+			entry = target
+		default:
+			return nil
+		}
+
+		key := newHardLinkKey(entry)
+		group, exists := groups[key]
+		if !exists {
+			group = &hardLinkGroup{entry: entry}
+			groups[key] = group
+		}
+		group.paths = append(group.paths, path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pathGroups := make(map[string]*hardLinkGroup)
+	for _, group := range groups {
+		if len(group.paths) < 2 {
+			continue
+		}
+		for _, path := range group.paths {
+			pathGroups[path] = group
+		}
+	}
+
+	return pathGroups, nil
+}
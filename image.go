@@ -0,0 +1,655 @@
+package initramfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/aibor/initramfs/internal/archive"
+	"github.com/aibor/initramfs/internal/files"
+)
+
+// ImageSegment is a part of an [Image], that is either uncompressed or
+// compressed as a whole.
+type ImageSegment = archive.Segment
+
+// ImageEntry is a single entry of an [Image].
+type ImageEntry struct {
+	// Path is the absolute path of the entry, like "/init".
+	Path string
+	// Mode are the type and permission bits of the entry.
+	Mode fs.FileMode
+	// UID and GID are the numeric owner of the entry.
+	UID, GID int
+	// ModTime is the modification time of the entry.
+	ModTime time.Time
+	// Size is the size of the content of regular files and of the target
+	// of symbolic links.
+	Size int64
+	// Inode and NLink are the inode number and the number of hard links of
+	// the entry as stored in the archive.
+	Inode, NLink uint32
+	// Major and Minor are the device numbers of device nodes.
+	Major, Minor uint32
+	// LinkTarget is the target of symbolic links.
+	LinkTarget string
+	// Segment is the index of the [ImageSegment] the entry was read from.
+	Segment int
+
+	// content is the content of regular files. Hard links share it.
+	content *imageContent
+	// order is the position of the entry in the image.
+	order int
+	// linkID identifies the hard links of regular files.
+	linkID hardLinkID
+}
+
+// Image is an initramfs image read by [ReadImage]. It represents the file
+// tree the kernel would unpack from the image. It implements [fs.StatFS],
+// [fs.ReadDirFS] and [fs.ReadFileFS] as well as the ReadLink and Lstat
+// methods of file systems with symbolic links, so it can be used as source
+// file system for [NewWithFS]. The [fs.FileInfo] of all files returns the
+// [ImageEntry] from its Sys method.
+type Image struct {
+	entries  map[string]*ImageEntry
+	children map[string][]string
+	segments []ImageSegment
+	src      io.ReaderAt
+
+	// decoders holds a decoder of each compressed segment that is not in
+	// use, so reading content in image order decompresses each segment
+	// once.
+	decoders   map[int]*segmentDecoder
+	decodersMu sync.Mutex
+}
+
+// imageContent is the content of a regular file in an [Image].
+type imageContent struct {
+	// segment is the index of the [ImageSegment] of the content.
+	segment int
+	// offset is the offset of the content in the uncompressed data of its
+	// segment.
+	offset int64
+	size   int64
+	// digest is the hex encoded SHA-256 hash of the content.
+	digest string
+}
+
+// hardLinkID identifies the entries of an archive that are hard links of the
+// same file. The kernel forgets all hard links at the end of each archive, so
+// the same inode in another archive is another file.
+type hardLinkID struct {
+	archive            int
+	inode              uint32
+	devMajor, devMinor uint32
+}
+
+// ReadImage reads an initramfs image like the Linux kernel does: it may
+// consist of multiple concatenated newc CPIO archives, each of which may be
+// compressed with any [Compression]. Entries with the same path replace
+// earlier ones. Missing parent directories are added with [DirMode].
+//
+// The content of regular files is not kept in memory, but read from r on
+// demand, if r implements [io.ReaderAt] and [io.Seeker], like [os.File]. So r
+// must not be closed or modified as long as the image is used. Any other r
+// is read into memory completely.
+func ReadImage(r io.Reader) (*Image, error) {
+	src, err := imageSource(r)
+	if err != nil {
+		return nil, fmt.Errorf("read image: %v", err)
+	}
+	img := &Image{
+		entries:  make(map[string]*ImageEntry),
+		src:      src,
+		decoders: make(map[int]*segmentDecoder),
+	}
+	hardLinks := make(map[hardLinkID][]*ImageEntry)
+	archiveIdx := 0
+
+	reader := archive.NewCPIOReader(io.NewSectionReader(src, 0, math.MaxInt64))
+	for order := 0; ; order++ {
+		hdr, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read image: %v", err)
+		}
+		// The kernel forgets all hard links at the end of each archive.
+		if hdr.Archive != archiveIdx {
+			linkContent(hardLinks)
+			hardLinks = make(map[hardLinkID][]*ImageEntry)
+			archiveIdx = hdr.Archive
+		}
+
+		entry := &ImageEntry{
+			Path:    path.Clean("/" + hdr.Name),
+			Mode:    hdr.Mode,
+			UID:     hdr.Owner.UID,
+			GID:     hdr.Owner.GID,
+			ModTime: hdr.ModTime,
+			Size:    hdr.Size,
+			Inode:   hdr.Inode,
+			NLink:   hdr.NLink,
+			Segment: hdr.Segment,
+			order:   order,
+		}
+		switch hdr.Mode.Type() {
+		case 0:
+			// The content is read for its digest only, which also
+			// ensures it is complete.
+			hash := sha256.New()
+			if _, err := io.Copy(hash, reader); err != nil {
+				return nil, fmt.Errorf("read %s: %v", hdr.Name, err)
+			}
+			entry.content = &imageContent{
+				segment: hdr.Segment,
+				offset:  hdr.Offset,
+				size:    hdr.Size,
+				digest:  hex.EncodeToString(hash.Sum(nil)),
+			}
+			entry.linkID = hardLinkID{hdr.Archive, hdr.Inode, hdr.DevMajor, hdr.DevMinor}
+			if hdr.NLink > 1 {
+				hardLinks[entry.linkID] = append(hardLinks[entry.linkID], entry)
+			}
+		case fs.ModeSymlink:
+			target, err := io.ReadAll(reader)
+			if err != nil {
+				return nil, fmt.Errorf("read %s: %v", hdr.Name, err)
+			}
+			entry.LinkTarget = string(target)
+		case fs.ModeDevice, fs.ModeDevice | fs.ModeCharDevice:
+			entry.Major, entry.Minor = hdr.RDevMajor, hdr.RDevMinor
+		}
+
+		// A replaced entry does not provide the content of its hard links
+		// anymore.
+		if replaced, exists := img.entries[fsPath(entry.Path)]; exists {
+			group := hardLinks[replaced.linkID]
+			if idx := slices.Index(group, replaced); idx >= 0 {
+				hardLinks[replaced.linkID] = slices.Delete(group, idx, idx+1)
+			}
+		}
+		img.entries[fsPath(entry.Path)] = entry
+	}
+	img.segments = reader.Segments()
+
+	linkContent(hardLinks)
+
+	img.index()
+	return img, nil
+}
+
+// linkContent sets the content of all entries of each of the given hard link
+// groups. The content is stored with one of them only, usually the last one.
+func linkContent(hardLinks map[hardLinkID][]*ImageEntry) {
+	for _, group := range hardLinks {
+		var content *imageContent
+		for _, entry := range group {
+			if entry.content.size > 0 {
+				content = entry.content
+			}
+		}
+		if content == nil {
+			continue
+		}
+		for _, entry := range group {
+			entry.content = content
+			entry.Size = content.size
+		}
+	}
+}
+
+// imageSource returns r as [io.ReaderAt] with offsets relative to its current
+// position. Readers that do not support random access are read into memory.
+func imageSource(r io.Reader) (io.ReaderAt, error) {
+	if ra, ok := r.(interface {
+		io.ReaderAt
+		io.Seeker
+	}); ok {
+		// Seeking fails for pipes, which do not support random access.
+		if base, err := ra.Seek(0, io.SeekCurrent); err == nil {
+			return io.NewSectionReader(ra, base, math.MaxInt64-base), nil
+		}
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+// openContent returns a reader for the given content. Content of
+// uncompressed segments is read directly from the source of the image,
+// while compressed segments are decompressed up to the content.
+func (img *Image) openContent(content *imageContent) (io.ReadCloser, error) {
+	segment := img.segments[content.segment]
+	if segment.Compression == CompressionNone {
+		return io.NopCloser(img.section(content)), nil
+	}
+	decoder, err := img.decoder(content.segment, content.offset)
+	if err != nil {
+		return nil, fmt.Errorf("decompress segment %d: %v", content.segment, err)
+	}
+	return &contentReader{
+		Reader:  io.LimitReader(decoder, content.size),
+		img:     img,
+		decoder: decoder,
+	}, nil
+}
+
+// section returns the given content of an uncompressed segment.
+func (img *Image) section(content *imageContent) *io.SectionReader {
+	segment := img.segments[content.segment]
+	return io.NewSectionReader(img.src, segment.Offset+content.offset, content.size)
+}
+
+// decoder returns a decoder of the given compressed segment positioned at
+// the given offset of its uncompressed data. The cached decoder of the
+// segment is used, unless it is past the offset already. The caller owns the
+// decoder until it is returned with [Image.putDecoder].
+func (img *Image) decoder(segment int, offset int64) (*segmentDecoder, error) {
+	img.decodersMu.Lock()
+	decoder, exists := img.decoders[segment]
+	if exists && decoder.offset <= offset {
+		delete(img.decoders, segment)
+	} else {
+		decoder = nil
+	}
+	img.decodersMu.Unlock()
+
+	if decoder == nil {
+		seg := img.segments[segment]
+		decomp, err := seg.Compression.NewReader(io.NewSectionReader(img.src, seg.Offset, seg.Size))
+		if err != nil {
+			return nil, err
+		}
+		decoder = &segmentDecoder{segment: segment, decomp: decomp}
+	}
+	if _, err := io.CopyN(io.Discard, decoder, offset-decoder.offset); err != nil {
+		_ = decoder.decomp.Close()
+		return nil, fmt.Errorf("skip to offset %d: %v", offset, err)
+	}
+	return decoder, nil
+}
+
+// putDecoder returns the given decoder to the cache, replacing the one of the
+// same segment. Decoders that failed are closed instead.
+func (img *Image) putDecoder(decoder *segmentDecoder) {
+	if decoder.err != nil {
+		_ = decoder.decomp.Close()
+		return
+	}
+	img.decodersMu.Lock()
+	replaced := img.decoders[decoder.segment]
+	img.decoders[decoder.segment] = decoder
+	img.decodersMu.Unlock()
+	if replaced != nil {
+		_ = replaced.decomp.Close()
+	}
+}
+
+// segmentDecoder decompresses a compressed segment and tracks its offset in
+// the uncompressed data.
+type segmentDecoder struct {
+	segment int
+	decomp  io.ReadCloser
+	// offset is the offset of the next byte of the uncompressed data.
+	offset int64
+	// err is the first read error other than [io.EOF].
+	err error
+}
+
+func (d *segmentDecoder) Read(p []byte) (int, error) {
+	n, err := d.decomp.Read(p)
+	d.offset += int64(n)
+	if err != nil && err != io.EOF && d.err == nil {
+		d.err = err
+	}
+	return n, err
+}
+
+// contentReader reads content of a compressed segment. Closing it returns its
+// decoder to the [Image].
+type contentReader struct {
+	io.Reader
+	img     *Image
+	decoder *segmentDecoder
+}
+
+func (r *contentReader) Close() error {
+	if r.decoder == nil {
+		return nil
+	}
+	r.img.putDecoder(r.decoder)
+	r.decoder = nil
+	return nil
+}
+
+// index adds missing parent directories and collects the children of all
+// directories. Entries below non-directories are dropped, like the kernel
+// fails to create them.
+func (img *Image) index() {
+	if _, exists := img.entries["."]; !exists {
+		img.entries["."] = newImageDir("/")
+	}
+
+	names := make([]string, 0, len(img.entries))
+	for name := range img.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	img.children = make(map[string][]string)
+	for _, name := range names {
+		if name == "." {
+			continue
+		}
+		if !img.addParents(name) {
+			delete(img.entries, name)
+			continue
+		}
+		dir := path.Dir(name)
+		img.children[dir] = append(img.children[dir], path.Base(name))
+	}
+	for _, children := range img.children {
+		sort.Strings(children)
+	}
+}
+
+// addParents adds missing parent directories of the given path. It returns
+// false, if any parent is not a directory.
+func (img *Image) addParents(name string) bool {
+	dir := path.Dir(name)
+	parent, exists := img.entries[dir]
+	if exists {
+		return parent.Mode.IsDir()
+	}
+	if dir != "." && !img.addParents(dir) {
+		return false
+	}
+	img.entries[dir] = newImageDir("/" + dir)
+	grandParent := path.Dir(dir)
+	img.children[grandParent] = append(img.children[grandParent], path.Base(dir))
+	return true
+}
+
+// newImageDir returns a directory entry for the given path, that is missing
+// in the image.
+func newImageDir(path string) *ImageEntry {
+	return &ImageEntry{Path: path, Mode: fs.ModeDir | DirMode, ModTime: time.Unix(0, 0), order: -1}
+}
+
+// Segments returns the segments of the image in the order they have been
+// read.
+func (img *Image) Segments() []ImageSegment {
+	return append([]ImageSegment(nil), img.segments...)
+}
+
+// Entries returns all entries of the image in the order they have been read
+// from the image. Entries that have been replaced by later ones with the same
+// path are omitted. Added parent directories come first. The root directory
+// is omitted, unless it is present in the image.
+func (img *Image) Entries() []*ImageEntry {
+	entries := make([]*ImageEntry, 0, len(img.entries))
+	for name, entry := range img.entries {
+		if name == "." && entry.order < 0 {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].order != entries[j].order {
+			return entries[i].order < entries[j].order
+		}
+		return entries[i].Path < entries[j].Path
+	})
+	return entries
+}
+
+// lookup returns the entry with the given name without following symbolic
+// links.
+func (img *Image) lookup(op, name string) (*ImageEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	entry, exists := img.entries[name]
+	if !exists {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return entry, nil
+}
+
+// resolve returns the entry with the given name following symbolic links.
+func (img *Image) resolve(op, name string) (*ImageEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	resolved, err := files.EvalSymlinks(img, name)
+	if err != nil {
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			err = pathErr.Err
+		}
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if resolved == "" {
+		resolved = "."
+	}
+	return img.lookup(op, resolved)
+}
+
+// Open opens the file with the given name following symbolic links.
+func (img *Image) Open(name string) (fs.File, error) {
+	entry, err := img.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	file := &imageFile{
+		imageFileInfo: imageFileInfo{entry: entry, name: path.Base(name)},
+		img:           img,
+	}
+	switch {
+	case entry.Mode.IsDir():
+		file.children, _ = img.ReadDir(fsPath(entry.Path))
+	case entry.content != nil && img.segments[entry.content.segment].Compression == CompressionNone:
+		return &sectionImageFile{imageFile: file, SectionReader: img.section(entry.content)}, nil
+	}
+	return file, nil
+}
+
+// Stat returns the [fs.FileInfo] of the file with the given name following
+// symbolic links.
+func (img *Image) Stat(name string) (fs.FileInfo, error) {
+	entry, err := img.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return &imageFileInfo{entry: entry, name: path.Base(name)}, nil
+}
+
+// Lstat returns the [fs.FileInfo] of the file with the given name without
+// following symbolic links.
+func (img *Image) Lstat(name string) (fs.FileInfo, error) {
+	entry, err := img.lookup("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return &imageFileInfo{entry: entry, name: path.Base(name)}, nil
+}
+
+// ReadLink returns the target of the symbolic link with the given name.
+func (img *Image) ReadLink(name string) (string, error) {
+	entry, err := img.lookup("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	if entry.Mode.Type() != fs.ModeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return entry.LinkTarget, nil
+}
+
+// ReadFile returns the content of the file with the given name following
+// symbolic links.
+func (img *Image) ReadFile(name string) ([]byte, error) {
+	entry, err := img.resolve("read", name)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Mode.IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errIsDir}
+	}
+	if entry.content == nil {
+		return nil, nil
+	}
+	reader, err := img.openContent(entry.content)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	defer reader.Close()
+	data := make([]byte, entry.content.size)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return data, nil
+}
+
+// ReadDir returns the entries of the directory with the given name following
+// symbolic links, sorted by name.
+func (img *Image) ReadDir(name string) ([]fs.DirEntry, error) {
+	entry, err := img.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !entry.Mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+	dir := fsPath(entry.Path)
+	children := img.children[dir]
+	dirEntries := make([]fs.DirEntry, 0, len(children))
+	for _, child := range children {
+		childInfo := &imageFileInfo{entry: img.entries[path.Join(dir, child)], name: child}
+		dirEntries = append(dirEntries, fs.FileInfoToDirEntry(childInfo))
+	}
+	return dirEntries, nil
+}
+
+var (
+	errIsDir  = errors.New("is a directory")
+	errNotDir = errors.New("not a directory")
+)
+
+// fsPath returns the given absolute path as [fs.FS] path.
+func fsPath(name string) string {
+	if name == "/" {
+		return "."
+	}
+	return name[1:]
+}
+
+// imageFileInfo is the [fs.FileInfo] of an [ImageEntry].
+type imageFileInfo struct {
+	entry *ImageEntry
+	name  string
+}
+
+func (i *imageFileInfo) Name() string       { return i.name }
+func (i *imageFileInfo) Size() int64        { return i.entry.Size }
+func (i *imageFileInfo) Mode() fs.FileMode  { return i.entry.Mode }
+func (i *imageFileInfo) ModTime() time.Time { return i.entry.ModTime }
+func (i *imageFileInfo) IsDir() bool        { return i.entry.Mode.IsDir() }
+func (i *imageFileInfo) Sys() any           { return i.entry }
+
+// imageFile is an open file of an [Image].
+type imageFile struct {
+	imageFileInfo
+	img *Image
+	// content is opened on the first read.
+	content  io.ReadCloser
+	closed   bool
+	children []fs.DirEntry
+}
+
+// Stat returns the [fs.FileInfo] of the file.
+func (f *imageFile) Stat() (fs.FileInfo, error) {
+	return &f.imageFileInfo, nil
+}
+
+// Read reads the content of regular files.
+func (f *imageFile) Read(p []byte) (int, error) {
+	switch {
+	case f.closed:
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+	case f.IsDir():
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errIsDir}
+	case f.entry.content == nil:
+		return 0, io.EOF
+	}
+	if f.content == nil {
+		content, err := f.img.openContent(f.entry.content)
+		if err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.name, Err: err}
+		}
+		f.content = content
+	}
+	return f.content.Read(p)
+}
+
+// ReadDir reads the entries of directories like [fs.ReadDirFile].
+func (f *imageFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errNotDir}
+	}
+	if n <= 0 {
+		children := f.children
+		f.children = nil
+		return children, nil
+	}
+	if len(f.children) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.children) {
+		n = len(f.children)
+	}
+	children := f.children[:n]
+	f.children = f.children[n:]
+	return children, nil
+}
+
+// Close closes the file.
+func (f *imageFile) Close() error {
+	f.closed = true
+	if f.content == nil {
+		return nil
+	}
+	err := f.content.Close()
+	f.content = nil
+	return err
+}
+
+// sectionImageFile is an open regular file of an uncompressed segment. It
+// supports random access, like for reading ELF files.
+type sectionImageFile struct {
+	*imageFile
+	*io.SectionReader
+}
+
+// Read reads the content of the file.
+func (f *sectionImageFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+	}
+	return f.SectionReader.Read(p)
+}
@@ -0,0 +1,340 @@
+package initramfs
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/aibor/initramfs/internal/archive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// buildImage writes a test archive with the given write options.
+func buildImage(t *testing.T, opts ...WriteOption) []byte {
+	t.Helper()
+	testFS := fstest.MapFS{
+		"busybox": &fstest.MapFile{Data: []byte("busybox"), Mode: 0755},
+	}
+	a := NewWithFS(testFS, "/busybox")
+	require.NoError(t, a.AddHardLink("/bin/sh", "/init"))
+	require.NoError(t, a.AddContent("/etc/hostname", []byte("test\n"), 0))
+	require.NoError(t, a.AddLink("/bin/ash", "sh"))
+	require.NoError(t, a.AddLink("/etc/abs", "/etc/hostname"))
+	require.NoError(t, a.AddDevice("/dev/console", fs.ModeDevice|fs.ModeCharDevice|0600, 5, 1))
+	require.NoError(t, a.SetOwner("/etc/hostname", 1, 2))
+
+	var b bytes.Buffer
+	require.NoError(t, a.WriteCPIO(&b, append(opts, WithReproducible())...))
+	return b.Bytes()
+}
+
+func TestReadImage(t *testing.T) {
+	for _, compression := range []Compression{
+		CompressionNone,
+		CompressionGzip,
+		CompressionZstd,
+		CompressionXZ,
+		CompressionLZ4,
+	} {
+		compression := compression
+		t.Run(compression.String(), func(t *testing.T) {
+			data := buildImage(t, WithCompression(compression))
+			img, err := ReadImage(bytes.NewReader(data))
+			require.NoError(t, err)
+
+			assert.Equal(t, []ImageSegment{{Compression: compression, Size: int64(len(data))}}, img.Segments())
+
+			content, err := fs.ReadFile(img, "init")
+			require.NoError(t, err)
+			assert.Equal(t, "busybox", string(content))
+			content, err = fs.ReadFile(img, "bin/sh")
+			require.NoError(t, err)
+			assert.Equal(t, "busybox", string(content), "hard link")
+			content, err = fs.ReadFile(img, "bin/ash")
+			require.NoError(t, err)
+			assert.Equal(t, "busybox", string(content), "symbolic link")
+			content, err = fs.ReadFile(img, "etc/abs")
+			require.NoError(t, err)
+			assert.Equal(t, "test\n", string(content), "absolute symbolic link")
+
+			info, err := fs.Stat(img, "etc/hostname")
+			require.NoError(t, err)
+			assert.Equal(t, FileMode, info.Mode())
+			assert.EqualValues(t, 5, info.Size())
+			assert.Equal(t, time.Unix(0, 0), info.ModTime())
+			entry := info.Sys().(*ImageEntry)
+			assert.Equal(t, "/etc/hostname", entry.Path)
+			assert.Equal(t, 1, entry.UID)
+			assert.Equal(t, 2, entry.GID)
+
+			info, err = img.Lstat("bin/ash")
+			require.NoError(t, err)
+			assert.Equal(t, fs.ModeSymlink|0777, info.Mode())
+			target, err := img.ReadLink("bin/ash")
+			require.NoError(t, err)
+			assert.Equal(t, "sh", target)
+
+			info, err = img.Lstat("dev/console")
+			require.NoError(t, err)
+			assert.Equal(t, fs.ModeDevice|fs.ModeCharDevice|0600, info.Mode())
+			entry = info.Sys().(*ImageEntry)
+			assert.EqualValues(t, 5, entry.Major)
+			assert.EqualValues(t, 1, entry.Minor)
+
+			require.NoError(t, fstest.TestFS(img, "init", "bin/sh", "bin/ash", "etc/hostname", "dev/console"))
+		})
+	}
+}
+
+func TestReadImageConcatenated(t *testing.T) {
+	first := buildImage(t)
+
+	a := Archive{sourceFS: fstest.MapFS{}}
+	require.NoError(t, a.AddContent("/init", []byte("override"), 0700))
+	require.NoError(t, a.AddContent("/new/deep/file", []byte("new"), 0))
+	var second bytes.Buffer
+	require.NoError(t, a.WriteCPIO(&second, WithCompression(CompressionGzip)))
+
+	image := append(append(first, make([]byte, 8)...), second.Bytes()...)
+	img, err := ReadImage(bytes.NewReader(image))
+	require.NoError(t, err)
+
+	assert.Equal(t, []ImageSegment{
+		{Compression: CompressionNone, Size: int64(len(first))},
+		{Compression: CompressionGzip, Offset: int64(len(first) + 8), Size: int64(second.Len())},
+	}, img.Segments())
+
+	content, err := fs.ReadFile(img, "init")
+	require.NoError(t, err)
+	assert.Equal(t, "override", string(content))
+	info, err := img.Stat("init")
+	require.NoError(t, err)
+	assert.Equal(t, fs.FileMode(0700), info.Mode())
+	assert.Equal(t, 1, info.Sys().(*ImageEntry).Segment)
+
+	content, err = fs.ReadFile(img, "bin/sh")
+	require.NoError(t, err)
+	assert.Equal(t, "busybox", string(content), "hard link of replaced file")
+
+	entries, err := img.ReadDir(".")
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"bin", "dev", "etc", "init", "new"}, names)
+
+	var paths []string
+	for _, entry := range img.Entries() {
+		paths = append(paths, entry.Path)
+	}
+	assert.Equal(t, []string{"/init", "/new", "/new/deep", "/new/deep/file"}, paths[len(paths)-4:],
+		"replaced entries at their last position")
+}
+
+func TestReadImageHardLinks(t *testing.T) {
+	testFS := fstest.MapFS{
+		"first":  &fstest.MapFile{Data: []byte("first")},
+		"second": &fstest.MapFile{Data: []byte("second")},
+	}
+	writeLinks := func(t *testing.T, w io.Writer, source string, paths ...string) {
+		t.Helper()
+		a := &Archive{sourceFS: testFS}
+		require.NoError(t, a.AddFileAt(paths[0], source))
+		for _, path := range paths[1:] {
+			require.NoError(t, a.AddHardLink(path, paths[0]))
+		}
+		require.NoError(t, a.WriteCPIO(w))
+	}
+	// All archives are written into the same compressed segment.
+	compress := func(t *testing.T, data []byte) *bytes.Reader {
+		t.Helper()
+		var b bytes.Buffer
+		w, err := archive.CompressionGzip.NewWriter(&b)
+		require.NoError(t, err)
+		_, err = w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		return bytes.NewReader(b.Bytes())
+	}
+
+	t.Run("same inode in other archive", func(t *testing.T) {
+		var b bytes.Buffer
+		writeLinks(t, &b, "/first", "/a1", "/a2")
+		writeLinks(t, &b, "/second", "/b1", "/b2")
+		img, err := ReadImage(compress(t, b.Bytes()))
+		require.NoError(t, err)
+		require.Len(t, img.Segments(), 1)
+
+		expected := map[string]string{"a1": "first", "a2": "first", "b1": "second", "b2": "second"}
+		for name, content := range expected {
+			actual, err := fs.ReadFile(img, name)
+			require.NoError(t, err, name)
+			assert.Equal(t, content, string(actual), name)
+		}
+	})
+
+	t.Run("replaced in other archive", func(t *testing.T) {
+		var b bytes.Buffer
+		writeLinks(t, &b, "/first", "/a1", "/a2")
+		writeLinks(t, &b, "/second", "/a2")
+		img, err := ReadImage(compress(t, b.Bytes()))
+		require.NoError(t, err)
+
+		expected := map[string]string{"a1": "first", "a2": "second"}
+		for name, content := range expected {
+			actual, err := fs.ReadFile(img, name)
+			require.NoError(t, err, name)
+			assert.Equal(t, content, string(actual), name)
+		}
+	})
+
+	t.Run("replaced in same archive", func(t *testing.T) {
+		var b bytes.Buffer
+		w := archive.NewCPIOWriter(&b)
+		first, err := testFS.Open("first")
+		require.NoError(t, err)
+		defer first.Close()
+		require.NoError(t, w.WriteHardLinks([]string{"/a1", "/a2"}, first, 0644, archive.Owner{}))
+		second, err := testFS.Open("second")
+		require.NoError(t, err)
+		defer second.Close()
+		require.NoError(t, w.WriteRegular("/a2", second, 0644, archive.Owner{}))
+		require.NoError(t, w.Close())
+		img, err := ReadImage(compress(t, b.Bytes()))
+		require.NoError(t, err)
+
+		actual, err := fs.ReadFile(img, "a2")
+		require.NoError(t, err)
+		assert.Equal(t, "second", string(actual))
+		// The content of the hard links is stored with the replaced entry.
+		actual, err = fs.ReadFile(img, "a1")
+		require.NoError(t, err)
+		assert.Empty(t, actual)
+	})
+}
+
+func TestImageContent(t *testing.T) {
+	a := Archive{sourceFS: fstest.MapFS{}}
+	require.NoError(t, a.AddContentString("/a", "aaa", 0))
+	require.NoError(t, a.AddContentString("/b", "bbbb", 0))
+	var b bytes.Buffer
+	require.NoError(t, a.WriteCPIO(&b))
+	offset := b.Len()
+	require.NoError(t, a.WriteCPIO(&b, WithCompression(CompressionZstd)))
+
+	name := filepath.Join(t.TempDir(), "initramfs.img")
+	require.NoError(t, os.WriteFile(name, b.Bytes(), 0644))
+	file, err := os.Open(name)
+	require.NoError(t, err)
+	defer file.Close()
+
+	// Content is read from the file on demand.
+	img, err := ReadImage(file)
+	require.NoError(t, err)
+	require.Len(t, img.Segments(), 2)
+	assert.Equal(t, CompressionZstd, img.Segments()[1].Compression)
+	assert.EqualValues(t, offset, img.Segments()[1].Offset)
+
+	t.Run("out of order", func(t *testing.T) {
+		expected := map[string]string{"a": "aaa", "b": "bbbb"}
+		for _, name := range []string{"b", "a", "b", "a"} {
+			content, err := img.ReadFile(name)
+			require.NoError(t, err)
+			assert.Equal(t, expected[name], string(content))
+		}
+	})
+
+	t.Run("concurrently open", func(t *testing.T) {
+		fileA, err := img.Open("a")
+		require.NoError(t, err)
+		defer fileA.Close()
+		fileB, err := img.Open("b")
+		require.NoError(t, err)
+		defer fileB.Close()
+
+		buf := make([]byte, 2)
+		_, err = io.ReadFull(fileB, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "bb", string(buf))
+		_, err = io.ReadFull(fileA, buf)
+		require.NoError(t, err)
+		assert.Equal(t, "aa", string(buf))
+		rest, err := io.ReadAll(fileB)
+		require.NoError(t, err)
+		assert.Equal(t, "bb", string(rest))
+		rest, err = io.ReadAll(fileA)
+		require.NoError(t, err)
+		assert.Equal(t, "a", string(rest))
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		f, err := img.Open("a")
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		_, err = f.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, fs.ErrClosed)
+	})
+}
+
+func TestImageContentRandomAccess(t *testing.T) {
+	img, err := ReadImage(bytes.NewReader(buildImage(t)))
+	require.NoError(t, err)
+
+	file, err := img.Open("init")
+	require.NoError(t, err)
+	defer file.Close()
+	readerAt, ok := file.(io.ReaderAt)
+	require.True(t, ok, "uncompressed content supports random access")
+	buf := make([]byte, 3)
+	_, err = readerAt.ReadAt(buf, 4)
+	require.NoError(t, err)
+	assert.Equal(t, "box", string(buf))
+	info, err := file.Stat()
+	require.NoError(t, err)
+	assert.Equal(t, "init", info.Name())
+}
+
+func TestReadImageErrors(t *testing.T) {
+	img, err := ReadImage(bytes.NewReader(buildImage(t)))
+	require.NoError(t, err)
+
+	_, err = img.Open("missing")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = img.Open("/init")
+	assert.ErrorIs(t, err, fs.ErrInvalid)
+	_, err = img.ReadLink("init")
+	assert.ErrorIs(t, err, fs.ErrInvalid)
+	_, err = img.ReadFile("etc")
+	assert.ErrorContains(t, err, "is a directory")
+	_, err = img.ReadDir("init")
+	assert.ErrorContains(t, err, "not a directory")
+
+	_, err = ReadImage(bytes.NewReader([]byte("garbage")))
+	assert.ErrorContains(t, err, "read image: offset 0: unknown format")
+}
+
+func TestArchiveFromImage(t *testing.T) {
+	img, err := ReadImage(bytes.NewReader(buildImage(t, WithCompression(CompressionZstd))))
+	require.NoError(t, err)
+
+	a := NewWithFS(img, "/init")
+	require.NoError(t, a.AddDir("/etc", "/etc", DirOptions{}))
+	var b bytes.Buffer
+	require.NoError(t, a.WriteCPIO(&b))
+
+	copied, err := ReadImage(&b)
+	require.NoError(t, err)
+	content, err := fs.ReadFile(copied, "init")
+	require.NoError(t, err)
+	assert.Equal(t, "busybox", string(content))
+	target, err := copied.ReadLink("etc/abs")
+	require.NoError(t, err)
+	assert.Equal(t, "/etc/hostname", target)
+}
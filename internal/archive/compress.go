@@ -0,0 +1,167 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression defines the compression algorithm applied to the archive
+// stream.
+type Compression int
+
+const (
+	// CompressionNone writes the archive uncompressed.
+	CompressionNone Compression = iota
+	// CompressionGzip compresses with gzip.
+	CompressionGzip
+	// CompressionZstd compresses with zstd.
+	CompressionZstd
+	// CompressionXZ compresses with xz. CRC32 is used as integrity check, as
+	// the kernel's xz decoder does not support any other.
+	CompressionXZ
+	// CompressionLZ4 compresses with lz4 using the legacy frame format that
+	// is expected by the kernel.
+	CompressionLZ4
+)
+
+var compressionNames = map[Compression]string{
+	CompressionNone: "none",
+	CompressionGzip: "gzip",
+	CompressionZstd: "zstd",
+	CompressionXZ:   "xz",
+	CompressionLZ4:  "lz4",
+}
+
+// ParseCompression returns the [Compression] for the given name. Valid names
+// are "none", "gzip", "zstd", "xz" and "lz4". An empty name is treated as
+// "none".
+func ParseCompression(name string) (Compression, error) {
+	if name == "" {
+		return CompressionNone, nil
+	}
+	for c, n := range compressionNames {
+		if strings.EqualFold(n, name) {
+			return c, nil
+		}
+	}
+	return CompressionNone, fmt.Errorf("unknown compression: %s", name)
+}
+
+// String returns the name of the [Compression].
+func (c Compression) String() string {
+	if name, exists := compressionNames[c]; exists {
+		return name
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// NewWriter returns a new [io.WriteCloser] that compresses all data written
+// to it and writes it to w. The caller is responsible for closing the
+// returned writer in order to flush all remaining data. It does not close w.
+func (c Compression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriterLevel(w, gzip.BestCompression)
+	case CompressionZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	case CompressionXZ:
+		config := xz.WriterConfig{CheckSum: xz.CRC32}
+		return config.NewWriter(w)
+	case CompressionLZ4:
+		lw := lz4.NewWriter(w)
+		if err := lw.Apply(lz4.LegacyOption(true), lz4.CompressionLevelOption(lz4.Level9)); err != nil {
+			return nil, err
+		}
+		return lw, nil
+	default:
+		return nil, fmt.Errorf("unknown compression %d", int(c))
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// compressionMagics are the magic bytes the compressed data of each
+// [Compression] starts with.
+var compressionMagics = map[Compression][]byte{
+	CompressionGzip: {0x1f, 0x8b},
+	CompressionZstd: {0x28, 0xb5, 0x2f, 0xfd},
+	CompressionXZ:   {0xfd, '7', 'z', 'X', 'Z', 0x00},
+	CompressionLZ4:  {0x02, 0x21, 0x4c, 0x18},
+}
+
+// unsupportedMagics are the magic bytes of compression formats the kernel
+// supports, but that can not be read.
+var unsupportedMagics = map[string][]byte{
+	"bzip2": []byte("BZh"),
+	"lzma":  {0x5d, 0x00, 0x00},
+	"lzo":   {0x89, 'L', 'Z', 'O'},
+}
+
+// DetectCompression returns the [Compression] of the data starting with the
+// given bytes. It returns false, if the data is not compressed with any
+// supported [Compression]. An error is returned, if the data is compressed
+// with an unsupported algorithm.
+func DetectCompression(data []byte) (Compression, bool, error) {
+	for c, magic := range compressionMagics {
+		if bytes.HasPrefix(data, magic) {
+			return c, true, nil
+		}
+	}
+	for name, magic := range unsupportedMagics {
+		if bytes.HasPrefix(data, magic) {
+			return CompressionNone, false, fmt.Errorf("unsupported compression: %s", name)
+		}
+	}
+	return CompressionNone, false, nil
+}
+
+// NewReader returns a new [io.ReadCloser] that decompresses the data read
+// from r. For [CompressionGzip], only a single gzip member is read and no
+// more data than needed is read from r, if r implements [io.ByteReader].
+// All other algorithms may read ahead. Closing the reader does not close r.
+func (c Compression) NewReader(r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case CompressionNone:
+		return io.NopCloser(r), nil
+	case CompressionGzip:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		gr.Multistream(false)
+		return gr, nil
+	case CompressionZstd:
+		// Decoding with concurrency 1 is synchronous, so readers that are
+		// never closed do not leak goroutines.
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case CompressionXZ:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	case CompressionLZ4:
+		return io.NopCloser(lz4.NewReader(r)), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %d", int(c))
+	}
+}
@@ -0,0 +1,171 @@
+package archive_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/aibor/initramfs/internal/archive"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+)
+
+func TestParseCompression(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected archive.Compression
+		errMsg   string
+	}{
+		{name: "", expected: archive.CompressionNone},
+		{name: "none", expected: archive.CompressionNone},
+		{name: "gzip", expected: archive.CompressionGzip},
+		{name: "ZSTD", expected: archive.CompressionZstd},
+		{name: "xz", expected: archive.CompressionXZ},
+		{name: "lz4", expected: archive.CompressionLZ4},
+		{name: "bzip2", errMsg: "unknown compression: bzip2"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := archive.ParseCompression(tt.name)
+			if tt.errMsg != "" {
+				assert.ErrorContains(t, err, tt.errMsg)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, c)
+		})
+	}
+}
+
+func TestCompressionNewWriter(t *testing.T) {
+	input := bytes.Repeat([]byte("initramfs content "), 1000)
+
+	tests := []struct {
+		compression archive.Compression
+		magic       []byte
+		reader      func(io.Reader) (io.Reader, error)
+	}{
+		{
+			compression: archive.CompressionNone,
+			reader:      func(r io.Reader) (io.Reader, error) { return r, nil },
+		},
+		{
+			compression: archive.CompressionGzip,
+			magic:       []byte{0x1f, 0x8b},
+			reader:      func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		},
+		{
+			compression: archive.CompressionZstd,
+			magic:       []byte{0x28, 0xb5, 0x2f, 0xfd},
+			reader:      func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+		},
+		{
+			compression: archive.CompressionXZ,
+			// Magic followed by stream flags with check type CRC32.
+			magic:  []byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0x00, 0x01},
+			reader: func(r io.Reader) (io.Reader, error) { return xz.NewReader(r) },
+		},
+		{
+			compression: archive.CompressionLZ4,
+			magic:       []byte{0x02, 0x21, 0x4c, 0x18},
+			reader:      func(r io.Reader) (io.Reader, error) { return lz4.NewReader(r), nil },
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.compression.String(), func(t *testing.T) {
+			var b bytes.Buffer
+			w, err := tt.compression.NewWriter(&b)
+			require.NoError(t, err)
+			_, err = w.Write(input)
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+
+			assert.True(t, bytes.HasPrefix(b.Bytes(), tt.magic), "magic")
+
+			r, err := tt.reader(&b)
+			require.NoError(t, err)
+			output, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, input, output)
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := archive.Compression(99).NewWriter(&bytes.Buffer{})
+		assert.ErrorContains(t, err, "unknown compression 99")
+	})
+}
+
+func TestDetectCompression(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		expected archive.Compression
+		ok       bool
+		errMsg   string
+	}{
+		{name: "gzip", data: []byte{0x1f, 0x8b, 0x08}, expected: archive.CompressionGzip, ok: true},
+		{name: "zstd", data: []byte{0x28, 0xb5, 0x2f, 0xfd}, expected: archive.CompressionZstd, ok: true},
+		{name: "xz", data: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, expected: archive.CompressionXZ, ok: true},
+		{name: "lz4", data: []byte{0x02, 0x21, 0x4c, 0x18}, expected: archive.CompressionLZ4, ok: true},
+		{name: "cpio", data: []byte("070701")},
+		{name: "empty"},
+		{name: "bzip2", data: []byte("BZh9"), errMsg: "unsupported compression: bzip2"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			c, ok, err := archive.DetectCompression(tt.data)
+			if tt.errMsg != "" {
+				assert.ErrorContains(t, err, tt.errMsg)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.expected, c)
+		})
+	}
+}
+
+func TestCompressionNewReader(t *testing.T) {
+	input := bytes.Repeat([]byte("initramfs content "), 1000)
+
+	for _, compression := range []archive.Compression{
+		archive.CompressionNone,
+		archive.CompressionGzip,
+		archive.CompressionZstd,
+		archive.CompressionXZ,
+		archive.CompressionLZ4,
+	} {
+		compression := compression
+		t.Run(compression.String(), func(t *testing.T) {
+			var b bytes.Buffer
+			w, err := compression.NewWriter(&b)
+			require.NoError(t, err)
+			_, err = w.Write(input)
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+
+			r, err := compression.NewReader(&b)
+			require.NoError(t, err)
+			output, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			assert.Equal(t, input, output)
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := archive.Compression(99).NewReader(&bytes.Buffer{})
+		assert.ErrorContains(t, err, "unknown compression 99")
+	})
+}
@@ -4,70 +4,122 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
-
-	"github.com/cavaliergopher/cpio"
+	"time"
 )
 
-// CPIOWriter implements [Writer] for [cpio.CPIOWriter].
+// CPIOWriter implements [Writer] for newc CPIO archives as expected by the
+// Linux kernel.
 type CPIOWriter struct {
-	cpioWriter *cpio.Writer
+	newcWriter *newcWriter
+	inode      uint32
+	modTime    *time.Time
 }
 
 // NewCPIOWriter creates a new archive writer.
 func NewCPIOWriter(w io.Writer) *CPIOWriter {
-	return &CPIOWriter{cpio.NewWriter(w)}
+	return &CPIOWriter{newcWriter: &newcWriter{w: w}}
 }
 
-// Close closes the [Writer]. Flush is called by the underlying closer.
+// Close closes the [Writer] by writing the trailer. It does not close the
+// underlying [io.Writer].
 func (w *CPIOWriter) Close() error {
-	return w.cpioWriter.Close()
+	return w.newcWriter.Close()
 }
 
-// Flush writes the data to the underlying [io.Writer].
+// Flush writes the padding of the current entry to the underlying
+// [io.Writer].
 func (w *CPIOWriter) Flush() error {
-	return w.cpioWriter.Flush()
+	return w.newcWriter.Flush()
+}
+
+// SetModTime sets a fixed modification time that is used for all entries
+// written afterwards, instead of the modification time of the source files.
+func (w *CPIOWriter) SetModTime(modTime time.Time) {
+	w.modTime = &modTime
+}
+
+// nextInode returns a new inode number. Inode numbers are assigned
+// sequentially in the order they are requested.
+func (w *CPIOWriter) nextInode() uint32 {
+	w.inode++
+	return w.inode
 }
 
-// writeHeader writes the cpio header.
-func (w *CPIOWriter) writeHeader(hdr *cpio.Header) error {
-	if err := w.cpioWriter.WriteHeader(hdr); err != nil {
+// writeHeader writes the cpio header. If the header has no inode number set,
+// a new one is assigned.
+func (w *CPIOWriter) writeHeader(hdr *newcHeader) error {
+	if hdr.Inode == 0 {
+		hdr.Inode = w.nextInode()
+	}
+	if w.modTime != nil {
+		hdr.MTime = unixTime(*w.modTime)
+	}
+	if err := w.newcWriter.WriteHeader(hdr); err != nil {
 		return fmt.Errorf("write header for %s: %v", hdr.Name, err)
 	}
 	return nil
 }
 
-// WriteDirectory add a directory entry for the given path to the archive.
-func (w *CPIOWriter) WriteDirectory(path string) error {
-	header := &cpio.Header{
+// unixTime returns the given time in seconds since the Unix epoch. Times
+// before the epoch are returned as 0.
+func unixTime(t time.Time) uint32 {
+	if t.Unix() < 0 {
+		return 0
+	}
+	return uint32(t.Unix())
+}
+
+// WriteDirectory add a directory entry for the given path to the archive with
+// the given mode, which may be 0.
+func (w *CPIOWriter) WriteDirectory(path string, mode fs.FileMode, owner Owner) error {
+	header := &newcHeader{
 		Name:  path,
-		Mode:  cpio.TypeDir | cpio.ModePerm,
-		Links: 2,
+		Mode:  newcMode(fs.ModeDir | mode),
+		UID:   uint32(owner.UID),
+		GID:   uint32(owner.GID),
+		NLink: 2,
 	}
 	return w.writeHeader(header)
 }
 
 // WriteLink adds a symbolic link for the given path pointing to the given
 // target.
-func (w *CPIOWriter) WriteLink(path, target string) error {
-	header := &cpio.Header{
-		Name: path,
-		Mode: cpio.TypeSymlink | cpio.ModePerm,
-		Size: int64(len(target)),
+func (w *CPIOWriter) WriteLink(path, target string, owner Owner) error {
+	header := &newcHeader{
+		Name:     path,
+		Mode:     newcMode(fs.ModeSymlink | fs.ModePerm),
+		UID:      uint32(owner.UID),
+		GID:      uint32(owner.GID),
+		NLink:    1,
+		FileSize: uint32(len(target)),
 	}
 	if err := w.writeHeader(header); err != nil {
 		return err
 	}
 
 	// Body of a link is the path of the target file.
-	if _, err := w.cpioWriter.Write([]byte(target)); err != nil {
+	if _, err := w.newcWriter.Write([]byte(target)); err != nil {
 		return fmt.Errorf("write body for %s: %v", path, err)
 	}
 
 	return nil
 }
 
-// WriteRegular copies the exisiting file from source into the archive.
-func (w *CPIOWriter) WriteRegular(path string, source fs.File, mode fs.FileMode) error {
+// WriteRegular copies the exisiting file from source into the archive with
+// the given mode, which may be 0.
+func (w *CPIOWriter) WriteRegular(path string, source fs.File, mode fs.FileMode, owner Owner) error {
+	return w.WriteHardLinks([]string{path}, source, mode, owner)
+}
+
+// WriteHardLinks copies the exisiting file from source into the archive for
+// all given paths as hard links sharing the same inode. As expected by the
+// kernel, the content is written only once for the last path. The given mode
+// is used as is, even if 0.
+func (w *CPIOWriter) WriteHardLinks(paths []string, source fs.File, mode fs.FileMode, owner Owner) error {
+	if len(paths) == 0 {
+		return nil
+	}
+
 	info, err := source.Stat()
 	if err != nil {
 		return fmt.Errorf("read info: %v", err)
@@ -75,24 +127,73 @@ func (w *CPIOWriter) WriteRegular(path string, source fs.File, mode fs.FileMode)
 	if !info.Mode().IsRegular() {
 		return fmt.Errorf("not a regular file: %s", source)
 	}
-
-	cpioHdr, err := cpio.FileInfoHeader(info, "")
-	if err != nil {
-		return fmt.Errorf("create header: %v", err)
+	if info.Size() > int64(^uint32(0)) {
+		return fmt.Errorf("file too large: %s", paths[0])
 	}
 
-	cpioHdr.Name = path
-	if mode != 0 {
-		cpioHdr.Mode = cpio.FileMode(mode)
+	inode := w.nextInode()
+	for idx, path := range paths {
+		header := &newcHeader{
+			Name:  path,
+			Inode: inode,
+			Mode:  newcMode(mode &^ fs.ModeType),
+			UID:   uint32(owner.UID),
+			GID:   uint32(owner.GID),
+			NLink: uint32(len(paths)),
+			MTime: unixTime(info.ModTime()),
+		}
+		last := idx == len(paths)-1
+		if last {
+			header.FileSize = uint32(info.Size())
+		}
+		if err := w.writeHeader(header); err != nil {
+			return err
+		}
+		if !last {
+			continue
+		}
+		if _, err := io.Copy(w.newcWriter, source); err != nil {
+			return fmt.Errorf("write body for %s: %v", path, err)
+		}
 	}
 
-	if err := w.writeHeader(cpioHdr); err != nil {
-		return err
-	}
+	return nil
+}
 
-	if _, err := io.Copy(w.cpioWriter, source); err != nil {
-		return fmt.Errorf("write body for %s: %v", path, err)
+// WriteDevice adds a device node for the given path with the given major and
+// minor device numbers. The mode must have [fs.ModeDevice] set. If
+// [fs.ModeCharDevice] is set as well, a character device is created, a block
+// device otherwise.
+func (w *CPIOWriter) WriteDevice(path string, mode fs.FileMode, major, minor uint32, owner Owner) error {
+	if mode&fs.ModeDevice == 0 {
+		return fmt.Errorf("not a device mode for %s: %s", path, mode)
+	}
+	header := &newcHeader{
+		Name:      path,
+		Mode:      newcMode(mode),
+		UID:       uint32(owner.UID),
+		GID:       uint32(owner.GID),
+		NLink:     1,
+		RDevMajor: major,
+		RDevMinor: minor,
 	}
+	return w.writeHeader(header)
+}
 
-	return nil
+// WriteSpecial adds a named pipe or a unix domain socket file for the given
+// path. The mode must have either [fs.ModeNamedPipe] or [fs.ModeSocket] set.
+func (w *CPIOWriter) WriteSpecial(path string, mode fs.FileMode, owner Owner) error {
+	switch mode.Type() {
+	case fs.ModeNamedPipe, fs.ModeSocket:
+	default:
+		return fmt.Errorf("not a named pipe or socket mode for %s: %s", path, mode)
+	}
+	header := &newcHeader{
+		Name:  path,
+		Mode:  newcMode(mode),
+		UID:   uint32(owner.UID),
+		GID:   uint32(owner.GID),
+		NLink: 1,
+	}
+	return w.writeHeader(header)
 }
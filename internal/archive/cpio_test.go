@@ -2,9 +2,11 @@ package archive_test
 
 import (
 	"bytes"
+	"io"
 	"io/fs"
 	"testing"
 	"testing/fstest"
+	"time"
 
 	"github.com/aibor/initramfs/internal/archive"
 	"github.com/cavaliergopher/cpio"
@@ -14,14 +16,44 @@ import (
 
 func TestCPIOWriterWriteDirectory(t *testing.T) {
 	t.Run("works", func(t *testing.T) {
-		w := archive.NewCPIOWriter(&bytes.Buffer{})
-		err := w.WriteDirectory("test")
-		assert.NoError(t, err)
+		var b bytes.Buffer
+		w := archive.NewCPIOWriter(&b)
+		err := w.WriteDirectory("test", 0755, archive.Owner{})
+		require.NoError(t, err)
+
+		r := cpio.NewReader(&b)
+		h, err := r.Next()
+		require.NoError(t, err)
+		assert.EqualValues(t, 0755|cpio.TypeDir, h.Mode)
+	})
+	t.Run("mode 0", func(t *testing.T) {
+		var b bytes.Buffer
+		w := archive.NewCPIOWriter(&b)
+		err := w.WriteDirectory("test", 0, archive.Owner{})
+		require.NoError(t, err)
+
+		r := cpio.NewReader(&b)
+		h, err := r.Next()
+		require.NoError(t, err)
+		assert.EqualValues(t, cpio.TypeDir, h.Mode)
+	})
+	t.Run("mode and owner", func(t *testing.T) {
+		var b bytes.Buffer
+		w := archive.NewCPIOWriter(&b)
+		err := w.WriteDirectory("test", fs.ModeSticky|0777, archive.Owner{UID: 1, GID: 2})
+		require.NoError(t, err)
+
+		r := cpio.NewReader(&b)
+		h, err := r.Next()
+		require.NoError(t, err)
+		assert.EqualValues(t, 01777|cpio.TypeDir, h.Mode)
+		assert.Equal(t, 1, h.Uid)
+		assert.Equal(t, 2, h.Guid)
 	})
 	t.Run("closed", func(t *testing.T) {
 		w := archive.NewCPIOWriter(&bytes.Buffer{})
 		w.Close()
-		err := w.WriteDirectory("test")
+		err := w.WriteDirectory("test", 0, archive.Owner{})
 		assert.ErrorContains(t, err, "write header for test:")
 	})
 }
@@ -30,7 +62,7 @@ func TestCPIOWriterWriteLink(t *testing.T) {
 	t.Run("works", func(t *testing.T) {
 		var b bytes.Buffer
 		w := archive.NewCPIOWriter(&b)
-		err := w.WriteLink("test", "target")
+		err := w.WriteLink("test", "target", archive.Owner{})
 		require.NoError(t, err)
 
 		r := cpio.NewReader(&b)
@@ -44,7 +76,7 @@ func TestCPIOWriterWriteLink(t *testing.T) {
 	t.Run("closed", func(t *testing.T) {
 		w := archive.NewCPIOWriter(&bytes.Buffer{})
 		w.Close()
-		err := w.WriteLink("test", "target")
+		err := w.WriteLink("test", "target", archive.Owner{})
 		assert.ErrorContains(t, err, "write header for test:")
 	})
 }
@@ -55,9 +87,10 @@ func TestCPIOWriterWriteRegular(t *testing.T) {
 		fileBody[idx] = byte(idx)
 	}
 	testFS := fstest.MapFS{
-		"regular": &fstest.MapFile{Data: fileBody},
-		"dir":     &fstest.MapFile{Mode: fs.ModeDir},
-		"link":    &fstest.MapFile{Mode: fs.ModeSymlink},
+		"regular":    &fstest.MapFile{Data: fileBody},
+		"executable": &fstest.MapFile{Mode: fs.ModeSetuid | 0711},
+		"dir":        &fstest.MapFile{Mode: fs.ModeDir},
+		"link":       &fstest.MapFile{Mode: fs.ModeSymlink},
 	}
 
 	for _, f := range []string{"dir", "link"} {
@@ -65,7 +98,7 @@ func TestCPIOWriterWriteRegular(t *testing.T) {
 			w := archive.NewCPIOWriter(&bytes.Buffer{})
 			file, err := testFS.Open(f)
 			require.NoError(t, err)
-			err = w.WriteRegular("test", file, 0755)
+			err = w.WriteRegular("test", file, 0755, archive.Owner{})
 			assert.ErrorContains(t, err, "not a regular file")
 		})
 	}
@@ -77,7 +110,7 @@ func TestCPIOWriterWriteRegular(t *testing.T) {
 
 			file, err := testFS.Open("regular")
 			require.NoError(t, err)
-			err = w.WriteRegular("test", file, 0755)
+			err = w.WriteRegular("test", file, 0755, archive.Owner{})
 			require.NoError(t, err)
 
 			r := cpio.NewReader(&b)
@@ -92,14 +125,192 @@ func TestCPIOWriterWriteRegular(t *testing.T) {
 			require.NoError(t, err)
 			assert.Equal(t, fileBody, body)
 		})
+		t.Run("mode 0", func(t *testing.T) {
+			var b bytes.Buffer
+			w := archive.NewCPIOWriter(&b)
+
+			file, err := testFS.Open("executable")
+			require.NoError(t, err)
+			err = w.WriteRegular("test", file, 0, archive.Owner{UID: 1000, GID: 100})
+			require.NoError(t, err)
+
+			r := cpio.NewReader(&b)
+			h, err := r.Next()
+			require.NoError(t, err)
+			assert.EqualValues(t, cpio.TypeReg, h.Mode)
+			assert.Equal(t, 1000, h.Uid)
+			assert.Equal(t, 100, h.Guid)
+		})
 		t.Run("closed", func(t *testing.T) {
 			w := archive.NewCPIOWriter(&bytes.Buffer{})
 			w.Close()
 
 			file, err := testFS.Open("regular")
 			require.NoError(t, err)
-			err = w.WriteRegular("test", file, 0755)
+			err = w.WriteRegular("test", file, 0755, archive.Owner{})
 			assert.ErrorContains(t, err, "write header for test:")
 		})
 	})
 }
+
+func TestCPIOWriterSetModTime(t *testing.T) {
+	modTime := time.Unix(1700000000, 0)
+	testFS := fstest.MapFS{
+		"regular": &fstest.MapFile{ModTime: time.Now()},
+	}
+
+	var b bytes.Buffer
+	w := archive.NewCPIOWriter(&b)
+	w.SetModTime(modTime)
+
+	require.NoError(t, w.WriteDirectory("dir", 0, archive.Owner{}))
+	file, err := testFS.Open("regular")
+	require.NoError(t, err)
+	require.NoError(t, w.WriteRegular("dir/file", file, 0755, archive.Owner{}))
+	require.NoError(t, w.WriteLink("link", "dir/file", archive.Owner{}))
+	require.NoError(t, w.Close())
+
+	r := cpio.NewReader(&b)
+	for _, name := range []string{"dir", "dir/file", "link"} {
+		h, err := r.Next()
+		require.NoError(t, err)
+		assert.Equal(t, name, h.Name)
+		assert.Equal(t, modTime, h.ModTime, name)
+	}
+}
+
+func TestCPIOWriterInodes(t *testing.T) {
+	var b bytes.Buffer
+	w := archive.NewCPIOWriter(&b)
+	for _, name := range []string{"a", "b", "c"} {
+		require.NoError(t, w.WriteDirectory(name, 0, archive.Owner{}))
+	}
+	require.NoError(t, w.Close())
+
+	r := cpio.NewReader(&b)
+	for i := 1; i <= 3; i++ {
+		h, err := r.Next()
+		require.NoError(t, err)
+		assert.EqualValues(t, i, h.Inode, h.Name)
+	}
+}
+
+func TestCPIOWriterWriteDevice(t *testing.T) {
+	t.Run("works", func(t *testing.T) {
+		var b bytes.Buffer
+		w := archive.NewCPIOWriter(&b)
+		err := w.WriteDevice("dev/console", fs.ModeDevice|fs.ModeCharDevice|0600, 5, 1, archive.Owner{})
+		require.NoError(t, err)
+		err = w.WriteDevice("dev/sda", fs.ModeDevice|0660, 8, 0, archive.Owner{GID: 6})
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		// Device numbers are not supported by the cpio package, so check the
+		// raw header fields.
+		raw := b.String()
+		assert.Equal(t, "00000005", raw[78:86], "rdevmajor")
+		assert.Equal(t, "00000001", raw[86:94], "rdevminor")
+
+		r := cpio.NewReader(&b)
+		h, err := r.Next()
+		require.NoError(t, err)
+		assert.Equal(t, "dev/console", h.Name)
+		assert.EqualValues(t, 0600|cpio.TypeChar, h.Mode)
+		h, err = r.Next()
+		require.NoError(t, err)
+		assert.Equal(t, "dev/sda", h.Name)
+		assert.EqualValues(t, 0660|cpio.TypeBlock, h.Mode)
+		assert.Equal(t, 6, h.Guid)
+	})
+	t.Run("not a device", func(t *testing.T) {
+		w := archive.NewCPIOWriter(&bytes.Buffer{})
+		err := w.WriteDevice("dev/console", 0600, 5, 1, archive.Owner{})
+		assert.ErrorContains(t, err, "not a device mode")
+	})
+	t.Run("closed", func(t *testing.T) {
+		w := archive.NewCPIOWriter(&bytes.Buffer{})
+		w.Close()
+		err := w.WriteDevice("test", fs.ModeDevice, 1, 1, archive.Owner{})
+		assert.ErrorContains(t, err, "write header for test:")
+	})
+}
+
+func TestCPIOWriterWriteSpecial(t *testing.T) {
+	t.Run("works", func(t *testing.T) {
+		var b bytes.Buffer
+		w := archive.NewCPIOWriter(&b)
+		err := w.WriteSpecial("run/log", fs.ModeNamedPipe|0620, archive.Owner{})
+		require.NoError(t, err)
+		err = w.WriteSpecial("run/sock", fs.ModeSocket|0755, archive.Owner{UID: 3})
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		r := cpio.NewReader(&b)
+		h, err := r.Next()
+		require.NoError(t, err)
+		assert.Equal(t, "run/log", h.Name)
+		assert.EqualValues(t, 0620|cpio.TypeFifo, h.Mode)
+		h, err = r.Next()
+		require.NoError(t, err)
+		assert.Equal(t, "run/sock", h.Name)
+		assert.EqualValues(t, 0755|cpio.TypeSocket, h.Mode)
+		assert.Equal(t, 3, h.Uid)
+	})
+	t.Run("invalid mode", func(t *testing.T) {
+		w := archive.NewCPIOWriter(&bytes.Buffer{})
+		err := w.WriteSpecial("run/log", fs.ModeDevice|0600, archive.Owner{})
+		assert.ErrorContains(t, err, "not a named pipe or socket mode")
+	})
+	t.Run("closed", func(t *testing.T) {
+		w := archive.NewCPIOWriter(&bytes.Buffer{})
+		w.Close()
+		err := w.WriteSpecial("test", fs.ModeNamedPipe, archive.Owner{})
+		assert.ErrorContains(t, err, "write header for test:")
+	})
+}
+
+func TestCPIOWriterWriteHardLinks(t *testing.T) {
+	testFS := fstest.MapFS{
+		"regular": &fstest.MapFile{Data: []byte("content"), Mode: 0755},
+	}
+
+	t.Run("works", func(t *testing.T) {
+		var b bytes.Buffer
+		w := archive.NewCPIOWriter(&b)
+		require.NoError(t, w.WriteDirectory("dir", 0, archive.Owner{}))
+		file, err := testFS.Open("regular")
+		require.NoError(t, err)
+		err = w.WriteHardLinks([]string{"a", "b", "dir/c"}, file, 0755, archive.Owner{})
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		r := cpio.NewReader(&b)
+		_, err = r.Next()
+		require.NoError(t, err)
+		for _, name := range []string{"a", "b", "dir/c"} {
+			h, err := r.Next()
+			require.NoError(t, err)
+			assert.Equal(t, name, h.Name)
+			assert.EqualValues(t, 2, h.Inode, name)
+			assert.Equal(t, 3, h.Links, name)
+			assert.EqualValues(t, 0755|cpio.TypeReg, h.Mode, name)
+			if name != "dir/c" {
+				assert.Zero(t, h.Size, name)
+				continue
+			}
+			assert.EqualValues(t, 7, h.Size)
+			body, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, "content", string(body))
+		}
+	})
+	t.Run("closed", func(t *testing.T) {
+		w := archive.NewCPIOWriter(&bytes.Buffer{})
+		w.Close()
+
+		file, err := testFS.Open("regular")
+		require.NoError(t, err)
+		err = w.WriteHardLinks([]string{"a", "b"}, file, 0, archive.Owner{})
+		assert.ErrorContains(t, err, "write header for a:")
+	})
+}
@@ -0,0 +1,146 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// lz4LegacyMaxBlock is the maximum size of a compressed block of the lz4
+// legacy format: the bound of the compressed size of 8 MiB of input.
+const lz4LegacyMaxBlock = 8<<20 + (8<<20)/255 + 16
+
+var errTruncatedFrame = errors.New("truncated compressed data")
+
+// compressedLen returns the length of the compressed data of the given
+// [Compression] at the start of the given data, so data following it, like
+// another segment of an image, is not passed to the decompressor, which may
+// fail on it or read it. Gzip is not supported, as its reader stops at the
+// end of the compressed data anyway.
+func compressedLen(c Compression, data []byte) (int, error) {
+	switch c {
+	case CompressionZstd:
+		return zstdLen(data)
+	case CompressionXZ:
+		return xzLen(data)
+	case CompressionLZ4:
+		return lz4LegacyLen(data), nil
+	default:
+		return 0, fmt.Errorf("length of %s data not supported", c)
+	}
+}
+
+// zstdLen returns the length of the consecutive zstd frames at the start of
+// the given data.
+func zstdLen(data []byte) (int, error) {
+	magic := compressionMagics[CompressionZstd]
+	pos := 0
+	for bytes.HasPrefix(data[pos:], magic) {
+		frameLen, err := zstdFrameLen(data[pos:])
+		if err != nil {
+			return 0, err
+		}
+		pos += frameLen
+	}
+	return pos, nil
+}
+
+// zstdFrameLen returns the length of the zstd frame at the start of the
+// given data as specified by RFC 8878.
+func zstdFrameLen(data []byte) (int, error) {
+	if len(data) < 5 {
+		return 0, errTruncatedFrame
+	}
+	descriptor := data[4]
+	fcsFlag := descriptor >> 6
+	singleSegment := descriptor&0x20 != 0
+	hasChecksum := descriptor&0x04 != 0
+	dictIDLen := []int{0, 1, 2, 4}[descriptor&0x03]
+	fcsLen := []int{0, 2, 4, 8}[fcsFlag]
+	if fcsFlag == 0 && singleSegment {
+		fcsLen = 1
+	}
+
+	pos := 5 + dictIDLen + fcsLen
+	if !singleSegment {
+		// Window descriptor.
+		pos++
+	}
+
+	for {
+		if pos+3 > len(data) {
+			return 0, errTruncatedFrame
+		}
+		header := uint32(data[pos]) | uint32(data[pos+1])<<8 | uint32(data[pos+2])<<16
+		pos += 3
+		last := header&1 != 0
+		size := int(header >> 3)
+		switch (header >> 1) & 3 {
+		case 1:
+			// RLE block with a single byte.
+			size = 1
+		case 3:
+			return 0, errors.New("invalid zstd block type")
+		}
+		pos += size
+		if last {
+			break
+		}
+	}
+
+	if hasChecksum {
+		pos += 4
+	}
+	if pos > len(data) {
+		return 0, errTruncatedFrame
+	}
+	return pos, nil
+}
+
+// xzLen returns the length of the xz stream at the start of the given data.
+// The stream footer is detected by its magic bytes and checksum as specified
+// by the .xz file format.
+func xzLen(data []byte) (int, error) {
+	const (
+		headerLen = 12
+		footerLen = 12
+	)
+	if len(data) < headerLen {
+		return 0, errTruncatedFrame
+	}
+	flags := data[6:8]
+
+	for pos := headerLen; pos+footerLen <= len(data); pos += 4 {
+		footer := data[pos : pos+footerLen]
+		if footer[10] != 'Y' || footer[11] != 'Z' || !bytes.Equal(footer[8:10], flags) {
+			continue
+		}
+		if crc32.ChecksumIEEE(footer[4:10]) != binary.LittleEndian.Uint32(footer[:4]) {
+			continue
+		}
+		return pos + footerLen, nil
+	}
+	return 0, errTruncatedFrame
+}
+
+// lz4LegacyLen returns the length of the lz4 legacy frames at the start of
+// the given data. The legacy format has no end marker, so the data ends
+// where no valid block size follows, like with padding.
+func lz4LegacyLen(data []byte) int {
+	magic := compressionMagics[CompressionLZ4]
+	pos := 0
+	for pos+4 <= len(data) {
+		if bytes.Equal(data[pos:pos+4], magic) {
+			pos += 4
+			continue
+		}
+		size := int(binary.LittleEndian.Uint32(data[pos : pos+4]))
+		if size == 0 || size > lz4LegacyMaxBlock || pos+4+size > len(data) {
+			break
+		}
+		pos += 4 + size
+	}
+	return pos
+}
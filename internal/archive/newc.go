@@ -0,0 +1,184 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+const (
+	newcMagic     = "070701"
+	newcHeaderLen = 110
+	newcTrailer   = "TRAILER!!!"
+)
+
+// File type and mode bits as used in newc headers.
+const (
+	modeTypeMask = 0170000
+	modeSocket   = 0140000
+	modeSymlink  = 0120000
+	modeRegular  = 0100000
+	modeBlock    = 0060000
+	modeDir      = 0040000
+	modeChar     = 0020000
+	modeFIFO     = 0010000
+	modeSetuid   = 04000
+	modeSetgid   = 02000
+	modeSticky   = 01000
+	modePerm     = 0777
+)
+
+var errWriteAfterClose = errors.New("write after close")
+
+// newcHeader is the header of a single entry in the "new" portable ASCII
+// format (newc) as it is expected by the Linux kernel.
+type newcHeader struct {
+	Inode     uint32
+	Mode      uint32
+	UID       uint32
+	GID       uint32
+	NLink     uint32
+	MTime     uint32
+	FileSize  uint32
+	DevMajor  uint32
+	DevMinor  uint32
+	RDevMajor uint32
+	RDevMinor uint32
+	Name      string
+}
+
+// newcMode converts the given [fs.FileMode] into newc mode bits.
+func newcMode(mode fs.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= modeSetuid
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= modeSetgid
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= modeSticky
+	}
+
+	switch mode.Type() {
+	case fs.ModeDir:
+		m |= modeDir
+	case fs.ModeSymlink:
+		m |= modeSymlink
+	case fs.ModeDevice:
+		m |= modeBlock
+	case fs.ModeDevice | fs.ModeCharDevice:
+		m |= modeChar
+	case fs.ModeNamedPipe:
+		m |= modeFIFO
+	case fs.ModeSocket:
+		m |= modeSocket
+	default:
+		m |= modeRegular
+	}
+
+	return m
+}
+
+// pad returns the number of bytes needed to align n to 4 bytes.
+func pad(n int64) int64 {
+	return (4 - n%4) % 4
+}
+
+// newcWriter writes a newc archive. For each entry, call
+// [newcWriter.WriteHeader] followed by writing the complete body, if any.
+type newcWriter struct {
+	w         io.Writer
+	remaining int64
+	pad       int64
+	closed    bool
+}
+
+// Flush completes the current entry by writing its padding. It fails if
+// the body of the current entry has not been written completely.
+func (w *newcWriter) Flush() error {
+	if w.remaining > 0 {
+		return fmt.Errorf("missing %d bytes of body", w.remaining)
+	}
+	if _, err := w.w.Write(make([]byte, w.pad)); err != nil {
+		return err
+	}
+	w.pad = 0
+	return nil
+}
+
+// WriteHeader completes the current entry and writes the given header.
+func (w *newcWriter) WriteHeader(hdr *newcHeader) error {
+	if w.closed {
+		return errWriteAfterClose
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fields := []uint32{
+		hdr.Inode,
+		hdr.Mode,
+		hdr.UID,
+		hdr.GID,
+		hdr.NLink,
+		hdr.MTime,
+		hdr.FileSize,
+		hdr.DevMajor,
+		hdr.DevMinor,
+		hdr.RDevMajor,
+		hdr.RDevMinor,
+		uint32(len(hdr.Name) + 1),
+		0, // Checksum, always 0 for newc.
+	}
+
+	buf := make([]byte, 0, newcHeaderLen+len(hdr.Name)+4)
+	buf = append(buf, newcMagic...)
+	for _, field := range fields {
+		buf = append(buf, fmt.Sprintf("%08X", field)...)
+	}
+	buf = append(buf, hdr.Name...)
+	buf = append(buf, 0)
+	buf = append(buf, make([]byte, pad(int64(len(buf))))...)
+
+	if _, err := w.w.Write(buf); err != nil {
+		return err
+	}
+
+	w.remaining = int64(hdr.FileSize)
+	w.pad = pad(int64(hdr.FileSize))
+
+	return nil
+}
+
+// Write writes the body of the current entry. It fails if more bytes are
+// written than announced by the header.
+func (w *newcWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errWriteAfterClose
+	}
+	if int64(len(p)) > w.remaining {
+		n, err := w.w.Write(p[:w.remaining])
+		w.remaining -= int64(n)
+		if err == nil {
+			err = errors.New("write too long")
+		}
+		return n, err
+	}
+	n, err := w.w.Write(p)
+	w.remaining -= int64(n)
+	return n, err
+}
+
+// Close writes the trailer entry. Subsequent writes fail.
+func (w *newcWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	if err := w.WriteHeader(&newcHeader{Name: newcTrailer, NLink: 1}); err != nil {
+		return err
+	}
+	w.closed = true
+	return nil
+}
@@ -0,0 +1,87 @@
+package archive
+
+import (
+	"bytes"
+	"io/fs"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewcMode(t *testing.T) {
+	tests := []struct {
+		mode     fs.FileMode
+		expected uint32
+	}{
+		{mode: 0644, expected: 0100644},
+		{mode: fs.ModeSetuid | fs.ModeSetgid | 0755, expected: 0106755},
+		{mode: fs.ModeDir | fs.ModeSticky | 0777, expected: 0041777},
+		{mode: fs.ModeSymlink | 0777, expected: 0120777},
+		{mode: fs.ModeDevice | 0600, expected: 0060600},
+		{mode: fs.ModeDevice | fs.ModeCharDevice | 0620, expected: 0020620},
+		{mode: fs.ModeNamedPipe | 0600, expected: 0010600},
+		{mode: fs.ModeSocket | 0755, expected: 0140755},
+	}
+
+	for _, tt := range tests {
+		assert.Equalf(t, tt.expected, newcMode(tt.mode), "%s", tt.mode)
+	}
+}
+
+func TestNewcWriter(t *testing.T) {
+	t.Run("layout", func(t *testing.T) {
+		var b bytes.Buffer
+		w := newcWriter{w: &b}
+		hdr := newcHeader{
+			Inode:     1,
+			Mode:      0100644,
+			UID:       2,
+			GID:       3,
+			NLink:     1,
+			MTime:     0x12345678,
+			FileSize:  3,
+			DevMajor:  4,
+			DevMinor:  5,
+			RDevMajor: 6,
+			RDevMinor: 7,
+			Name:      "file",
+		}
+		require.NoError(t, w.WriteHeader(&hdr))
+		_, err := w.Write([]byte("abc"))
+		require.NoError(t, err)
+		require.NoError(t, w.Flush())
+
+		expected := "070701" +
+			"00000001" + "000081A4" + "00000002" + "00000003" + "00000001" +
+			"12345678" + "00000003" + "00000004" + "00000005" + "00000006" +
+			"00000007" + "00000005" + "00000000" +
+			"file\x00\x00" + "abc\x00"
+		assert.Equal(t, expected, b.String())
+		assert.Zero(t, b.Len()%4)
+	})
+
+	t.Run("missing body", func(t *testing.T) {
+		w := newcWriter{w: &bytes.Buffer{}}
+		require.NoError(t, w.WriteHeader(&newcHeader{Name: "a", FileSize: 2}))
+		err := w.WriteHeader(&newcHeader{Name: "b"})
+		assert.ErrorContains(t, err, "missing 2 bytes of body")
+	})
+
+	t.Run("write too long", func(t *testing.T) {
+		w := newcWriter{w: &bytes.Buffer{}}
+		require.NoError(t, w.WriteHeader(&newcHeader{Name: "a", FileSize: 2}))
+		n, err := w.Write([]byte("abc"))
+		assert.ErrorContains(t, err, "write too long")
+		assert.Equal(t, 2, n)
+	})
+
+	t.Run("trailer", func(t *testing.T) {
+		var b bytes.Buffer
+		w := newcWriter{w: &b}
+		require.NoError(t, w.Close())
+		assert.Contains(t, b.String(), "TRAILER!!!")
+		assert.Zero(t, b.Len()%4)
+		assert.ErrorIs(t, w.WriteHeader(&newcHeader{Name: "a"}), errWriteAfterClose)
+	})
+}
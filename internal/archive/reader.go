@@ -0,0 +1,363 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"time"
+)
+
+// newcMagicCRC is the magic of the newc variant with checksums. The checksums
+// are ignored, like the kernel does.
+const newcMagicCRC = "070702"
+
+// maxNameSize is the maximum size of entry names including the terminating
+// NUL byte, like the kernel's PATH_MAX.
+const maxNameSize = 4096
+
+// Header is the header of an entry read by [CPIOReader].
+type Header struct {
+	// Name is the path of the entry as stored in the archive.
+	Name string
+	// Mode are the type and permission bits of the entry.
+	Mode fs.FileMode
+	// Owner is the numeric owner of the entry.
+	Owner Owner
+	// Inode is the inode number of the entry. Together with the device
+	// numbers it identifies hard links.
+	Inode uint32
+	// NLink is the number of hard links of the entry.
+	NLink uint32
+	// ModTime is the modification time of the entry.
+	ModTime time.Time
+	// Size is the size of the body of the entry.
+	Size int64
+	// Offset is the offset of the body of the entry in the uncompressed data
+	// of its [Segment].
+	Offset int64
+	// DevMajor and DevMinor are the device numbers of the device the entry
+	// was read from.
+	DevMajor, DevMinor uint32
+	// RDevMajor and RDevMinor are the device numbers of device nodes.
+	RDevMajor, RDevMinor uint32
+	// Segment is the index of the [Segment] the entry was read from.
+	Segment int
+	// Archive is the index of the archive the entry was read from. It is
+	// counted over all segments, as a segment may contain multiple archives.
+	// Hard links only link entries of the same archive.
+	Archive int
+}
+
+// Segment is a part of an image read by [CPIOReader], that is either
+// uncompressed or compressed as a whole. A single segment may contain
+// multiple concatenated archives.
+type Segment struct {
+	// Compression is the [Compression] of the segment.
+	Compression Compression
+	// Offset is the offset of the segment in the image.
+	Offset int64
+	// Size is the size of the segment in the image, excluding any following
+	// padding. For compressed segments, it is the size of the compressed data.
+	Size int64
+}
+
+// CPIOReader reads entries of newc CPIO archives as the Linux kernel does
+// for initramfs images: the image may consist of multiple concatenated
+// archives, each of which may be compressed with any supported
+// [Compression]. Padding of NUL bytes between archives is skipped.
+type CPIOReader struct {
+	counter    *countingReader
+	src        *bufio.Reader
+	cur        *bufio.Reader
+	decomp     io.ReadCloser
+	decompRead *countingReader
+	segments   []Segment
+	archives   int
+	remaining  int64
+	pad        int64
+	afterEntry bool
+}
+
+// NewCPIOReader creates a new archive reader.
+func NewCPIOReader(r io.Reader) *CPIOReader {
+	counter := &countingReader{r: r}
+	return &CPIOReader{counter: counter, src: bufio.NewReader(counter)}
+}
+
+// Segments returns the segments read so far.
+func (r *CPIOReader) Segments() []Segment {
+	return r.segments
+}
+
+// Next advances to the next entry. Trailer entries are skipped. It returns
+// [io.EOF] at the end of the input.
+func (r *CPIOReader) Next() (*Header, error) {
+	if r.cur != nil {
+		if _, err := r.cur.Discard(int(r.remaining + r.pad)); err != nil {
+			return nil, fmt.Errorf("skip body: %v", unexpectedEOF(err))
+		}
+		r.remaining, r.pad = 0, 0
+	}
+
+	for {
+		if r.cur == nil {
+			if err := r.nextSegment(); err != nil {
+				return nil, err
+			}
+		}
+
+		if r.afterEntry {
+			// A trailer may be followed by another archive in the same
+			// compressed stream.
+			if err := skipZeros(r.cur); err == io.EOF {
+				if err := r.endSegment(); err != nil {
+					return nil, err
+				}
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		hdr, err := r.readHeader()
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name != newcTrailer {
+			r.afterEntry = false
+			return hdr, nil
+		}
+		r.archives++
+		if r.cur == r.src {
+			// Uncompressed archives end with their trailer. Anything
+			// following is another segment.
+			r.endSegmentSize()
+			r.cur = nil
+			continue
+		}
+		r.afterEntry = true
+	}
+}
+
+// Read reads from the body of the current entry.
+func (r *CPIOReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 || r.cur == nil {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.cur.Read(p)
+	r.remaining -= int64(n)
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nextSegment starts the next segment after skipping NUL padding. It returns
+// [io.EOF] if there is none.
+func (r *CPIOReader) nextSegment() error {
+	if err := skipZeros(r.src); err != nil {
+		return err
+	}
+	offset := r.counter.n - int64(r.src.Buffered())
+
+	magic, err := r.src.Peek(6)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if string(magic) == newcMagic || string(magic) == newcMagicCRC {
+		r.segments = append(r.segments, Segment{Compression: CompressionNone, Offset: offset})
+		r.cur = r.src
+		r.afterEntry = false
+		return nil
+	}
+
+	compression, ok, err := DetectCompression(magic)
+	if err != nil {
+		return fmt.Errorf("offset %d: %v", offset, err)
+	}
+	if !ok {
+		return fmt.Errorf("offset %d: unknown format", offset)
+	}
+	var compressed io.Reader = r.src
+	if compression != CompressionGzip {
+		compressed, err = r.cutCompressed(compression, offset)
+		if err != nil {
+			return fmt.Errorf("offset %d: %v", offset, err)
+		}
+	}
+	decomp, err := compression.NewReader(compressed)
+	if err != nil {
+		return fmt.Errorf("offset %d: decompress %s: %v", offset, compression, err)
+	}
+	r.segments = append(r.segments, Segment{Compression: compression, Offset: offset})
+	r.decomp = decomp
+	r.decompRead = &countingReader{r: decomp}
+	r.cur = bufio.NewReader(r.decompRead)
+	r.afterEntry = false
+	return nil
+}
+
+// cutCompressed returns a reader for the compressed data of the given
+// [Compression] starting at the given offset. All following data remains to
+// be read from the source. The gzip reader stops at the end of its data by
+// itself, but the other decompressors read ahead, so the rest of the input
+// is read into memory to determine the end of the compressed data.
+func (r *CPIOReader) cutCompressed(compression Compression, offset int64) (io.Reader, error) {
+	data, err := io.ReadAll(r.src)
+	if err != nil {
+		return nil, err
+	}
+	length, err := compressedLen(compression, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", compression, err)
+	}
+	r.counter = &countingReader{r: bytes.NewReader(data[length:]), n: offset + int64(length)}
+	r.src = bufio.NewReader(r.counter)
+	return bytes.NewReader(data[:length]), nil
+}
+
+// endSegment ends the current compressed segment.
+func (r *CPIOReader) endSegment() error {
+	r.endSegmentSize()
+	err := r.decomp.Close()
+	r.decomp, r.decompRead = nil, nil
+	r.cur = nil
+	return err
+}
+
+// endSegmentSize sets the size of the current segment, that ends at the
+// current position in the input.
+func (r *CPIOReader) endSegmentSize() {
+	segment := &r.segments[len(r.segments)-1]
+	segment.Size = r.counter.n - int64(r.src.Buffered()) - segment.Offset
+}
+
+// offset returns the offset of the next byte of the current segment in its
+// uncompressed data.
+func (r *CPIOReader) offset() int64 {
+	if r.cur == r.src {
+		return r.counter.n - int64(r.src.Buffered()) - r.segments[len(r.segments)-1].Offset
+	}
+	return r.decompRead.n - int64(r.cur.Buffered())
+}
+
+// readHeader reads the header of the next entry of the current segment.
+func (r *CPIOReader) readHeader() (*Header, error) {
+	buf := make([]byte, newcHeaderLen)
+	if _, err := io.ReadFull(r.cur, buf); err != nil {
+		return nil, fmt.Errorf("read header: %v", unexpectedEOF(err))
+	}
+	if magic := string(buf[:6]); magic != newcMagic && magic != newcMagicCRC {
+		return nil, fmt.Errorf("invalid header magic: %q", magic)
+	}
+
+	fields := make([]uint32, 13)
+	for idx := range fields {
+		value, err := strconv.ParseUint(string(buf[6+idx*8:14+idx*8]), 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid header field %d: %v", idx, err)
+		}
+		fields[idx] = uint32(value)
+	}
+
+	nameSize := int64(fields[11])
+	if nameSize == 0 || nameSize > maxNameSize {
+		return nil, fmt.Errorf("invalid header: name size %d", nameSize)
+	}
+	name := make([]byte, nameSize+pad(newcHeaderLen+nameSize))
+	if _, err := io.ReadFull(r.cur, name); err != nil {
+		return nil, fmt.Errorf("read name: %v", unexpectedEOF(err))
+	}
+
+	hdr := &Header{
+		Name:      string(name[:nameSize-1]),
+		Mode:      fileMode(fields[1]),
+		Owner:     Owner{UID: int(fields[2]), GID: int(fields[3])},
+		Inode:     fields[0],
+		NLink:     fields[4],
+		ModTime:   time.Unix(int64(fields[5]), 0),
+		Size:      int64(fields[6]),
+		Offset:    r.offset(),
+		DevMajor:  fields[7],
+		DevMinor:  fields[8],
+		RDevMajor: fields[9],
+		RDevMinor: fields[10],
+		Segment:   len(r.segments) - 1,
+		Archive:   r.archives,
+	}
+	r.remaining = hdr.Size
+	r.pad = pad(hdr.Size)
+	return hdr, nil
+}
+
+// fileMode converts the given newc mode bits into an [fs.FileMode]. It is
+// the inverse of newcMode.
+func fileMode(m uint32) fs.FileMode {
+	mode := fs.FileMode(m & modePerm)
+	if m&modeSetuid != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if m&modeSetgid != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if m&modeSticky != 0 {
+		mode |= fs.ModeSticky
+	}
+
+	switch m & modeTypeMask {
+	case modeDir:
+		mode |= fs.ModeDir
+	case modeSymlink:
+		mode |= fs.ModeSymlink
+	case modeBlock:
+		mode |= fs.ModeDevice
+	case modeChar:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case modeFIFO:
+		mode |= fs.ModeNamedPipe
+	case modeSocket:
+		mode |= fs.ModeSocket
+	}
+
+	return mode
+}
+
+// skipZeros discards NUL bytes. It returns [io.EOF] if the end of the input
+// is reached.
+func skipZeros(r *bufio.Reader) error {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != 0 {
+			return r.UnreadByte()
+		}
+	}
+}
+
+// unexpectedEOF converts [io.EOF] into [io.ErrUnexpectedEOF].
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// countingReader counts the bytes read from the underlying [io.Reader].
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
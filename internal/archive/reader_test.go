@@ -0,0 +1,262 @@
+package archive_test
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/aibor/initramfs/internal/archive"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestArchive writes an archive with a single regular file with the
+// given name and content, compressed with the given compression.
+func writeTestArchive(t *testing.T, w io.Writer, compression archive.Compression, name, content string) {
+	t.Helper()
+	cw, err := compression.NewWriter(w)
+	require.NoError(t, err)
+	aw := archive.NewCPIOWriter(cw)
+	aw.SetModTime(time.Unix(1000, 0))
+	require.NoError(t, aw.WriteDirectory("/dir", 0755, archive.Owner{}))
+	testFS := fstest.MapFS{"file": &fstest.MapFile{Data: []byte(content)}}
+	file, err := testFS.Open("file")
+	require.NoError(t, err)
+	defer file.Close()
+	require.NoError(t, aw.WriteRegular(name, file, 0644, archive.Owner{UID: 1, GID: 2}))
+	require.NoError(t, aw.Close())
+	require.NoError(t, cw.Close())
+}
+
+type readEntry struct {
+	name    string
+	mode    fs.FileMode
+	content string
+	segment int
+	archive int
+}
+
+func readAll(t *testing.T, r *archive.CPIOReader) ([]readEntry, error) {
+	t.Helper()
+	var entries []readEntry
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return entries, err
+		}
+		content, err := io.ReadAll(r)
+		require.NoError(t, err)
+		entries = append(entries, readEntry{hdr.Name, hdr.Mode, string(content), hdr.Segment, hdr.Archive})
+	}
+}
+
+func TestCPIOReader(t *testing.T) {
+	for _, compression := range []archive.Compression{
+		archive.CompressionNone,
+		archive.CompressionGzip,
+		archive.CompressionZstd,
+		archive.CompressionXZ,
+		archive.CompressionLZ4,
+	} {
+		compression := compression
+		t.Run(compression.String(), func(t *testing.T) {
+			var b bytes.Buffer
+			writeTestArchive(t, &b, compression, "/dir/file", "content")
+			size := int64(b.Len())
+			decomp, err := compression.NewReader(bytes.NewReader(b.Bytes()))
+			require.NoError(t, err)
+			data, err := io.ReadAll(decomp)
+			require.NoError(t, err)
+
+			r := archive.NewCPIOReader(&b)
+			hdr, err := r.Next()
+			require.NoError(t, err)
+			assert.Equal(t, "/dir", hdr.Name)
+			assert.Equal(t, fs.ModeDir|0755, hdr.Mode)
+
+			hdr, err = r.Next()
+			require.NoError(t, err)
+			assert.Equal(t, "/dir/file", hdr.Name)
+			assert.Equal(t, fs.FileMode(0644), hdr.Mode)
+			assert.Equal(t, archive.Owner{UID: 1, GID: 2}, hdr.Owner)
+			assert.EqualValues(t, 7, hdr.Size)
+			assert.EqualValues(t, 1, hdr.NLink)
+			assert.Equal(t, time.Unix(1000, 0), hdr.ModTime)
+			assert.Equal(t, "content", string(data[hdr.Offset:hdr.Offset+hdr.Size]))
+			content, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, "content", string(content))
+
+			_, err = r.Next()
+			assert.Equal(t, io.EOF, err)
+			assert.Equal(t, []archive.Segment{{Compression: compression, Size: size}}, r.Segments())
+		})
+	}
+
+	t.Run("concatenated", func(t *testing.T) {
+		var b bytes.Buffer
+		writeTestArchive(t, &b, archive.CompressionNone, "/dir/a", "a")
+		sizeNone := b.Len()
+		b.Write(make([]byte, 512))
+		offsetGzip := b.Len()
+		writeTestArchive(t, &b, archive.CompressionGzip, "/dir/b", "bb")
+		offsetGzip2 := b.Len()
+		writeTestArchive(t, &b, archive.CompressionGzip, "/dir/c", "ccc")
+		sizeGzip2 := b.Len() - offsetGzip2
+		b.Write(make([]byte, 3))
+		offsetZstd := b.Len()
+		// Two archives in the same compressed stream.
+		var inner bytes.Buffer
+		writeTestArchive(t, &inner, archive.CompressionNone, "/dir/d", "dddd")
+		inner.Write(make([]byte, 4))
+		writeTestArchive(t, &inner, archive.CompressionNone, "/dir/e", "eeeee")
+		w, err := archive.CompressionZstd.NewWriter(&b)
+		require.NoError(t, err)
+		_, err = w.Write(inner.Bytes())
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		sizeZstd := b.Len() - offsetZstd
+
+		r := archive.NewCPIOReader(&b)
+		entries, err := readAll(t, r)
+		require.NoError(t, err)
+		expected := []readEntry{}
+		for idx, name := range []string{"a", "b", "c", "d", "e"} {
+			segment := idx
+			if name == "e" {
+				segment = 3
+			}
+			expected = append(expected,
+				readEntry{"/dir", fs.ModeDir | 0755, "", segment, idx},
+				readEntry{"/dir/" + name, 0644, string(bytes.Repeat([]byte(name), idx+1)), segment, idx},
+			)
+		}
+		assert.Equal(t, expected, entries)
+		assert.Equal(t, []archive.Segment{
+			{Compression: archive.CompressionNone, Offset: 0, Size: int64(sizeNone)},
+			{Compression: archive.CompressionGzip, Offset: int64(offsetGzip), Size: int64(offsetGzip2 - offsetGzip)},
+			{Compression: archive.CompressionGzip, Offset: int64(offsetGzip2), Size: int64(sizeGzip2)},
+			{Compression: archive.CompressionZstd, Offset: int64(offsetZstd), Size: int64(sizeZstd)},
+		}, r.Segments())
+	})
+
+	t.Run("compressed followed by segments", func(t *testing.T) {
+		compressions := []archive.Compression{
+			archive.CompressionZstd,
+			archive.CompressionXZ,
+			archive.CompressionLZ4,
+			archive.CompressionGzip,
+			archive.CompressionNone,
+		}
+		var b bytes.Buffer
+		var expected []archive.Segment
+		for idx, compression := range compressions {
+			offset := int64(b.Len())
+			writeTestArchive(t, &b, compression, "/dir/"+compression.String(), "content")
+			expected = append(expected, archive.Segment{
+				Compression: compression,
+				Offset:      offset,
+				Size:        int64(b.Len()) - offset,
+			})
+			// Pad like between segments of an image.
+			b.Write(make([]byte, 4-b.Len()%4+idx%2*4))
+		}
+
+		r := archive.NewCPIOReader(&b)
+		entries, err := readAll(t, r)
+		require.NoError(t, err)
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.name)
+		}
+		assert.Equal(t, []string{
+			"/dir", "/dir/zstd",
+			"/dir", "/dir/xz",
+			"/dir", "/dir/lz4",
+			"/dir", "/dir/gzip",
+			"/dir", "/dir/none",
+		}, names)
+		assert.Equal(t, expected, r.Segments())
+	})
+
+	t.Run("skip body", func(t *testing.T) {
+		var b bytes.Buffer
+		writeTestArchive(t, &b, archive.CompressionGzip, "/dir/file", "content")
+		r := archive.NewCPIOReader(&b)
+		names := []string{}
+		for {
+			hdr, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			names = append(names, hdr.Name)
+		}
+		assert.Equal(t, []string{"/dir", "/dir/file"}, names)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		_, err := archive.NewCPIOReader(&bytes.Buffer{}).Next()
+		assert.Equal(t, io.EOF, err)
+	})
+
+	tests := []struct {
+		name   string
+		data   func(t *testing.T) []byte
+		errMsg string
+	}{
+		{
+			name:   "unknown format",
+			data:   func(*testing.T) []byte { return []byte("\x00\x00\x00\x00garbage") },
+			errMsg: "offset 4: unknown format",
+		},
+		{
+			name:   "unsupported compression",
+			data:   func(*testing.T) []byte { return []byte("BZh91AY&SY") },
+			errMsg: "offset 0: unsupported compression: bzip2",
+		},
+		{
+			name: "truncated",
+			data: func(t *testing.T) []byte {
+				var b bytes.Buffer
+				writeTestArchive(t, &b, archive.CompressionNone, "/dir/file", "content")
+				return b.Bytes()[:200]
+			},
+			errMsg: "unexpected EOF",
+		},
+		{
+			name: "truncated zstd",
+			data: func(t *testing.T) []byte {
+				var b bytes.Buffer
+				writeTestArchive(t, &b, archive.CompressionZstd, "/dir/file", "content")
+				return b.Bytes()[:b.Len()-8]
+			},
+			errMsg: "offset 0: zstd: truncated compressed data",
+		},
+		{
+			name: "invalid header",
+			data: func(t *testing.T) []byte {
+				var b bytes.Buffer
+				writeTestArchive(t, &b, archive.CompressionNone, "/dir/file", "content")
+				data := b.Bytes()
+				copy(data[6:14], "XXXXXXXX")
+				return data
+			},
+			errMsg: "invalid header field 0",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readAll(t, archive.NewCPIOReader(bytes.NewReader(tt.data(t))))
+			assert.ErrorContains(t, err, tt.errMsg)
+		})
+	}
+}
@@ -4,26 +4,58 @@ import "io/fs"
 
 type MockWriter struct {
 	Path        string
+	Paths       []string
 	RelatedPath string
 	Source      fs.File
 	Mode        fs.FileMode
+	Owner       Owner
+	Major       uint32
+	Minor       uint32
 	Err         error
 }
 
-func (m *MockWriter) WriteRegular(path string, source fs.File, mode fs.FileMode) error {
+func (m *MockWriter) WriteRegular(path string, source fs.File, mode fs.FileMode, owner Owner) error {
 	m.Path = path
 	m.Source = source
 	m.Mode = mode
+	m.Owner = owner
 	return m.Err
 }
 
-func (m *MockWriter) WriteDirectory(path string) error {
+func (m *MockWriter) WriteHardLinks(paths []string, source fs.File, mode fs.FileMode, owner Owner) error {
+	m.Paths = paths
+	m.Source = source
+	m.Mode = mode
+	m.Owner = owner
+	return m.Err
+}
+
+func (m *MockWriter) WriteDirectory(path string, mode fs.FileMode, owner Owner) error {
 	m.Path = path
+	m.Mode = mode
+	m.Owner = owner
 	return m.Err
 }
 
-func (m *MockWriter) WriteLink(path, target string) error {
+func (m *MockWriter) WriteLink(path, target string, owner Owner) error {
 	m.Path = path
 	m.RelatedPath = target
+	m.Owner = owner
+	return m.Err
+}
+
+func (m *MockWriter) WriteDevice(path string, mode fs.FileMode, major, minor uint32, owner Owner) error {
+	m.Path = path
+	m.Mode = mode
+	m.Major = major
+	m.Minor = minor
+	m.Owner = owner
+	return m.Err
+}
+
+func (m *MockWriter) WriteSpecial(path string, mode fs.FileMode, owner Owner) error {
+	m.Path = path
+	m.Mode = mode
+	m.Owner = owner
 	return m.Err
 }
@@ -2,9 +2,18 @@ package archive
 
 import "io/fs"
 
+// Owner is the numeric user and group ID of an archive entry.
+type Owner struct {
+	UID int
+	GID int
+}
+
 // Writer defines initramfs archive writer interface.
 type Writer interface {
-	WriteRegular(string, fs.File, fs.FileMode) error
-	WriteDirectory(string) error
-	WriteLink(string, string) error
+	WriteRegular(string, fs.File, fs.FileMode, Owner) error
+	WriteHardLinks([]string, fs.File, fs.FileMode, Owner) error
+	WriteDirectory(string, fs.FileMode, Owner) error
+	WriteLink(string, string, Owner) error
+	WriteDevice(string, fs.FileMode, uint32, uint32, Owner) error
+	WriteSpecial(string, fs.FileMode, Owner) error
 }
@@ -0,0 +1,27 @@
+package files
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// Content returns a reader for the content of a regular file [Entry] along
+// with the size of the content. It is used instead of a source file.
+// The caller is responsible for closing the reader. The reader may be an
+// [io/fs.File], whose [io/fs.FileInfo] then describes the content.
+type Content func() (io.ReadCloser, int64, error)
+
+// BytesContent returns a [Content] for the given data.
+func BytesContent(data []byte) Content {
+	return func() (io.ReadCloser, int64, error) {
+		return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+	}
+}
+
+// StringContent returns a [Content] for the given string.
+func StringContent(data string) Content {
+	return func() (io.ReadCloser, int64, error) {
+		return io.NopCloser(strings.NewReader(data)), int64(len(data)), nil
+	}
+}
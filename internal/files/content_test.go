@@ -0,0 +1,35 @@
+package files
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		content Content
+	}{
+		{name: "bytes", content: BytesContent([]byte("content"))},
+		{name: "string", content: StringContent("content")},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			// Can be read multiple times.
+			for i := 0; i < 2; i++ {
+				r, size, err := tt.content()
+				require.NoError(t, err)
+				assert.EqualValues(t, 7, size)
+				data, err := io.ReadAll(r)
+				require.NoError(t, err)
+				assert.Equal(t, "content", string(data))
+				assert.NoError(t, r.Close())
+			}
+		})
+	}
+}
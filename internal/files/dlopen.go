@@ -0,0 +1,131 @@
+package files
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+)
+
+const (
+	// DLOpenRequired is the priority of libraries an ELF file can not work
+	// without, even though it loads them at runtime only.
+	DLOpenRequired = "required"
+	// DLOpenRecommended is the priority of libraries for important features.
+	// It is the default priority of .note.dlopen entries.
+	DLOpenRecommended = "recommended"
+	// DLOpenSuggested is the priority of libraries for optional features.
+	DLOpenSuggested = "suggested"
+)
+
+const (
+	// dlopenNoteOwner is the owner of .note.dlopen notes.
+	dlopenNoteOwner = "FDO"
+	// dlopenNoteType is the type of .note.dlopen notes.
+	dlopenNoteType = 0x407c0c0a
+)
+
+// DLOpenNote is an entry of the ELF dlopen metadata of an ELF file, as
+// specified by https://systemd.io/ELF_DLOPEN_METADATA/. It describes
+// libraries the file loads at runtime with dlopen, so they are not present
+// as DT_NEEDED.
+type DLOpenNote struct {
+	// Feature is the short name of the feature the libraries are used for.
+	Feature string `json:"feature"`
+	// Description is the human readable description of the feature.
+	Description string `json:"description"`
+	// Priority is one of [DLOpenRequired], [DLOpenRecommended] or
+	// [DLOpenSuggested].
+	Priority string `json:"priority"`
+	// SONames are the alternative names of the library in order of
+	// preference. Only one of them is loaded.
+	SONames []string `json:"soname"`
+}
+
+// DLOpenNotes returns the entries of the .note.dlopen notes of the ELF file
+// with the given path. If fsys is nil, the host's file system is used.
+func DLOpenNotes(fsys fs.FS, elfFilePath string) ([]DLOpenNote, error) {
+	info, err := readELF(fsys, elfFilePath, true)
+	if err != nil {
+		return nil, err
+	}
+	if info.dlopenErr != nil {
+		return nil, fmt.Errorf("read dlopen notes: %v", info.dlopenErr)
+	}
+	return info.dlopen, nil
+}
+
+// dlopenPriorityRank returns the rank of the given priority. Higher ranks are
+// more important. It returns false for unknown priorities.
+func dlopenPriorityRank(priority string) (int, bool) {
+	switch priority {
+	case DLOpenRequired:
+		return 3, true
+	case DLOpenRecommended:
+		return 2, true
+	case DLOpenSuggested:
+		return 1, true
+	default:
+		return 0, false
+	}
+}
+
+// dlopenNotes parses the FDO dlopen notes of all note sections of the given
+// file. Entries without priority get [DLOpenRecommended].
+func dlopenNotes(f *elf.File) ([]DLOpenNote, error) {
+	var notes []DLOpenNote
+	for _, section := range f.Sections {
+		if section.Type != elf.SHT_NOTE {
+			continue
+		}
+		data, err := section.Data()
+		if err != nil {
+			return nil, err
+		}
+		align := uint64(4)
+		if section.Addralign == 8 {
+			align = 8
+		}
+
+		for len(data) > 0 {
+			if len(data) < 12 {
+				return nil, fmt.Errorf("note in %s too short", section.Name)
+			}
+			nameSize := uint64(f.ByteOrder.Uint32(data[0:4]))
+			descSize := uint64(f.ByteOrder.Uint32(data[4:8]))
+			noteType := f.ByteOrder.Uint32(data[8:12])
+			descOffset := alignUp(12+nameSize, align)
+			end := alignUp(descOffset+descSize, align)
+			if descOffset+descSize > uint64(len(data)) {
+				return nil, fmt.Errorf("note in %s exceeds section", section.Name)
+			}
+			name := string(bytes.TrimRight(data[12:12+nameSize], "\x00"))
+			desc := bytes.TrimRight(data[descOffset:descOffset+descSize], "\x00")
+			if end > uint64(len(data)) {
+				end = uint64(len(data))
+			}
+			data = data[end:]
+
+			if name != dlopenNoteOwner || noteType != dlopenNoteType {
+				continue
+			}
+			var entries []DLOpenNote
+			if err := json.Unmarshal(desc, &entries); err != nil {
+				return nil, fmt.Errorf("parse dlopen note: %v", err)
+			}
+			for idx := range entries {
+				if entries[idx].Priority == "" {
+					entries[idx].Priority = DLOpenRecommended
+				}
+			}
+			notes = append(notes, entries...)
+		}
+	}
+	return notes, nil
+}
+
+// alignUp returns the given value rounded up to a multiple of align.
+func alignUp(value, align uint64) uint64 {
+	return (value + align - 1) &^ (align - 1)
+}
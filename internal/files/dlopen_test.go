@@ -0,0 +1,166 @@
+package files_test
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/aibor/initramfs/internal/files"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDLOpenNotes(t *testing.T) {
+	t.Run("notes", func(t *testing.T) {
+		notes, err := files.DLOpenNotes(nil, "testdata/bin/main_dlopen")
+		require.NoError(t, err)
+
+		expected := []files.DLOpenNote{
+			{
+				Feature:     "func3",
+				Description: "Optional func3 support",
+				Priority:    files.DLOpenRequired,
+				SONames:     []string{"libfunc3.so.9", "libfunc3.so"},
+			},
+			{
+				Feature:  "missing",
+				Priority: files.DLOpenSuggested,
+				SONames:  []string{"libmissing.so"},
+			},
+		}
+		assert.Equal(t, expected, notes)
+	})
+
+	t.Run("no notes", func(t *testing.T) {
+		notes, err := files.DLOpenNotes(nil, "testdata/bin/main")
+		require.NoError(t, err)
+		assert.Empty(t, notes)
+	})
+}
+
+func TestELFLibResolverResolveDLOpen(t *testing.T) {
+	tests := []struct {
+		name         string
+		priority     string
+		hints        map[string][]string
+		expectedLibs []string
+		errMsg       string
+	}{
+		{
+			name:         "notes ignored",
+			expectedLibs: []string{"/lib/libfunc2.so"},
+		},
+		{
+			name:         "required",
+			priority:     files.DLOpenRequired,
+			expectedLibs: []string{"/lib/libfunc2.so", "/lib/libfunc3.so", "/lib/libfunc1.so"},
+		},
+		{
+			// The suggested lib does not exist, which is not an error.
+			name:         "suggested",
+			priority:     files.DLOpenSuggested,
+			expectedLibs: []string{"/lib/libfunc2.so", "/lib/libfunc3.so", "/lib/libfunc1.so"},
+		},
+		{
+			name:     "unknown priority",
+			priority: "mandatory",
+			errMsg:   "unknown dlopen priority: mandatory",
+		},
+		{
+			name:         "hint by base name",
+			hints:        map[string][]string{"libfunc2.so": {"libfunc1.so"}},
+			expectedLibs: []string{"/lib/libfunc2.so", "/lib/libfunc1.so"},
+		},
+		{
+			name:         "hint by path",
+			hints:        map[string][]string{"/bin/main_dlopen": {"libfunc3.so"}},
+			expectedLibs: []string{"/lib/libfunc2.so", "/lib/libfunc3.so", "/lib/libfunc1.so"},
+		},
+		{
+			name:   "missing hint",
+			hints:  map[string][]string{"main_dlopen": {"libmissing.so"}},
+			errMsg: "hinted lib could not be resolved: libmissing.so",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			r := files.ELFLibResolver{
+				FS:             os.DirFS("testdata"),
+				SearchPaths:    []string{"/lib"},
+				DLOpenPriority: tt.priority,
+				Hints:          tt.hints,
+			}
+			err := r.Resolve("/bin/main_dlopen")
+			if tt.errMsg != "" {
+				assert.ErrorContains(t, err, tt.errMsg)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedLibs, r.Libs)
+		})
+	}
+
+	t.Run("dependencies", func(t *testing.T) {
+		r := files.ELFLibResolver{
+			FS:             os.DirFS("testdata"),
+			SearchPaths:    []string{"/lib"},
+			DLOpenPriority: files.DLOpenRequired,
+		}
+		require.NoError(t, r.Resolve("/bin/main_dlopen"))
+		assert.Contains(t, r.Dependencies, files.Dependency{
+			Requester: "/bin/main_dlopen",
+			Name:      "libfunc3.so",
+			Path:      "/lib/libfunc3.so",
+			DLOpen:    true,
+		})
+	})
+}
+
+func TestELFLibResolverResolveInvalidDLOpenNote(t *testing.T) {
+	data, err := os.ReadFile("testdata/bin/main_dlopen")
+	require.NoError(t, err)
+	// The JSON of the note is invalid.
+	data = bytes.Replace(data, []byte(`[{"feature"`), []byte(`{{"feature"`), 1)
+	testFS := fstest.MapFS{
+		"bin/main_dlopen": &fstest.MapFile{Data: data, Mode: 0755},
+	}
+	libs, err := os.ReadDir("testdata/lib")
+	require.NoError(t, err)
+	for _, lib := range libs {
+		data, err := os.ReadFile("testdata/lib/" + lib.Name())
+		require.NoError(t, err)
+		testFS["lib/"+lib.Name()] = &fstest.MapFile{Data: data, Mode: 0755}
+	}
+
+	t.Run("notes", func(t *testing.T) {
+		_, err := files.DLOpenNotes(testFS, "bin/main_dlopen")
+		assert.ErrorContains(t, err, "read dlopen notes: parse dlopen note:")
+	})
+
+	t.Run("notes ignored", func(t *testing.T) {
+		r := files.ELFLibResolver{
+			FS:          testFS,
+			SearchPaths: []string{"/lib"},
+		}
+		require.NoError(t, r.Resolve("/bin/main_dlopen"))
+		assert.Equal(t, []string{"/lib/libfunc2.so"}, r.Libs)
+		assert.Empty(t, r.Unresolved)
+	})
+
+	t.Run("unresolved", func(t *testing.T) {
+		r := files.ELFLibResolver{
+			FS:             testFS,
+			SearchPaths:    []string{"/lib"},
+			DLOpenPriority: files.DLOpenSuggested,
+		}
+		require.NoError(t, r.Resolve("/bin/main_dlopen"))
+		assert.Equal(t, []string{"/lib/libfunc2.so"}, r.Libs)
+		require.Len(t, r.Unresolved, 1)
+		assert.Equal(t, "/bin/main_dlopen", r.Unresolved[0].Requester)
+		assert.Equal(t, ".note.dlopen", r.Unresolved[0].Name)
+		assert.ErrorContains(t, r.Unresolved[0].Err, "read dlopen notes: parse dlopen note:")
+	})
+}
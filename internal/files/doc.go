@@ -1,6 +1,6 @@
 // Package files provides a simple file tree abstraction.
 //
 // It is specifically designed to match the simple needs for building a simple
-// initramfs. So it only supports file types for regular files, directories and
-// symbolic links.
+// initramfs. So it only supports file types for regular files, directories,
+// symbolic and hard links, device nodes, named pipes and sockets.
 package files
@@ -1,11 +1,16 @@
 package files
 
 import (
+	"bytes"
 	"debug/elf"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 
 	"golang.org/x/exp/slices"
 )
@@ -13,53 +18,668 @@ import (
 // ELFLibResolver resolves dynamically linked libraries of ELF file. It collects
 // the libraries deduplicated for all files resolved with
 // [ELFLibResolver.Resolve].
+//
+// Each resolved file is resolved like the main object of its own process:
+// like ld.so, a library is loaded only once per process by its name, but
+// libraries found for other files are not reused, as they might have been
+// found with other search paths or for another machine.
+//
+// Libraries are looked up in the order of the dynamic linker ld.so for each
+// requesting object: the DT_RPATH of the object and the objects it has been
+// loaded by, unless the object has a DT_RUNPATH, then
+// [ELFLibResolver.SearchPaths], like LD_LIBRARY_PATH, then the DT_RUNPATH of
+// the object, then [ELFLibResolver.Cache] and [ELFLibResolver.ConfigPaths],
+// and finally the default search paths for the machine of the object, see
+// [DefaultSearchPaths]. The last three are skipped, if the object is linked
+// with "-z nodefaultlib". The dynamic string tokens $ORIGIN, $LIB and $PLATFORM
+// are expanded in DT_RPATH and DT_RUNPATH.
+//
+// Libraries loaded at runtime with dlopen are not present as DT_NEEDED. They
+// are resolved the same way, if they are listed in the .note.dlopen notes of
+// the object, see [ELFLibResolver.DLOpenPriority], or in
+// [ELFLibResolver.Hints].
 type ELFLibResolver struct {
+	// FS is the file system ELF files and libraries are looked up in. All
+	// paths are relative to its root. If nil, the host's file system is used
+	// and relative paths are relative to the current working directory.
+	FS fs.FS
+	// Root is the directory in FS libraries are looked up in, like a sysroot
+	// for cross-architecture images. Search paths and absolute symbolic links
+	// are resolved relative to it, if FS implements [ReadLinkFS]. If empty,
+	// the root of FS is used. Paths relative to $ORIGIN are not relative to
+	// Root, as the path of the requesting object includes it already.
+	Root string
+	// SearchPaths are the directories libraries are looked up in, relative to
+	// Root, like LD_LIBRARY_PATH.
 	SearchPaths []string
-	Libs        []string
+	// Cache is the ld.so.cache libraries are looked up in after DT_RUNPATH,
+	// unless the object is linked with "-z nodefaultlib". Its paths are
+	// relative to Root.
+	Cache *LDCache
+	// ConfigPaths are the directories of the ld.so.conf, relative to Root.
+	// They are looked up after the Cache and before the default search
+	// paths, as the cache might be missing or outdated.
+	ConfigPaths []string
+	// DLOpenPriority is the lowest priority of .note.dlopen entries that are
+	// resolved: [DLOpenRequired], [DLOpenRecommended] or [DLOpenSuggested].
+	// If empty, the notes are not read. Entries that can not be resolved are
+	// an error only, if they are required. Notes that can not be parsed are
+	// collected in Unresolved.
+	DLOpenPriority string
+	// Hints are additional libraries required by ELF files, like libraries
+	// they load with dlopen. The keys are paths of ELF files, as passed to
+	// [ELFLibResolver.Resolve] or found for libraries, or their base names,
+	// like "libc.so.6". The libraries are looked up like DT_NEEDED entries of
+	// the file and must be found.
+	Hints map[string][]string
+	// AllowMissing are patterns of names of libraries and interpreters that
+	// are allowed to be missing, like "linux-vdso.so.1", in the syntax of
+	// [path.Match]. Paths match by their base name as well.
+	AllowMissing []string
+	// KeepGoing continues resolving, if a library or interpreter can not be
+	// resolved. Those are collected in Unresolved instead of being returned
+	// as error.
+	KeepGoing bool
+	// Unresolved are the libraries and interpreters that could not be
+	// resolved, if KeepGoing is set, and the .note.dlopen notes that could
+	// not be parsed.
+	Unresolved []Unresolved
+	// Scripts enables resolving the interpreters of scripts given in their
+	// shebang line by [ELFLibResolver.ResolveFile].
+	Scripts bool
+	// Libs are the paths of all libraries found for the resolved ELF files,
+	// including the libraries required by libraries, deduplicated and in the
+	// order they have been found. The content of a library should be read
+	// from its [ELFLibResolver.RealPath].
+	Libs []string
+	// Interpreters are the program interpreters requested by the resolved
+	// ELF files, as given in their PT_INTERP program header.
+	Interpreters []string
+	// ScriptInterpreters are the interpreters requested by the shebang line
+	// of the resolved scripts, like "/bin/sh", if Scripts is set.
+	ScriptInterpreters []string
+	// Dependencies are the edges of the dependency graph of all resolved ELF
+	// files, in the order they have been resolved.
+	Dependencies []Dependency
+
+	found        map[string]*candidate
+	loaded       map[string]string
+	defaultPaths []string
+}
+
+// Dependency is an edge of the dependency graph of resolved ELF files.
+type Dependency struct {
+	// Requester is the path of the ELF file requiring the dependency.
+	Requester string
+	// Name is the name the dependency is required by: the DT_NEEDED entry
+	// for libraries or the PT_INTERP path for interpreters.
+	Name string
+	// Path is the path the dependency has been found at. For libraries, it
+	// is the path in [ELFLibResolver.Libs].
+	Path string
+	// Interpreter is true, if the dependency is the program interpreter of
+	// the requester.
+	Interpreter bool
+	// DLOpen is true, if the dependency is loaded at runtime with dlopen, as
+	// given by a .note.dlopen note or [ELFLibResolver.Hints].
+	DLOpen bool
+}
+
+// Unresolved is a dependency of an ELF file that could not be resolved.
+type Unresolved struct {
+	// Requester is the path of the ELF file requiring the dependency.
+	Requester string
+	// Name is the name the dependency is required by. The alternatives of
+	// .note.dlopen entries are joined by ", ".
+	Name string
+	// Err describes why the dependency could not be resolved.
+	Err error
+}
+
+// elfObject is an ELF file in the dependency tree.
+type elfObject struct {
+	// path is the path the object has been found at. It is used as $ORIGIN.
+	path string
+	info *elfInfo
 }
 
 // Resolve analyzes the required linked libraries of the ELF file with the
 // given path. The libraries are search for in the library search paths and
-// are added with their absolute path to [ELFLibResolver]'s list of libs. Call
-// [ELFLibResolver.Libs] once all files are resolved.
+// are added with their absolute path to [ELFLibResolver.Libs], which is
+// complete once all files are resolved. The program interpreter of the file,
+// if any, is added to [ELFLibResolver.Interpreters].
 func (r *ELFLibResolver) Resolve(elfFile string) error {
-	libs, err := LinkedLibs(elfFile)
+	if err := r.validate(); err != nil {
+		return err
+	}
+
+	info, err := r.readELF(elfFile)
 	if err != nil {
 		return fmt.Errorf("get linked libs: %v", err)
 	}
+	return r.resolveMain(elfFile, info)
+}
+
+// resolveMain resolves the ELF file with the given info found at the given
+// path as the main object of a new process, so no libraries loaded for other
+// files are reused.
+func (r *ELFLibResolver) resolveMain(path string, info *elfInfo) error {
+	r.loaded = make(map[string]string)
+	return r.resolve(path, info, nil)
+}
 
-	for _, lib := range libs {
-		var found bool
-		for _, searchPath := range r.SearchPaths {
-			path := filepath.Join(searchPath, lib)
-			_, err := os.Stat(path)
+// validate returns an error if the configuration of the [ELFLibResolver] is
+// invalid.
+func (r *ELFLibResolver) validate() error {
+	if r.DLOpenPriority != "" {
+		if _, known := dlopenPriorityRank(r.DLOpenPriority); !known {
+			return fmt.Errorf("unknown dlopen priority: %s", r.DLOpenPriority)
+		}
+	}
+	return nil
+}
+
+// resolve resolves the libraries of the ELF file with the given info found at
+// the given path. Loaders is the chain of objects the file is loaded by,
+// starting with the closest one.
+func (r *ELFLibResolver) resolve(path string, info *elfInfo, loaders []*elfObject) error {
+	chain := append([]*elfObject{{path: path, info: info}}, loaders...)
+	dirs, defaultDirs := r.searchDirs(chain)
+
+	if info.interp != "" {
+		if err := r.resolveInterpreter(path, info, append(dirs, defaultDirs...)); err != nil {
+			return err
+		}
+	}
+
+	for _, lib := range info.libs {
+		resolved, skipped, err := r.resolveLib(path, lib, false, chain, dirs, defaultDirs)
+		if err != nil {
+			return err
+		}
+		if !resolved {
+			if err := r.missing(path, "lib", []string{lib}, skipped); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, lib := range r.hints(path) {
+		resolved, skipped, err := r.resolveLib(path, lib, true, chain, dirs, defaultDirs)
+		if err != nil {
+			return err
+		}
+		if !resolved {
+			if err := r.missing(path, "hinted lib", []string{lib}, skipped); err != nil {
+				return err
+			}
+		}
+	}
+
+	return r.resolveDLOpen(path, info, chain, dirs, defaultDirs)
+}
+
+// resolveLib resolves the given lib required by the first object of the
+// given chain found at the given path. It returns false and the reasons for
+// all skipped files, if no compatible file has been found.
+func (r *ELFLibResolver) resolveLib(path, lib string, dlopen bool, chain []*elfObject, dirs, defaultDirs []string) (bool, []string, error) {
+	dep := Dependency{Requester: path, Name: lib, DLOpen: dlopen}
+
+	// Like ld.so, load each library only once per process.
+	if loaded, exists := r.loaded[lib]; exists {
+		dep.Path = loaded
+		r.addDependency(dep)
+		return true, nil, nil
+	}
+
+	info := chain[0].info
+	found, skipped, err := r.find(r.candidates(lib, info, dirs, defaultDirs), info.header)
+	if err != nil || found == nil {
+		return false, skipped, err
+	}
+
+	r.loaded[lib] = found.path
+	dep.Path = found.path
+	r.addDependency(dep)
+	if !slices.Contains(r.Libs, found.path) {
+		r.Libs = append(r.Libs, found.path)
+		r.setFound(found.path, found)
+	}
+	// The libraries of the library depend on the loader chain, so they are
+	// resolved for each process.
+	if err := r.resolve(found.path, found.info, chain); err != nil {
+		return false, nil, err
+	}
+
+	return true, nil, nil
+}
+
+// resolveDLOpen resolves the libraries of the .note.dlopen entries of the
+// first object of the given chain with at least
+// [ELFLibResolver.DLOpenPriority]. The first soname of an entry that is found
+// is used.
+func (r *ELFLibResolver) resolveDLOpen(path string, info *elfInfo, chain []*elfObject, dirs, defaultDirs []string) error {
+	if r.DLOpenPriority == "" {
+		return nil
+	}
+	minRank, _ := dlopenPriorityRank(r.DLOpenPriority)
+
+	// Invalid notes, like of foreign tools, do not prevent using the file.
+	if info.dlopenErr != nil {
+		r.Unresolved = append(r.Unresolved, Unresolved{
+			Requester: path,
+			Name:      ".note.dlopen",
+			Err:       fmt.Errorf("read dlopen notes: %v", info.dlopenErr),
+		})
+		return nil
+	}
+
+	for _, note := range info.dlopen {
+		if rank, known := dlopenPriorityRank(note.Priority); !known || rank < minRank {
+			continue
+		}
+
+		var skipped []string
+		resolved := false
+		for _, soname := range note.SONames {
+			found, skippedLib, err := r.resolveLib(path, soname, true, chain, dirs, defaultDirs)
 			if err != nil {
-				if errors.Is(err, os.ErrNotExist) {
-					continue
-				}
 				return err
 			}
-			if !slices.Contains(r.Libs, path) {
-				r.Libs = append(r.Libs, path)
-				if err := r.Resolve(path); err != nil {
-					return err
-				}
+			if found {
+				resolved = true
+				break
 			}
-			found = true
-			break
+			skipped = append(skipped, skippedLib...)
 		}
-		if !found {
-			return fmt.Errorf("lib could not be resolved: %s", lib)
+		if !resolved && note.Priority == DLOpenRequired {
+			if err := r.missing(path, "dlopen lib", note.SONames, skipped); err != nil {
+				return err
+			}
 		}
 	}
 
 	return nil
 }
 
+// hints returns the [ELFLibResolver.Hints] for the file with the given path,
+// for the path itself and its base name.
+func (r *ELFLibResolver) hints(path string) []string {
+	var libs []string
+	for _, key := range []string{path, filepath.Base(path)} {
+		libs = appendUnique(libs, r.Hints[key]...)
+	}
+	return libs
+}
+
+// candidate is a file found for a lib or interpreter.
+type candidate struct {
+	path     string
+	realPath string
+	names    []string
+	info     *elfInfo
+}
+
+// find returns the first file of the given paths that exists and is an ELF
+// file compatible with ELF files with the given header, like ld.so skips
+// incompatible files. If none is found, it returns nil and the reasons for
+// all skipped files.
+func (r *ELFLibResolver) find(paths []string, header elf.FileHeader) (*candidate, []string, error) {
+	var skipped []string
+	for _, path := range paths {
+		realPath, names, err := r.lookup(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, nil, err
+		}
+
+		info, err := r.readELF(realPath)
+		if err != nil {
+			// Files that can not be opened are an error, invalid files are
+			// skipped.
+			var pathErr *fs.PathError
+			if errors.As(err, &pathErr) {
+				return nil, nil, err
+			}
+			skipped = append(skipped, fmt.Sprintf("%s: %v", path, err))
+			continue
+		}
+		if err := checkCompatible(header, info.header); err != nil {
+			skipped = append(skipped, fmt.Sprintf("%s: %v", path, err))
+			continue
+		}
+
+		return &candidate{path: path, realPath: realPath, names: names, info: info}, nil, nil
+	}
+	return nil, skipped, nil
+}
+
+// missing handles a dependency of the given kind with the given alternative
+// names that could not be resolved for the file with the given path. It
+// returns nil, if the dependency is allowed to be missing by
+// [ELFLibResolver.AllowMissing] or collected in [ELFLibResolver.Unresolved]
+// because of [ELFLibResolver.KeepGoing].
+func (r *ELFLibResolver) missing(requester, kind string, names, skipped []string) error {
+	for _, name := range names {
+		for _, pattern := range r.AllowMissing {
+			matched, err := path.Match(pattern, name)
+			if err != nil {
+				return fmt.Errorf("allow missing pattern %s: %v", pattern, err)
+			}
+			baseMatched, _ := path.Match(pattern, path.Base(name))
+			if matched || baseMatched {
+				return nil
+			}
+		}
+	}
+
+	name := strings.Join(names, ", ")
+	err := notFoundError(kind, name, skipped)
+	if !r.KeepGoing {
+		return err
+	}
+	r.Unresolved = append(r.Unresolved, Unresolved{
+		Requester: requester,
+		Name:      name,
+		Err:       err,
+	})
+	return nil
+}
+
+// notFoundError returns the error for a lib or interpreter with the given
+// name that could not be resolved. If incompatible files have been skipped,
+// the reasons are included.
+func notFoundError(kind, name string, skipped []string) error {
+	if len(skipped) == 0 {
+		return fmt.Errorf("%s could not be resolved: %s", kind, name)
+	}
+	return fmt.Errorf("%s could not be resolved: %s: no compatible file found, skipped %s",
+		kind, name, strings.Join(skipped, ", "))
+}
+
+// checkCompatible returns an error if an ELF file with the header got can
+// not be loaded into a process with ELF files with the header want.
+func checkCompatible(want, got elf.FileHeader) error {
+	switch {
+	case got.Class != want.Class:
+		return fmt.Errorf("class %s, want %s", got.Class, want.Class)
+	case got.Data != want.Data:
+		return fmt.Errorf("byte order %s, want %s", got.Data, want.Data)
+	case got.Machine != want.Machine:
+		return fmt.Errorf("machine %s, want %s", got.Machine, want.Machine)
+	case !compatibleOSABI(want.OSABI, got.OSABI):
+		return fmt.Errorf("OS ABI %s, want %s", got.OSABI, want.OSABI)
+	default:
+		return nil
+	}
+}
+
+// compatibleOSABI returns true if the given OS ABIs are compatible. The
+// generic System V ABI is compatible with the Linux ABI, as most Linux ELF
+// files use it.
+func compatibleOSABI(want, got elf.OSABI) bool {
+	linux := func(abi elf.OSABI) bool {
+		return abi == elf.ELFOSABI_NONE || abi == elf.ELFOSABI_LINUX
+	}
+	return got == want || (linux(got) && linux(want))
+}
+
+// candidates returns the paths the given lib required by the object with the
+// given info is looked up at, in order. Libs with a path separator are looked
+// up at that path only.
+func (r *ELFLibResolver) candidates(lib string, info *elfInfo, dirs, defaultDirs []string) []string {
+	if strings.Contains(lib, "/") {
+		return []string{r.rootPath(lib)}
+	}
+
+	var paths []string
+	for _, dir := range dirs {
+		paths = append(paths, filepath.Join(dir, lib))
+	}
+	if r.Cache != nil && !info.noDefaultLib {
+		for _, path := range r.Cache.Lookup(lib, info.header) {
+			paths = append(paths, r.rootPath(path))
+		}
+	}
+	for _, dir := range defaultDirs {
+		paths = append(paths, filepath.Join(dir, lib))
+	}
+	return paths
+}
+
+// searchDirs returns the directories libraries of the first object of the
+// given loader chain are looked up in, in the order of ld.so. The directories
+// that are looked up before the [ELFLibResolver.Cache] and the ones after it
+// are returned separately.
+func (r *ELFLibResolver) searchDirs(chain []*elfObject) ([]string, []string) {
+	var dirs, defaultDirs []string
+
+	obj := chain[0]
+	if len(obj.info.runpath) == 0 {
+		for _, loader := range chain {
+			// The DT_RPATH of objects with DT_RUNPATH is ignored.
+			if len(loader.info.runpath) == 0 {
+				dirs = append(dirs, r.expandPaths(loader, loader.info.rpath)...)
+			}
+		}
+	}
+
+	for _, searchPath := range r.SearchPaths {
+		dirs = append(dirs, r.rootPath(searchPath))
+	}
+
+	dirs = append(dirs, r.expandPaths(obj, obj.info.runpath)...)
+
+	if !obj.info.noDefaultLib {
+		for _, configPath := range r.ConfigPaths {
+			defaultDirs = append(defaultDirs, r.rootPath(configPath))
+		}
+		for _, searchPath := range DefaultSearchPaths(obj.info.header) {
+			if !slices.Contains(r.defaultPaths, searchPath) {
+				r.defaultPaths = append(r.defaultPaths, searchPath)
+			}
+			defaultDirs = append(defaultDirs, r.rootPath(searchPath))
+		}
+	}
+
+	return dirs, defaultDirs
+}
+
+// expandPaths expands the dynamic string tokens in the given DT_RPATH or
+// DT_RUNPATH entries of the given object and returns the resulting
+// directories. Directories relative to $ORIGIN are relative to the path of the
+// object, all others are relative to [ELFLibResolver.Root].
+func (r *ELFLibResolver) expandPaths(obj *elfObject, paths []string) []string {
+	var dirs []string
+	for _, path := range paths {
+		for _, dir := range expandDST(path, obj.info.header) {
+			if dir, isOrigin := cutOrigin(dir); isOrigin {
+				dirs = append(dirs, filepath.Join(filepath.Dir(obj.path), dir))
+				continue
+			}
+			dirs = append(dirs, r.rootPath(dir))
+		}
+	}
+	return dirs
+}
+
+// rootPath returns the given path in [ELFLibResolver.Root].
+func (r *ELFLibResolver) rootPath(path string) string {
+	return filepath.Join(r.Root, path)
+}
+
+// resolveInterpreter looks up the program interpreter of the ELF file with
+// the given path and info. It is looked up at its exact path first. If it does not
+// exist, it is looked up by its base name in the given search directories,
+// as sysroots often lack the compatibility links, like "/lib64". Like
+// libraries, it is looked up for each file, so its compatibility is checked.
+func (r *ELFLibResolver) resolveInterpreter(requester string, info *elfInfo, searchDirs []string) error {
+	interp := info.interp
+	paths := []string{r.rootPath(interp)}
+	for _, dir := range searchDirs {
+		paths = append(paths, filepath.Join(dir, filepath.Base(interp)))
+	}
+	found, skipped, err := r.find(paths, info.header)
+	if err != nil {
+		return err
+	}
+	if found == nil {
+		return r.missing(requester, "interpreter", []string{interp}, skipped)
+	}
+
+	if existing, exists := r.found[interp]; exists && slices.Contains(r.Interpreters, interp) {
+		// The interpreter is added at the path requested, so all files
+		// must use the same one.
+		if existing.path != found.path {
+			return fmt.Errorf("interpreter collision %s: %s and %s", interp, existing.path, found.path)
+		}
+	} else {
+		r.Interpreters = append(r.Interpreters, interp)
+		r.setFound(interp, found)
+	}
+	r.addDependency(Dependency{
+		Requester:   requester,
+		Name:        interp,
+		Path:        found.path,
+		Interpreter: true,
+	})
+	return r.resolve(found.path, found.info, nil)
+}
+
+// addDependency adds the given [Dependency] to
+// [ELFLibResolver.Dependencies], unless it is present already, like for files
+// resolved multiple times.
+func (r *ELFLibResolver) addDependency(dep Dependency) {
+	if !slices.Contains(r.Dependencies, dep) {
+		r.Dependencies = append(r.Dependencies, dep)
+	}
+}
+
+func (r *ELFLibResolver) setFound(path string, found *candidate) {
+	if r.found == nil {
+		r.found = make(map[string]*candidate)
+	}
+	r.found[path] = found
+}
+
+// lookup returns the given path with all symbolic links resolved and the
+// names of its link chain, see [LinkChain], if the file exists. Links of
+// paths inside of [ELFLibResolver.Root] are resolved confined to it.
+func (r *ELFLibResolver) lookup(path string) (string, []string, error) {
+	if r.FS == nil {
+		if _, err := os.Stat(path); err != nil {
+			return "", nil, err
+		}
+		names := []string{filepath.Base(path)}
+		if realPath, err := filepath.EvalSymlinks(path); err == nil &&
+			filepath.Base(realPath) != names[0] {
+			names = append(names, filepath.Base(realPath))
+		}
+		return path, names, nil
+	}
+
+	root, name := "", path
+	if rel, err := filepath.Rel(r.Root, path); r.Root != "" && err == nil &&
+		rel != ".." && !strings.HasPrefix(rel, "../") {
+		root, name = r.Root, rel
+	}
+	realPath, err := EvalSymlinksIn(r.FS, root, name)
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := statFS(r.FS, realPath); err != nil {
+		return "", nil, err
+	}
+	names, err := LinkChain(r.FS, root, name)
+	if err != nil {
+		return "", nil, err
+	}
+	return realPath, names, nil
+}
+
+// RealPath returns the path of the given resolved lib or interpreter with all
+// symbolic links resolved inside of [ELFLibResolver.Root]. This is the path
+// the content of the file should be read from. Paths not found in
+// [ELFLibResolver.Libs], [ELFLibResolver.Interpreters] or
+// [ELFLibResolver.ScriptInterpreters] are returned as is.
+func (r *ELFLibResolver) RealPath(lib string) string {
+	if found, exists := r.found[lib]; exists {
+		return found.realPath
+	}
+	return lib
+}
+
+// LinkNames returns the names of the given resolved lib or interpreter and
+// of the symbolic links it resolves through, with the name of the real file
+// last, like ["libfoo.so.1", "libfoo.so.1.2.3"]. See [LinkChain]. For paths
+// not found in [ELFLibResolver.Libs], [ELFLibResolver.Interpreters] or
+// [ELFLibResolver.ScriptInterpreters] only the base name is returned.
+func (r *ELFLibResolver) LinkNames(lib string) []string {
+	if found, exists := r.found[lib]; exists {
+		return found.names
+	}
+	return []string{filepath.Base(lib)}
+}
+
+// LookupPaths returns the directories libraries are looked up in by default,
+// relative to [ELFLibResolver.Root]. These are the
+// [ELFLibResolver.SearchPaths] followed by the default search paths of the
+// machines of all resolved ELF files.
+func (r *ELFLibResolver) LookupPaths() []string {
+	paths := slices.Clone(r.SearchPaths)
+	for _, path := range r.defaultPaths {
+		if !slices.Contains(paths, path) {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
 // LinkedLibs fetches the list of dynamically linked libraries from the ELF
 // file.
 func LinkedLibs(elfFilePath string) ([]string, error) {
-	elfFile, err := elf.Open(elfFilePath)
+	return LinkedLibsFS(nil, elfFilePath)
+}
+
+// LinkedLibsFS fetches the list of dynamically linked libraries from the ELF
+// file in the given file system. If fsys is nil, the host's file system is
+// used.
+func LinkedLibsFS(fsys fs.FS, elfFilePath string) ([]string, error) {
+	info, err := readELF(fsys, elfFilePath, false)
+	if err != nil {
+		return nil, err
+	}
+	return info.libs, nil
+}
+
+// elfInfo is the information of an ELF file required for resolving its
+// dependencies.
+type elfInfo struct {
+	header       elf.FileHeader
+	libs         []string
+	interp       string
+	rpath        []string
+	runpath      []string
+	noDefaultLib bool
+	dlopen       []DLOpenNote
+	// dlopenErr is the error parsing the dlopen notes. It does not fail
+	// reading the file, as the notes are optional.
+	dlopenErr error
+}
+
+// readELF reads the ELF file with the given path in [ELFLibResolver.FS]. The
+// dlopen notes are read only if [ELFLibResolver.DLOpenPriority] is set.
+func (r *ELFLibResolver) readELF(elfFilePath string) (*elfInfo, error) {
+	return readELF(r.FS, elfFilePath, r.DLOpenPriority != "")
+}
+
+// readELF reads the dynamically linked libraries, the program interpreter,
+// the header and, if withDLOpen is true, the dlopen notes of the ELF file in
+// the given file system.
+func readELF(fsys fs.FS, elfFilePath string, withDLOpen bool) (*elfInfo, error) {
+	elfFile, err := openELF(fsys, elfFilePath)
 	if err != nil {
 		return nil, err
 	}
@@ -70,5 +690,160 @@ func LinkedLibs(elfFilePath string) ([]string, error) {
 		return nil, fmt.Errorf("read libs: %v", err)
 	}
 
-	return libs, nil
+	interp, err := interpreter(elfFile.File)
+	if err != nil {
+		return nil, fmt.Errorf("read interpreter: %v", err)
+	}
+
+	info := elfInfo{header: elfFile.FileHeader, libs: libs, interp: interp}
+
+	if info.rpath, err = dynPaths(elfFile.File, elf.DT_RPATH); err != nil {
+		return nil, fmt.Errorf("read rpath: %v", err)
+	}
+	if info.runpath, err = dynPaths(elfFile.File, elf.DT_RUNPATH); err != nil {
+		return nil, fmt.Errorf("read runpath: %v", err)
+	}
+
+	flags, err := dynValue(elfFile.File, elf.DT_FLAGS_1)
+	if err != nil {
+		return nil, fmt.Errorf("read flags: %v", err)
+	}
+	info.noDefaultLib = flags&uint64(elf.DF_1_NODEFLIB) != 0
+
+	if withDLOpen {
+		info.dlopen, info.dlopenErr = dlopenNotes(elfFile.File)
+	}
+
+	return &info, nil
+}
+
+// dynPaths returns the colon separated paths of the given string tag of the
+// dynamic section. Empty paths are omitted.
+func dynPaths(f *elf.File, tag elf.DynTag) ([]string, error) {
+	values, err := f.DynString(tag)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, value := range values {
+		for _, path := range strings.Split(value, ":") {
+			if path != "" {
+				paths = append(paths, path)
+			}
+		}
+	}
+	return paths, nil
+}
+
+// dynValue returns the value of the given integer tag of the dynamic section.
+// If the tag is present multiple times, the values are or'ed. It returns 0 for
+// files without dynamic section or the tag.
+func dynValue(f *elf.File, tag elf.DynTag) (uint64, error) {
+	section := f.Section(".dynamic")
+	if section == nil {
+		return 0, nil
+	}
+	data, err := section.Data()
+	if err != nil {
+		return 0, err
+	}
+
+	entrySize := 16
+	if f.Class == elf.ELFCLASS32 {
+		entrySize = 8
+	}
+
+	var value uint64
+	for len(data) >= entrySize {
+		var t, v uint64
+		if f.Class == elf.ELFCLASS32 {
+			t = uint64(f.ByteOrder.Uint32(data[0:4]))
+			v = uint64(f.ByteOrder.Uint32(data[4:8]))
+		} else {
+			t = f.ByteOrder.Uint64(data[0:8])
+			v = f.ByteOrder.Uint64(data[8:16])
+		}
+		data = data[entrySize:]
+		if elf.DynTag(t) == elf.DT_NULL {
+			break
+		}
+		if elf.DynTag(t) == tag {
+			value |= v
+		}
+	}
+	return value, nil
+}
+
+// Interpreter returns the program interpreter requested by the ELF file with
+// the given path, like "/lib64/ld-linux-x86-64.so.2". It returns an empty
+// string for files without interpreter, like static executables and
+// libraries. If fsys is nil, the host's file system is used.
+func Interpreter(fsys fs.FS, elfFilePath string) (string, error) {
+	info, err := readELF(fsys, elfFilePath, false)
+	if err != nil {
+		return "", err
+	}
+	return info.interp, nil
+}
+
+// interpreter returns the content of the PT_INTERP program header.
+func interpreter(f *elf.File) (string, error) {
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		data, err := io.ReadAll(prog.Open())
+		if err != nil {
+			return "", err
+		}
+		return string(bytes.TrimRight(data, "\x00")), nil
+	}
+	return "", nil
+}
+
+// elfFile wraps an [elf.File] read from an [fs.FS] so closing it closes the
+// underlying file as well.
+type elfFile struct {
+	*elf.File
+	closer io.Closer
+}
+
+// Close closes the [elf.File] and the underlying file.
+func (f *elfFile) Close() error {
+	_ = f.File.Close()
+	return f.closer.Close()
+}
+
+// openELF opens the ELF file at the given path in the given file system. If
+// fsys is nil, the host's file system is used. If the file system's files do
+// not implement [io.ReaderAt], the file is read into memory completely.
+func openELF(fsys fs.FS, path string) (*elfFile, error) {
+	var file fs.File
+	var err error
+	if fsys == nil {
+		file, err = os.Open(path)
+	} else {
+		file, err = fsys.Open(fsPath(path))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	readerAt, ok := file.(io.ReaderAt)
+	if !ok {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		readerAt = bytes.NewReader(data)
+	}
+
+	f, err := elf.NewFile(readerAt)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &elfFile{File: f, closer: file}, nil
 }
@@ -1,11 +1,18 @@
 package files_test
 
 import (
+	"bytes"
+	"debug/elf"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/aibor/initramfs/internal/files"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slices"
 )
 
 func TestLinkedLibs(t *testing.T) {
@@ -19,6 +26,98 @@ func TestLinkedLibs(t *testing.T) {
 	assert.Equal(t, expected, libs)
 }
 
+func TestLinkedLibsFS(t *testing.T) {
+	testFS := os.DirFS("testdata")
+	expected := []string{
+		"libfunc2.so",
+		"libfunc3.so",
+	}
+
+	t.Run("reader at", func(t *testing.T) {
+		libs, err := files.LinkedLibsFS(testFS, "/bin/main")
+		require.NoError(t, err)
+		assert.Equal(t, expected, libs)
+	})
+
+	t.Run("read completely", func(t *testing.T) {
+		// Files of this file system do not implement io.ReaderAt.
+		wrappedFS := readerOnlyFS{testFS}
+		libs, err := files.LinkedLibsFS(wrappedFS, "bin/main")
+		require.NoError(t, err)
+		assert.Equal(t, expected, libs)
+	})
+
+	t.Run("not existing", func(t *testing.T) {
+		_, err := files.LinkedLibsFS(testFS, "/bin/nonexisting")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("not ELF", func(t *testing.T) {
+		_, err := files.LinkedLibsFS(testFS, "/src/main.c")
+		assert.ErrorContains(t, err, "bad magic number")
+	})
+}
+
+type readerOnlyFS struct {
+	fsys fs.FS
+}
+
+func (f readerOnlyFS) Open(name string) (fs.File, error) {
+	file, err := f.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return readerOnlyFile{file}, nil
+}
+
+type readerOnlyFile struct {
+	fs.File
+}
+
+func TestELFLibResolverResolveFS(t *testing.T) {
+	r := files.ELFLibResolver{
+		FS:          os.DirFS("testdata"),
+		SearchPaths: []string{"/nonexisting", "/lib"},
+	}
+	require.NoError(t, r.Resolve("/bin/main"))
+
+	expected := []string{
+		"/lib/libfunc2.so",
+		"/lib/libfunc3.so",
+		"/lib/libfunc1.so",
+	}
+	assert.Equal(t, expected, r.Libs)
+	assert.Equal(t, []string{"/lib64/ld-linux-x86-64.so.2"}, r.Interpreters)
+	assert.Equal(t, "/lib/ld-linux-x86-64.so.2", r.RealPath("/lib64/ld-linux-x86-64.so.2"))
+}
+
+func TestInterpreter(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		expected string
+	}{
+		{
+			name:     "executable",
+			file:     "testdata/bin/main",
+			expected: "/lib64/ld-linux-x86-64.so.2",
+		},
+		{
+			name: "library",
+			file: "testdata/lib/libfunc3.so",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			interp, err := files.Interpreter(nil, tt.file)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, interp)
+		})
+	}
+}
+
 func TestELFLibResolverResolve(t *testing.T) {
 	defaultSearchPaths := []string{"testdata/lib"}
 
@@ -66,6 +165,18 @@ func TestELFLibResolverResolve(t *testing.T) {
 				"testdata/lib/libfunc1.so",
 			},
 		},
+		{
+			name: "rpath relative to origin",
+			files: []string{
+				"testdata/bin/main_rpath",
+			},
+			expectedLibs: []string{
+				"testdata/lib/libfunc2.so",
+				"testdata/lib/libfunc3.so",
+				// DT_RPATH of main_rpath is used for libs loaded by its libs.
+				"testdata/lib/libfunc1.so",
+			},
+		},
 		{
 			name: "fails if lib not found",
 			files: []string{
@@ -95,3 +206,469 @@ func TestELFLibResolverResolve(t *testing.T) {
 		})
 	}
 }
+
+// sysroot creates a sysroot in the given directory with the test libraries
+// and interpreter installed into "/opt/libs" and linked with absolute symbolic
+// links from the default x86_64 multiarch directory.
+func sysroot(t *testing.T, dir string) {
+	t.Helper()
+
+	libDir := filepath.Join(dir, "lib", "x86_64-linux-gnu")
+	optDir := filepath.Join(dir, "opt", "libs")
+	require.NoError(t, os.MkdirAll(libDir, 0755))
+	require.NoError(t, os.MkdirAll(optDir, 0755))
+	for _, lib := range []string{"libfunc1.so", "libfunc2.so", "libfunc3.so", "ld-linux-x86-64.so.2"} {
+		data, err := os.ReadFile(filepath.Join("testdata", "lib", lib))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(optDir, lib), data, 0755))
+		require.NoError(t, os.Symlink("/opt/libs/"+lib, filepath.Join(libDir, lib)))
+	}
+}
+
+func TestELFLibResolverResolveRoot(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "sysroot")
+	sysroot(t, root)
+	elfFile, err := filepath.Abs("testdata/bin/main")
+	require.NoError(t, err)
+
+	r := files.ELFLibResolver{
+		FS:   files.DirFS("/"),
+		Root: root,
+	}
+	// The ELF file itself is not part of the sysroot.
+	require.NoError(t, r.Resolve(elfFile))
+
+	expected := []string{
+		root + "/lib/x86_64-linux-gnu/libfunc2.so",
+		root + "/lib/x86_64-linux-gnu/libfunc3.so",
+		root + "/lib/x86_64-linux-gnu/libfunc1.so",
+	}
+	assert.Equal(t, expected, r.Libs)
+
+	for _, lib := range r.Libs {
+		assert.Equal(t, root+"/opt/libs/"+filepath.Base(lib), r.RealPath(lib))
+	}
+
+	// The sysroot lacks "/lib64", so the interpreter is found by its name.
+	interp := "/lib64/ld-linux-x86-64.so.2"
+	assert.Equal(t, []string{interp}, r.Interpreters)
+	assert.Equal(t, root+"/opt/libs/ld-linux-x86-64.so.2", r.RealPath(interp))
+
+	expectedLookupPaths := []string{
+		"/lib/x86_64-linux-gnu",
+		"/usr/lib/x86_64-linux-gnu",
+		"/lib64",
+		"/usr/lib64",
+		"/lib",
+		"/usr/lib",
+	}
+	assert.Equal(t, expectedLookupPaths, r.LookupPaths())
+}
+
+func TestELFLibResolverResolveRunpath(t *testing.T) {
+	elfFile, err := filepath.Abs("testdata/bin/main_runpath")
+	require.NoError(t, err)
+
+	// install copies the given test libs into the given directories of the
+	// sysroot.
+	install := func(t *testing.T, root string, libs []string, dirs ...string) {
+		t.Helper()
+		for _, dir := range dirs {
+			require.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0755))
+			for _, lib := range libs {
+				data, err := os.ReadFile(filepath.Join("testdata/lib", lib))
+				require.NoError(t, err)
+				require.NoError(t, os.WriteFile(filepath.Join(root, dir, lib), data, 0755))
+			}
+		}
+	}
+	allLibs := []string{"libfunc1.so", "libfunc2.so", "libfunc3.so"}
+
+	tests := []struct {
+		name         string
+		install      map[string][]string
+		searchPaths  []string
+		expectedLibs []string
+		errMsg       string
+	}{
+		{
+			name: "runpath is not used for libs of libs",
+			install: map[string][]string{
+				"/opt/func/lib": allLibs,
+			},
+			errMsg: "lib could not be resolved: libfunc1.so",
+		},
+		{
+			name: "default paths after runpath",
+			install: map[string][]string{
+				"/opt/func/lib": {"libfunc2.so", "libfunc3.so"},
+				"/usr/lib":      allLibs,
+			},
+			expectedLibs: []string{
+				"/opt/func/lib/libfunc2.so",
+				"/opt/func/lib/libfunc3.so",
+				"/usr/lib/libfunc1.so",
+			},
+		},
+		{
+			name: "search paths before runpath",
+			install: map[string][]string{
+				"/opt/func/lib": allLibs,
+				"/custom":       allLibs,
+			},
+			searchPaths: []string{"/custom"},
+			expectedLibs: []string{
+				"/custom/libfunc2.so",
+				"/custom/libfunc3.so",
+				"/custom/libfunc1.so",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			install(t, root, []string{"ld-linux-x86-64.so.2"}, "/lib64")
+			for dir, libs := range tt.install {
+				install(t, root, libs, dir)
+			}
+
+			r := files.ELFLibResolver{
+				FS:          files.DirFS("/"),
+				Root:        root,
+				SearchPaths: tt.searchPaths,
+			}
+			err := r.Resolve(elfFile)
+			if tt.errMsg != "" {
+				assert.ErrorContains(t, err, tt.errMsg)
+				return
+			}
+			require.NoError(t, err)
+
+			var expected []string
+			for _, lib := range tt.expectedLibs {
+				expected = append(expected, filepath.Join(root, lib))
+			}
+			assert.Equal(t, expected, r.Libs)
+		})
+	}
+}
+
+func TestELFLibResolverResolveRpathOrder(t *testing.T) {
+	// DT_RPATH takes precedence over the search paths.
+	r := files.ELFLibResolver{
+		SearchPaths: []string{"/nonexisting"},
+	}
+	require.NoError(t, r.Resolve("testdata/bin/main_rpath"))
+	assert.Equal(t, "testdata/lib/libfunc2.so", r.Libs[0])
+	assert.Equal(t, []string{"/nonexisting"}, r.LookupPaths()[:1])
+}
+
+func TestELFLibResolverResolveCompatibility(t *testing.T) {
+	lib, err := os.ReadFile("testdata/lib/libfunc2.so")
+	require.NoError(t, err)
+
+	// patched returns a copy of libfunc2.so with the given header bytes set.
+	patched := func(offset int, values ...byte) []byte {
+		data := slices.Clone(lib)
+		copy(data[offset:], values)
+		return data
+	}
+
+	tests := []struct {
+		name     string
+		first    []byte
+		expected string
+		errMsg   string
+	}{
+		{
+			name:     "compatible",
+			first:    lib,
+			expected: "/first/libfunc2.so",
+		},
+		{
+			name:     "linux OS ABI",
+			first:    patched(7, byte(elf.ELFOSABI_LINUX)),
+			expected: "/first/libfunc2.so",
+		},
+		{
+			name:     "other machine",
+			first:    patched(18, byte(elf.EM_AARCH64), 0),
+			expected: "/second/libfunc2.so",
+		},
+		{
+			name:     "other OS ABI",
+			first:    patched(7, byte(elf.ELFOSABI_FREEBSD)),
+			expected: "/second/libfunc2.so",
+		},
+		{
+			name:     "other class",
+			first:    patched(4, byte(elf.ELFCLASS32)),
+			expected: "/second/libfunc2.so",
+		},
+		{
+			name:     "not ELF",
+			first:    []byte("INPUT(libfunc2.so.1)"),
+			expected: "/second/libfunc2.so",
+		},
+	}
+
+	setup := func(t *testing.T, first []byte, withSecond bool) string {
+		t.Helper()
+		root := t.TempDir()
+		for _, dir := range []string{"first", "second", "lib64"} {
+			require.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0755))
+		}
+		require.NoError(t, os.WriteFile(filepath.Join(root, "first", "libfunc2.so"), first, 0755))
+		libs := []string{"libfunc1.so", "libfunc3.so"}
+		if withSecond {
+			libs = append(libs, "libfunc2.so")
+		}
+		for _, lib := range libs {
+			data, err := os.ReadFile(filepath.Join("testdata/lib", lib))
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(filepath.Join(root, "second", lib), data, 0755))
+		}
+		interp, err := os.ReadFile("testdata/lib/ld-linux-x86-64.so.2")
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(root, "lib64", "ld-linux-x86-64.so.2"), interp, 0755))
+		return root
+	}
+
+	elfFile, err := filepath.Abs("testdata/bin/main")
+	require.NoError(t, err)
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			root := setup(t, tt.first, true)
+			r := files.ELFLibResolver{
+				FS:          files.DirFS("/"),
+				Root:        root,
+				SearchPaths: []string{"/first", "/second"},
+			}
+			require.NoError(t, r.Resolve(elfFile))
+			assert.Equal(t, filepath.Join(root, tt.expected), r.Libs[0])
+		})
+	}
+
+	t.Run("no compatible lib", func(t *testing.T) {
+		root := setup(t, patched(18, byte(elf.EM_AARCH64), 0), false)
+		r := files.ELFLibResolver{
+			FS:          files.DirFS("/"),
+			Root:        root,
+			SearchPaths: []string{"/first", "/second"},
+		}
+		err := r.Resolve(elfFile)
+		assert.ErrorContains(t, err, "lib could not be resolved: libfunc2.so: no compatible file found, skipped ")
+		assert.ErrorContains(t, err, "first/libfunc2.so: machine EM_AARCH64, want EM_X86_64")
+	})
+}
+
+func TestELFLibResolverResolveMixedMachines(t *testing.T) {
+	// aarch64 returns a copy of the given test file patched to be an aarch64
+	// ELF file requesting an aarch64 interpreter.
+	aarch64 := func(t *testing.T, name string) []byte {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join("testdata", name))
+		require.NoError(t, err)
+		data = bytes.ReplaceAll(data, []byte("ld-linux-x86-64.so.2"), []byte("ld-linux-arm-64.so.2"))
+		copy(data[18:], []byte{byte(elf.EM_AARCH64), 0})
+		return data
+	}
+
+	root := t.TempDir()
+	testFiles := map[string][]byte{
+		"bin/main_arm":               aarch64(t, "bin/main"),
+		"lib64/ld-linux-arm-64.so.2": aarch64(t, "lib/ld-linux-x86-64.so.2"),
+	}
+	for _, lib := range []string{"libfunc1.so", "libfunc2.so", "libfunc3.so", "ld-linux-x86-64.so.2"} {
+		data, err := os.ReadFile(filepath.Join("testdata/lib", lib))
+		require.NoError(t, err)
+		testFiles["x86/"+lib] = data
+		testFiles["arm/"+lib] = aarch64(t, "lib/"+lib)
+	}
+	testFiles["lib64/ld-linux-x86-64.so.2"] = testFiles["x86/ld-linux-x86-64.so.2"]
+	for name, data := range testFiles {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, filepath.Dir(name)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(root, name), data, 0755))
+	}
+	x86File, err := filepath.Abs("testdata/bin/main")
+	require.NoError(t, err)
+	armFile := filepath.Join(root, "bin/main_arm")
+
+	newResolver := func() *files.ELFLibResolver {
+		return &files.ELFLibResolver{
+			FS:          files.DirFS("/"),
+			Root:        root,
+			SearchPaths: []string{"/x86", "/arm"},
+		}
+	}
+	libs := func(dir string) []string {
+		return []string{
+			filepath.Join(root, dir, "libfunc2.so"),
+			filepath.Join(root, dir, "libfunc3.so"),
+			filepath.Join(root, dir, "libfunc1.so"),
+		}
+	}
+
+	t.Run("alone", func(t *testing.T) {
+		r := newResolver()
+		require.NoError(t, r.Resolve(armFile))
+		assert.Equal(t, libs("arm"), r.Libs)
+		assert.Equal(t, []string{"/lib64/ld-linux-arm-64.so.2"}, r.Interpreters)
+	})
+
+	for _, order := range [][]string{{x86File, armFile}, {armFile, x86File}} {
+		order := order
+		t.Run("after "+filepath.Base(order[0]), func(t *testing.T) {
+			r := newResolver()
+			for _, file := range order {
+				require.NoError(t, r.Resolve(file))
+			}
+			assert.ElementsMatch(t, append(libs("x86"), libs("arm")...), r.Libs)
+			assert.ElementsMatch(t, []string{
+				"/lib64/ld-linux-x86-64.so.2",
+				"/lib64/ld-linux-arm-64.so.2",
+			}, r.Interpreters)
+
+			for _, dep := range r.Dependencies {
+				dir := "x86"
+				if dep.Requester == armFile || strings.HasPrefix(dep.Requester, filepath.Join(root, "arm")) {
+					dir = "arm"
+				}
+				if !dep.Interpreter {
+					assert.Equal(t, filepath.Join(root, dir, dep.Name), dep.Path, dep.Requester)
+				}
+			}
+		})
+	}
+
+	t.Run("interpreter collision", func(t *testing.T) {
+		require.NoError(t, os.Remove(filepath.Join(root, "lib64/ld-linux-arm-64.so.2")))
+		require.NoError(t, os.WriteFile(filepath.Join(root, "arm/ld-linux-x86-64.so.2"),
+			aarch64(t, "lib/ld-linux-x86-64.so.2"), 0755))
+		data := bytes.ReplaceAll(aarch64(t, "bin/main"),
+			[]byte("ld-linux-arm-64.so.2"), []byte("ld-linux-x86-64.so.2"))
+		require.NoError(t, os.WriteFile(armFile, data, 0755))
+
+		r := newResolver()
+		require.NoError(t, r.Resolve(x86File))
+		err := r.Resolve(armFile)
+		assert.ErrorContains(t, err, "interpreter collision /lib64/ld-linux-x86-64.so.2")
+	})
+}
+
+func TestELFLibResolverResolvePerProcess(t *testing.T) {
+	root := t.TempDir()
+	install := map[string][]string{
+		"/lib64":        {"ld-linux-x86-64.so.2"},
+		"/opt/func/lib": {"libfunc1.so", "libfunc2.so", "libfunc3.so"},
+		"/usr/lib":      {"libfunc1.so", "libfunc2.so", "libfunc3.so"},
+	}
+	for dir, libs := range install {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0755))
+		for _, lib := range libs {
+			data, err := os.ReadFile(filepath.Join("testdata/lib", lib))
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(filepath.Join(root, dir, lib), data, 0755))
+		}
+	}
+
+	r := files.ELFLibResolver{
+		FS:   files.DirFS("/"),
+		Root: root,
+	}
+	// The libraries found in the DT_RUNPATH of main_runpath are not reused
+	// for main, which has none.
+	for _, elfFile := range []string{"testdata/bin/main_runpath", "testdata/bin/main"} {
+		elfFile, err := filepath.Abs(elfFile)
+		require.NoError(t, err)
+		require.NoError(t, r.Resolve(elfFile))
+	}
+
+	expected := []string{
+		root + "/opt/func/lib/libfunc2.so",
+		root + "/opt/func/lib/libfunc3.so",
+		root + "/usr/lib/libfunc1.so",
+		root + "/usr/lib/libfunc2.so",
+		root + "/usr/lib/libfunc3.so",
+	}
+	assert.Equal(t, expected, r.Libs)
+}
+
+func TestELFLibResolverResolveKeepGoing(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "sysroot")
+	sysroot(t, root)
+	for _, lib := range []string{"libfunc1.so", "ld-linux-x86-64.so.2"} {
+		require.NoError(t, os.Remove(filepath.Join(root, "lib", "x86_64-linux-gnu", lib)))
+	}
+	elfFile, err := filepath.Abs("testdata/bin/main")
+	require.NoError(t, err)
+	libDir := filepath.Join(root, "lib", "x86_64-linux-gnu")
+
+	tests := []struct {
+		name       string
+		keepGoing  bool
+		allow      []string
+		unresolved []string
+		errMsg     string
+	}{
+		{
+			name:   "abort",
+			errMsg: "interpreter could not be resolved: /lib64/ld-linux-x86-64.so.2",
+		},
+		{
+			name:       "keep going",
+			keepGoing:  true,
+			unresolved: []string{"/lib64/ld-linux-x86-64.so.2", "libfunc1.so"},
+		},
+		{
+			name:       "allow missing",
+			keepGoing:  true,
+			allow:      []string{"ld-linux-*"},
+			unresolved: []string{"libfunc1.so"},
+		},
+		{
+			name:  "allow all missing",
+			allow: []string{"ld-linux-x86-64.so.2", "libfunc1.so"},
+		},
+		{
+			name:   "invalid pattern",
+			allow:  []string{"["},
+			errMsg: "allow missing pattern [: syntax error in pattern",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			r := files.ELFLibResolver{
+				FS:           files.DirFS("/"),
+				Root:         root,
+				KeepGoing:    tt.keepGoing,
+				AllowMissing: tt.allow,
+			}
+			err := r.Resolve(elfFile)
+			if tt.errMsg != "" {
+				assert.ErrorContains(t, err, tt.errMsg)
+				return
+			}
+			require.NoError(t, err)
+
+			expectedLibs := []string{
+				filepath.Join(libDir, "libfunc2.so"),
+				filepath.Join(libDir, "libfunc3.so"),
+			}
+			assert.Equal(t, expectedLibs, r.Libs)
+
+			var unresolved []string
+			for _, u := range r.Unresolved {
+				unresolved = append(unresolved, u.Name)
+				assert.ErrorContains(t, u.Err, "could not be resolved: "+u.Name)
+			}
+			assert.Equal(t, tt.unresolved, unresolved)
+		})
+	}
+}
@@ -1,20 +1,52 @@
 package files
 
 import (
+	"io/fs"
 	"path/filepath"
+	"sort"
 )
 
+// Owner is the numeric user and group ID of an [Entry].
+type Owner struct {
+	UID int
+	GID int
+}
+
 // Entry is a single file tree entry.
 type Entry struct {
 	// Type of this entry.
 	Type Type
 	// Related path depending on the file type. Empty for directories,
-	// target path for links, source files for regular files.
+	// target path for links, source files for regular files, the absolute
+	// path of the target entry in the tree for hard links.
 	RelatedPath string
+	// Content of regular files that have no source file. If set, it is used
+	// instead of RelatedPath.
+	Content Content
+	// SourceFS is the file system the source file of regular files is read
+	// from. If nil, the default of the consumer is used. It must be
+	// comparable, as entries are compared by source.
+	SourceFS fs.FS
+	// Mode holds the permission bits and the setuid, setgid and sticky bits.
+	// If nil, the default for the type is used by the consumer. Mode 0 is a
+	// valid explicit mode.
+	Mode *fs.FileMode
+	// Owner of the entry. If nil, the default for the type is used by the
+	// consumer.
+	Owner *Owner
+	// Major device number for device entries.
+	Major uint32
+	// Minor device number for device entries.
+	Minor uint32
 
 	children map[string]*Entry
 }
 
+// SetMode sets the explicit mode of the [Entry].
+func (e *Entry) SetMode(mode fs.FileMode) {
+	e.Mode = &mode
+}
+
 // IsDir returns true if the [Entry] is a directory.
 func (e *Entry) IsDir() bool {
 	return e.Type == TypeDirectory
@@ -30,6 +62,11 @@ func (e *Entry) IsRegular() bool {
 	return e.Type == TypeRegular
 }
 
+// IsDevice returns true if the [Entry] is a character or block device.
+func (e *Entry) IsDevice() bool {
+	return e.Type == TypeCharDevice || e.Type == TypeBlockDevice
+}
+
 // AddFile adds a new regular file [Entry] children.
 func (e *Entry) AddFile(name, relatedPath string) (*Entry, error) {
 	entry := &Entry{
@@ -39,6 +76,16 @@ func (e *Entry) AddFile(name, relatedPath string) (*Entry, error) {
 	return e.AddEntry(name, entry)
 }
 
+// AddContent adds a new regular file [Entry] children with the given
+// [Content] instead of a source file.
+func (e *Entry) AddContent(name string, content Content) (*Entry, error) {
+	entry := &Entry{
+		Type:    TypeRegular,
+		Content: content,
+	}
+	return e.AddEntry(name, entry)
+}
+
 // AddDirectory adds a new directory [Entry] children.
 func (e *Entry) AddDirectory(name string) (*Entry, error) {
 	entry := &Entry{
@@ -56,6 +103,52 @@ func (e *Entry) AddLink(name, relatedPath string) (*Entry, error) {
 	return e.AddEntry(name, entry)
 }
 
+// AddCharDevice adds a new character device [Entry] children.
+func (e *Entry) AddCharDevice(name string, major, minor uint32) (*Entry, error) {
+	entry := &Entry{
+		Type:  TypeCharDevice,
+		Major: major,
+		Minor: minor,
+	}
+	return e.AddEntry(name, entry)
+}
+
+// AddBlockDevice adds a new block device [Entry] children.
+func (e *Entry) AddBlockDevice(name string, major, minor uint32) (*Entry, error) {
+	entry := &Entry{
+		Type:  TypeBlockDevice,
+		Major: major,
+		Minor: minor,
+	}
+	return e.AddEntry(name, entry)
+}
+
+// AddHardLink adds a new hard link [Entry] children. The target must be the
+// absolute path of a regular file [Entry] in the same tree.
+func (e *Entry) AddHardLink(name, target string) (*Entry, error) {
+	entry := &Entry{
+		Type:        TypeHardLink,
+		RelatedPath: target,
+	}
+	return e.AddEntry(name, entry)
+}
+
+// AddFIFO adds a new named pipe [Entry] children.
+func (e *Entry) AddFIFO(name string) (*Entry, error) {
+	entry := &Entry{
+		Type: TypeFIFO,
+	}
+	return e.AddEntry(name, entry)
+}
+
+// AddSocket adds a new socket [Entry] children.
+func (e *Entry) AddSocket(name string) (*Entry, error) {
+	entry := &Entry{
+		Type: TypeSocket,
+	}
+	return e.AddEntry(name, entry)
+}
+
 // AddEntry adds an arbitrary [Entry] as children. The caller is responsible
 // for using only valid [Type]s and according fields.
 func (e *Entry) AddEntry(name string, entry *Entry) (*Entry, error) {
@@ -72,6 +165,19 @@ func (e *Entry) AddEntry(name string, entry *Entry) (*Entry, error) {
 	return entry, nil
 }
 
+// RemoveEntry removes the child [Entry] with the given name including all its
+// children. Return ErrEntryNotExists if it doesn't exist.
+func (e *Entry) RemoveEntry(name string) error {
+	if !e.IsDir() {
+		return ErrEntryNotDir
+	}
+	if _, exists := e.children[name]; !exists {
+		return ErrEntryNotExists
+	}
+	delete(e.children, name)
+	return nil
+}
+
 // GetEntry getsan [Entry] for the given name. Return ErrEntryNotExists if it
 // doesn't exist.
 func (e *Entry) GetEntry(name string) (*Entry, error) {
@@ -85,8 +191,19 @@ func (e *Entry) GetEntry(name string) (*Entry, error) {
 	return entry, nil
 }
 
+// childNames returns the names of all children sorted lexically.
+func (e *Entry) childNames() []string {
+	names := make([]string, 0, len(e.children))
+	for name := range e.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (e *Entry) walk(base string, fn WalkFunc) error {
-	for name, entry := range e.children {
+	for _, name := range e.childNames() {
+		entry := e.children[name]
 		path := filepath.Join(base, name)
 		if err := fn(path, entry); err != nil {
 			return err
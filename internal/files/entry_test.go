@@ -10,6 +10,8 @@ import (
 var fileEntry = Entry{Type: TypeRegular}
 var dirEntry = Entry{Type: TypeDirectory}
 var linkEntry = Entry{Type: TypeLink}
+var charDevEntry = Entry{Type: TypeCharDevice}
+var blockDevEntry = Entry{Type: TypeBlockDevice}
 
 func TestIsRegular(t *testing.T) {
 	assert.True(t, fileEntry.IsRegular())
@@ -29,6 +31,14 @@ func TestIsLink(t *testing.T) {
 	assert.True(t, linkEntry.IsLink())
 }
 
+func TestIsDevice(t *testing.T) {
+	assert.False(t, fileEntry.IsDevice())
+	assert.False(t, dirEntry.IsDevice())
+	assert.False(t, linkEntry.IsDevice())
+	assert.True(t, charDevEntry.IsDevice())
+	assert.True(t, blockDevEntry.IsDevice())
+}
+
 func TestAddFile(t *testing.T) {
 	p := dirEntry
 	e, err := p.AddFile("file", "source")
@@ -38,6 +48,16 @@ func TestAddFile(t *testing.T) {
 	assert.Empty(t, e.children)
 }
 
+func TestAddContent(t *testing.T) {
+	p := dirEntry
+	e, err := p.AddContent("file", StringContent("content"))
+	require.NoError(t, err)
+	assert.Equal(t, TypeRegular, e.Type)
+	assert.Equal(t, "", e.RelatedPath)
+	assert.NotNil(t, e.Content)
+	assert.Empty(t, e.children)
+}
+
 func TestAddDirectory(t *testing.T) {
 	p := dirEntry
 	e, err := p.AddDirectory("dir")
@@ -56,6 +76,51 @@ func TestAddLink(t *testing.T) {
 	assert.Empty(t, e.children)
 }
 
+func TestAddCharDevice(t *testing.T) {
+	p := dirEntry
+	e, err := p.AddCharDevice("console", 5, 1)
+	require.NoError(t, err)
+	assert.Equal(t, TypeCharDevice, e.Type)
+	assert.Equal(t, uint32(5), e.Major)
+	assert.Equal(t, uint32(1), e.Minor)
+	assert.Empty(t, e.children)
+}
+
+func TestAddBlockDevice(t *testing.T) {
+	p := dirEntry
+	e, err := p.AddBlockDevice("sda", 8, 0)
+	require.NoError(t, err)
+	assert.Equal(t, TypeBlockDevice, e.Type)
+	assert.Equal(t, uint32(8), e.Major)
+	assert.Equal(t, uint32(0), e.Minor)
+	assert.Empty(t, e.children)
+}
+
+func TestAddHardLink(t *testing.T) {
+	p := dirEntry
+	e, err := p.AddHardLink("link", "/target")
+	require.NoError(t, err)
+	assert.Equal(t, TypeHardLink, e.Type)
+	assert.Equal(t, "/target", e.RelatedPath)
+	assert.Empty(t, e.children)
+}
+
+func TestAddFIFO(t *testing.T) {
+	p := dirEntry
+	e, err := p.AddFIFO("fifo")
+	require.NoError(t, err)
+	assert.Equal(t, TypeFIFO, e.Type)
+	assert.Empty(t, e.children)
+}
+
+func TestAddSocket(t *testing.T) {
+	p := dirEntry
+	e, err := p.AddSocket("socket")
+	require.NoError(t, err)
+	assert.Equal(t, TypeSocket, e.Type)
+	assert.Empty(t, e.children)
+}
+
 func TestAddEntry(t *testing.T) {
 	t.Run("new", func(t *testing.T) {
 		p := dirEntry
@@ -112,3 +177,26 @@ func TestGetEntry(t *testing.T) {
 		require.ErrorIs(t, err, ErrEntryNotDir)
 	})
 }
+
+func TestRemoveEntry(t *testing.T) {
+	t.Run("exists", func(t *testing.T) {
+		p := dirEntry
+		_, err := p.AddEntry("file", &Entry{Type: TypeRegular})
+		require.NoError(t, err)
+		require.NoError(t, p.RemoveEntry("file"))
+		_, err = p.GetEntry("file")
+		assert.ErrorIs(t, err, ErrEntryNotExists)
+	})
+
+	t.Run("does not exist", func(t *testing.T) {
+		p := dirEntry
+		err := p.RemoveEntry("404")
+		assert.ErrorIs(t, err, ErrEntryNotExists)
+	})
+
+	t.Run("not dir", func(t *testing.T) {
+		p := fileEntry
+		err := p.RemoveEntry("file")
+		require.ErrorIs(t, err, ErrEntryNotDir)
+	})
+}
@@ -0,0 +1,228 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxLinks is the maximum number of symbolic links followed when resolving a
+// single path, like the kernel's MAXSYMLINKS.
+const maxLinks = 40
+
+// ReadLinkFS is an [fs.FS] that supports symbolic links. The method set
+// matches the ReadLinkFS interface of the io/fs package of newer Go versions.
+type ReadLinkFS interface {
+	fs.FS
+	// ReadLink returns the target of the symbolic link with the given name.
+	ReadLink(name string) (string, error)
+	// Lstat returns the [fs.FileInfo] of the given file without following
+	// symbolic links.
+	Lstat(name string) (fs.FileInfo, error)
+}
+
+// dirFS is a [ReadLinkFS] for a directory of the host's file system.
+type dirFS struct {
+	fs.FS
+	dir string
+}
+
+// DirFS returns a [ReadLinkFS] for the given directory of the host's file
+// system.
+func DirFS(dir string) ReadLinkFS {
+	return dirFS{FS: os.DirFS(dir), dir: dir}
+}
+
+func (f dirFS) join(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(f.dir, filepath.FromSlash(name)), nil
+}
+
+// ReadLink returns the target of the symbolic link with the given name.
+func (f dirFS) ReadLink(name string) (string, error) {
+	path, err := f.join("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(path)
+}
+
+// Lstat returns the [fs.FileInfo] of the given file without following
+// symbolic links.
+func (f dirFS) Lstat(name string) (fs.FileInfo, error) {
+	path, err := f.join("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(path)
+}
+
+// ReadLink returns the target of the symbolic link with the given name in the
+// given file system. It fails if the file system does not implement
+// [ReadLinkFS].
+func ReadLink(fsys fs.FS, name string) (string, error) {
+	linkFS, ok := fsys.(ReadLinkFS)
+	if !ok {
+		return "", fmt.Errorf("readlink %s: not supported by file system", name)
+	}
+	return linkFS.ReadLink(name)
+}
+
+// EvalSymlinks returns the given path with all symbolic links resolved in the
+// given file system. See [EvalSymlinksIn].
+func EvalSymlinks(fsys fs.FS, name string) (string, error) {
+	return EvalSymlinksIn(fsys, "", name)
+}
+
+// EvalSymlinksIn returns the given path with all symbolic links resolved in
+// the given file system, confined to the given root directory of it, like in
+// a chroot: the path and absolute link targets are relative to the root and
+// ".." never leaves the root. The returned path includes the root.
+//
+// If the file system does not implement [ReadLinkFS], links can not be
+// detected and the joined path is returned as is. The returned path is
+// absolute, if the root or the path is absolute.
+func EvalSymlinksIn(fsys fs.FS, root, name string) (string, error) {
+	prefix := ""
+	if filepath.IsAbs(root) || (root == "" && filepath.IsAbs(name)) {
+		prefix = "/"
+	}
+	fsRoot := strings.Trim(path.Clean(filepath.ToSlash("/"+root)), "/")
+
+	linkFS, ok := fsys.(ReadLinkFS)
+	if !ok {
+		return prefix + path.Join(fsRoot, fsPath(name)), nil
+	}
+
+	resolved, err := evalSymlinks(linkFS, fsRoot, name)
+	if err != nil {
+		return "", err
+	}
+
+	return prefix + path.Join(fsRoot, resolved), nil
+}
+
+// evalSymlinks resolves the given path inside the given root of the file
+// system and returns the resolved path relative to the root.
+func evalSymlinks(linkFS ReadLinkFS, fsRoot, name string) (string, error) {
+	var (
+		resolved  string
+		remaining = strings.Split(filepath.ToSlash(name), "/")
+		links     int
+	)
+	for len(remaining) > 0 {
+		elem := remaining[0]
+		remaining = remaining[1:]
+
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			if resolved == "." {
+				resolved = ""
+			}
+			continue
+		}
+
+		next := path.Join(resolved, elem)
+		info, err := linkFS.Lstat(fsPath(path.Join(fsRoot, next)))
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxLinks {
+			return "", &fs.PathError{Op: "eval", Path: name, Err: errTooManyLinks}
+		}
+		target, err := linkFS.ReadLink(fsPath(path.Join(fsRoot, next)))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = ""
+		}
+		remaining = append(strings.Split(target, "/"), remaining...)
+	}
+
+	return resolved, nil
+}
+
+// LinkChain returns the base names of the given path and of all symbolic
+// links it points to, in the given root directory of the file system, like
+// EvalSymlinksIn. The last name is the one of the final file, like
+// ["libfoo.so.1", "libfoo.so.1.2.3"]. Only links of the last path element are
+// part of the chain, links of parent directories are resolved silently. If
+// the file system does not implement [ReadLinkFS], only the base name of the
+// path is returned.
+func LinkChain(fsys fs.FS, root, name string) ([]string, error) {
+	names := []string{path.Base(filepath.ToSlash(name))}
+
+	linkFS, ok := fsys.(ReadLinkFS)
+	if !ok {
+		return names, nil
+	}
+	fsRoot := strings.Trim(path.Clean(filepath.ToSlash("/"+root)), "/")
+
+	current := filepath.ToSlash(name)
+	for links := 0; ; links++ {
+		if links > maxLinks {
+			return nil, &fs.PathError{Op: "chain", Path: name, Err: errTooManyLinks}
+		}
+
+		dir, err := evalSymlinks(linkFS, fsRoot, path.Dir(current))
+		if err != nil {
+			return nil, err
+		}
+		file := fsPath(path.Join(fsRoot, dir, path.Base(current)))
+		info, err := linkFS.Lstat(file)
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			return names, nil
+		}
+
+		target, err := linkFS.ReadLink(file)
+		if err != nil {
+			return nil, err
+		}
+		if path.IsAbs(target) {
+			current = target
+		} else {
+			current = path.Join(dir, target)
+		}
+		names = append(names, path.Base(current))
+	}
+}
+
+var errTooManyLinks = errors.New("too many links")
+
+// fsPath returns the given path as valid [fs.FS] path by cutting the leading
+// separator.
+func fsPath(name string) string {
+	name = strings.TrimPrefix(path.Clean(filepath.ToSlash(name)), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// statFS returns the [fs.FileInfo] for the given path in the given file
+// system. If fsys is nil, the host's file system is used.
+func statFS(fsys fs.FS, name string) (fs.FileInfo, error) {
+	if fsys == nil {
+		return os.Stat(name)
+	}
+	return fs.Stat(fsys, fsPath(name))
+}
@@ -0,0 +1,221 @@
+package files_test
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aibor/initramfs/internal/files"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvalSymlinksIn(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"root/lib/real", "lib"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, d), 0755))
+	}
+	for _, f := range []string{"root/lib/real/libc.so", "lib/outside.so"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, f), nil, 0644))
+	}
+	links := map[string]string{
+		"root/lib/abs.so":    "/lib/real/libc.so",
+		"root/lib/rel.so":    "real/libc.so",
+		"root/lib/up.so":     "../../../lib/real/libc.so",
+		"root/lib/chain.so":  "abs.so",
+		"root/lib/dir":       "/lib/real",
+		"root/lib/escape.so": "/lib/outside.so",
+		"root/lib/loop.so":   "loop.so",
+	}
+	for link, target := range links {
+		require.NoError(t, os.Symlink(target, filepath.Join(dir, link)))
+	}
+	testFS := files.DirFS(dir)
+
+	tests := []struct {
+		name     string
+		root     string
+		path     string
+		expected string
+		errMsg   string
+	}{
+		{
+			name:     "no link",
+			root:     "/root",
+			path:     "/lib/real/libc.so",
+			expected: "/root/lib/real/libc.so",
+		},
+		{
+			name:     "absolute link",
+			root:     "/root",
+			path:     "/lib/abs.so",
+			expected: "/root/lib/real/libc.so",
+		},
+		{
+			name:     "relative link",
+			root:     "/root",
+			path:     "/lib/rel.so",
+			expected: "/root/lib/real/libc.so",
+		},
+		{
+			name:     "relative link beyond root",
+			root:     "/root",
+			path:     "/lib/up.so",
+			expected: "/root/lib/real/libc.so",
+		},
+		{
+			name:     "link chain",
+			root:     "/root",
+			path:     "/lib/chain.so",
+			expected: "/root/lib/real/libc.so",
+		},
+		{
+			name:     "linked directory",
+			root:     "/root",
+			path:     "/lib/dir/libc.so",
+			expected: "/root/lib/real/libc.so",
+		},
+		{
+			name:   "absolute link does not escape",
+			root:   "/root",
+			path:   "/lib/escape.so",
+			errMsg: "no such file or directory",
+		},
+		{
+			name:     "absolute link without root",
+			path:     "/root/lib/escape.so",
+			expected: "/lib/outside.so",
+		},
+		{
+			name:     "relative path",
+			root:     "root",
+			path:     "lib/abs.so",
+			expected: "root/lib/real/libc.so",
+		},
+		{
+			name:   "link loop",
+			root:   "/root",
+			path:   "/lib/loop.so",
+			errMsg: "too many links",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			path, err := files.EvalSymlinksIn(testFS, tt.root, tt.path)
+			if tt.errMsg != "" {
+				assert.ErrorContains(t, err, tt.errMsg)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, path)
+		})
+	}
+
+	t.Run("not existing", func(t *testing.T) {
+		_, err := files.EvalSymlinks(testFS, "/nonexisting")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("without link support", func(t *testing.T) {
+		path, err := files.EvalSymlinksIn(readerOnlyFS{testFS}, "/root", "/lib/abs.so")
+		require.NoError(t, err)
+		assert.Equal(t, "/root/lib/abs.so", path)
+	})
+}
+
+func TestDirFS(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Symlink("target", filepath.Join(dir, "link")))
+	testFS := files.DirFS(dir)
+
+	target, err := testFS.ReadLink("link")
+	require.NoError(t, err)
+	assert.Equal(t, "target", target)
+
+	info, err := testFS.Lstat("link")
+	require.NoError(t, err)
+	assert.Equal(t, fs.ModeSymlink, info.Mode().Type())
+
+	_, err = testFS.ReadLink("/link")
+	assert.ErrorIs(t, err, fs.ErrInvalid)
+}
+
+func TestLinkChain(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"root/lib/real", "root/usr"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, d), 0755))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "root/lib/real/libc.so.6.1"), nil, 0644))
+	links := map[string]string{
+		"root/lib/real/libc.so.6": "libc.so.6.1",
+		"root/lib/libc.so":        "/lib/real/libc.so.6",
+		"root/usr/lib":            "../lib",
+		"root/lib/loop.so":        "loop.so",
+	}
+	for link, target := range links {
+		require.NoError(t, os.Symlink(target, filepath.Join(dir, link)))
+	}
+	testFS := files.DirFS(dir)
+
+	tests := []struct {
+		name     string
+		path     string
+		expected []string
+		errMsg   string
+	}{
+		{
+			name:     "no link",
+			path:     "/lib/real/libc.so.6.1",
+			expected: []string{"libc.so.6.1"},
+		},
+		{
+			name:     "chain",
+			path:     "/lib/libc.so",
+			expected: []string{"libc.so", "libc.so.6", "libc.so.6.1"},
+		},
+		{
+			name:     "directory link",
+			path:     "/usr/lib/real/libc.so.6",
+			expected: []string{"libc.so.6", "libc.so.6.1"},
+		},
+		{
+			name:   "loop",
+			path:   "/lib/loop.so",
+			errMsg: "too many links",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			names, err := files.LinkChain(testFS, "/root", tt.path)
+			if tt.errMsg != "" {
+				assert.ErrorContains(t, err, tt.errMsg)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, names)
+		})
+	}
+
+	t.Run("without link support", func(t *testing.T) {
+		names, err := files.LinkChain(readerOnlyFS{testFS}, "/root", "/lib/libc.so")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"libc.so"}, names)
+	})
+}
+
+func TestReadLink(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Symlink("target", filepath.Join(dir, "link")))
+	testFS := files.DirFS(dir)
+
+	target, err := files.ReadLink(testFS, "link")
+	require.NoError(t, err)
+	assert.Equal(t, "target", target)
+
+	_, err = files.ReadLink(readerOnlyFS{testFS}, "link")
+	assert.ErrorContains(t, err, "readlink link: not supported by file system")
+}
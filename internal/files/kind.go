@@ -0,0 +1,152 @@
+package files
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// shebangMaxLen is the maximum length of a shebang line read, like the
+	// kernel's BINPRM_BUF_SIZE.
+	shebangMaxLen = 256
+	// maxScriptDepth is the maximum number of nested script interpreters,
+	// like the kernel's limit of binfmt rewrites.
+	maxScriptDepth = 4
+)
+
+// Kind is the kind of a file regarding its runtime dependencies.
+type Kind int
+
+const (
+	// KindOther is any file without runtime dependencies, like a data file.
+	KindOther Kind = iota
+	// KindELF is an ELF file. It might be statically linked.
+	KindELF
+	// KindScript is an executable script with a shebang line naming its
+	// interpreter.
+	KindScript
+)
+
+// String returns the name of the [Kind].
+func (k Kind) String() string {
+	switch k {
+	case KindELF:
+		return "ELF"
+	case KindScript:
+		return "script"
+	default:
+		return "other"
+	}
+}
+
+// DetectKind returns the [Kind] of the file with the given path in the given
+// file system. For scripts, the interpreter of the shebang line is returned
+// as well, without its optional argument, like "/bin/sh" for "#!/bin/sh -e".
+// Shebang lines without interpreter are [KindOther]. If fsys is nil, the
+// host's file system is used.
+func DetectKind(fsys fs.FS, path string) (Kind, string, error) {
+	var file fs.File
+	var err error
+	if fsys == nil {
+		file, err = os.Open(path)
+	} else {
+		file, err = fsys.Open(fsPath(path))
+	}
+	if err != nil {
+		return KindOther, "", err
+	}
+	defer file.Close()
+
+	buf := make([]byte, shebangMaxLen)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return KindOther, "", err
+	}
+	buf = buf[:n]
+
+	switch {
+	case bytes.HasPrefix(buf, []byte("\x7fELF")):
+		return KindELF, "", nil
+	case bytes.HasPrefix(buf, []byte("#!")):
+		line, _, _ := bytes.Cut(buf[2:], []byte("\n"))
+		fields := bytes.Fields(line)
+		if len(fields) == 0 {
+			return KindOther, "", nil
+		}
+		return KindScript, string(fields[0]), nil
+	default:
+		return KindOther, "", nil
+	}
+}
+
+// ResolveFile resolves the runtime dependencies of the file with the given
+// path depending on its [Kind]. ELF files are resolved like by
+// [ELFLibResolver.Resolve]. The interpreters of scripts are resolved, if
+// [ELFLibResolver.Scripts] is set. All other files are skipped.
+func (r *ELFLibResolver) ResolveFile(path string) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+	return r.resolveFile(path, path, nil)
+}
+
+// resolveFile resolves the file found at the given path, whose content is
+// read from the given real path. Interps are the script interpreters the file
+// is the interpreter of, starting with the closest one.
+func (r *ELFLibResolver) resolveFile(path, realPath string, interps []string) error {
+	kind, interp, err := DetectKind(r.FS, realPath)
+	if err != nil {
+		return fmt.Errorf("detect kind: %v", err)
+	}
+
+	switch kind {
+	case KindELF:
+		info, err := r.readELF(realPath)
+		if err != nil {
+			return fmt.Errorf("get linked libs: %v", err)
+		}
+		return r.resolveMain(path, info)
+	case KindScript:
+		if !r.Scripts {
+			return nil
+		}
+		return r.resolveScriptInterpreter(path, interp, interps)
+	default:
+		return nil
+	}
+}
+
+// resolveScriptInterpreter looks up the given interpreter of the script with
+// the given path at its exact path in [ELFLibResolver.Root] and resolves it
+// recursively. The interpreter may be a script itself, up to
+// maxScriptDepth levels, like the kernel allows.
+func (r *ELFLibResolver) resolveScriptInterpreter(script, interp string, interps []string) error {
+	if len(interps) >= maxScriptDepth || slices.Contains(interps, interp) {
+		return fmt.Errorf("%s: too many nested script interpreters", script)
+	}
+
+	if found, exists := r.found[interp]; exists && slices.Contains(r.ScriptInterpreters, interp) {
+		r.addDependency(Dependency{Requester: script, Name: interp, Path: found.path, Interpreter: true})
+		return nil
+	}
+
+	interpPath := r.rootPath(interp)
+	realPath, names, err := r.lookup(interpPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return r.missing(script, "script interpreter", []string{interp}, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	r.ScriptInterpreters = append(r.ScriptInterpreters, interp)
+	r.setFound(interp, &candidate{path: interpPath, realPath: realPath, names: names})
+	r.addDependency(Dependency{Requester: script, Name: interp, Path: interpPath, Interpreter: true})
+	return r.resolveFile(interpPath, realPath, append([]string{interp}, interps...))
+}
@@ -0,0 +1,179 @@
+package files_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aibor/initramfs/internal/files"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectKind(t *testing.T) {
+	dir := t.TempDir()
+	contents := map[string]string{
+		"script":      "#!/bin/sh\necho\n",
+		"script_args": "#! /bin/sh -e\r\necho\n",
+		"empty":       "",
+		"no_interp":   "#!\n",
+		"data":        "key=value\n",
+	}
+	for name, content := range contents {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0755))
+	}
+
+	tests := []struct {
+		name           string
+		path           string
+		expectedKind   files.Kind
+		expectedInterp string
+	}{
+		{
+			name:         "ELF",
+			path:         "testdata/bin/main",
+			expectedKind: files.KindELF,
+		},
+		{
+			name:           "script",
+			path:           filepath.Join(dir, "script"),
+			expectedKind:   files.KindScript,
+			expectedInterp: "/bin/sh",
+		},
+		{
+			name:           "script with argument",
+			path:           filepath.Join(dir, "script_args"),
+			expectedKind:   files.KindScript,
+			expectedInterp: "/bin/sh",
+		},
+		{
+			name:         "empty",
+			path:         filepath.Join(dir, "empty"),
+			expectedKind: files.KindOther,
+		},
+		{
+			name:         "shebang without interpreter",
+			path:         filepath.Join(dir, "no_interp"),
+			expectedKind: files.KindOther,
+		},
+		{
+			name:         "data",
+			path:         filepath.Join(dir, "data"),
+			expectedKind: files.KindOther,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			kind, interp, err := files.DetectKind(nil, tt.path)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedKind, kind)
+			assert.Equal(t, tt.expectedInterp, interp)
+		})
+	}
+
+	t.Run("not existing", func(t *testing.T) {
+		_, _, err := files.DetectKind(nil, filepath.Join(dir, "nonexisting"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
+
+func TestELFLibResolverResolveFile(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "sysroot")
+	sysroot(t, root)
+	binDir := filepath.Join(root, "bin")
+	require.NoError(t, os.MkdirAll(binDir, 0755))
+	data, err := os.ReadFile("testdata/bin/main")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "busybox"), data, 0755))
+	require.NoError(t, os.Symlink("/bin/busybox", filepath.Join(binDir, "sh")))
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "wrapper"), []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "loop"), []byte("#!/bin/loop\n"), 0755))
+
+	scriptDir := t.TempDir()
+	for name, content := range map[string]string{
+		"script":  "#!/bin/sh\n",
+		"nested":  "#!/bin/wrapper\n",
+		"missing": "#!/bin/bash\n",
+		"loop":    "#!/bin/loop\n",
+		"data":    "data\n",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(scriptDir, name), []byte(content), 0755))
+	}
+
+	tests := []struct {
+		name           string
+		file           string
+		scripts        bool
+		expectedInterp []string
+		errMsg         string
+	}{
+		{
+			name: "data",
+			file: "data",
+		},
+		{
+			name: "script without scripts",
+			file: "script",
+		},
+		{
+			name:           "script",
+			file:           "script",
+			scripts:        true,
+			expectedInterp: []string{"/bin/sh"},
+		},
+		{
+			name:           "nested script",
+			file:           "nested",
+			scripts:        true,
+			expectedInterp: []string{"/bin/wrapper", "/bin/sh"},
+		},
+		{
+			name:    "missing interpreter",
+			file:    "missing",
+			scripts: true,
+			errMsg:  "script interpreter could not be resolved: /bin/bash",
+		},
+		{
+			name:    "interpreter loop",
+			file:    "loop",
+			scripts: true,
+			errMsg:  "too many nested script interpreters",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			r := files.ELFLibResolver{
+				FS:      files.DirFS("/"),
+				Root:    root,
+				Scripts: tt.scripts,
+			}
+			err := r.ResolveFile(filepath.Join(scriptDir, tt.file))
+			if tt.errMsg != "" {
+				assert.ErrorContains(t, err, tt.errMsg)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedInterp, r.ScriptInterpreters)
+			if len(tt.expectedInterp) == 0 {
+				assert.Empty(t, r.Libs)
+				return
+			}
+			assert.Len(t, r.Libs, 3)
+		})
+	}
+
+	t.Run("link names", func(t *testing.T) {
+		r := files.ELFLibResolver{
+			FS:      files.DirFS("/"),
+			Root:    root,
+			Scripts: true,
+		}
+		require.NoError(t, r.ResolveFile(filepath.Join(scriptDir, "script")))
+		assert.Equal(t, filepath.Join(binDir, "busybox"), r.RealPath("/bin/sh"))
+		assert.Equal(t, []string{"sh", "busybox"}, r.LinkNames("/bin/sh"))
+	})
+}
@@ -0,0 +1,353 @@
+package files
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// LDConfigFile is the path of the ld.so.conf file.
+	LDConfigFile = "/etc/ld.so.conf"
+	// LDCacheFile is the path of the ld.so.cache file.
+	LDCacheFile = "/etc/ld.so.cache"
+)
+
+const (
+	// ldCacheMagic is the magic of the ld.so.cache format used since glibc
+	// 2.32 exclusively.
+	ldCacheMagic = "glibc-ld.so.cache1.1"
+	// ldCacheOldMagic is the magic of the old ld.so.cache format. The new
+	// format might follow.
+	ldCacheOldMagic = "ld.so-1.7.0"
+
+	ldCacheHeaderLen     = 48
+	ldCacheEntryLen      = 24
+	ldCacheOldHeaderLen  = 16
+	ldCacheOldEntryLen   = 12
+	ldCacheEndianBig     = 3
+	ldCacheEndianMask    = 3
+	ldCacheMaxIncludes   = 16
+	ldCacheFlagTypeMask  = 0x00ff
+	ldCacheFlagELFLibc6  = 0x0003
+	ldCacheFlagArchMask  = 0xff00
+	ldCacheFlagSPARC64   = 0x0100
+	ldCacheFlagIA64      = 0x0200
+	ldCacheFlagX8664     = 0x0300
+	ldCacheFlagS390      = 0x0400
+	ldCacheFlagPPC64     = 0x0500
+	ldCacheFlagMIPS64N64 = 0x0700
+	ldCacheFlagX32       = 0x0800
+	ldCacheFlagAArch64   = 0x0a00
+	ldCacheFlagRISCVD    = 0x1000
+)
+
+// LDCacheEntry is a library entry of an ld.so.cache file.
+type LDCacheEntry struct {
+	// Name is the name the library is looked up by, usually its SONAME.
+	Name string
+	// Path is the absolute path of the library.
+	Path string
+	// Flags define the type and architecture of the library.
+	Flags int32
+	// HWCap is set for libraries in glibc-hwcaps subdirectories.
+	HWCap uint64
+}
+
+// LDCache is a parsed ld.so.cache file as written by ldconfig.
+type LDCache struct {
+	Entries []LDCacheEntry
+}
+
+// ParseLDCache parses the given content of an ld.so.cache file. Both, the
+// current format and the old format, are supported.
+func ParseLDCache(data []byte) (*LDCache, error) {
+	if bytes.HasPrefix(data, []byte(ldCacheOldMagic)) {
+		if len(data) < ldCacheOldHeaderLen {
+			return nil, fmt.Errorf("ld.so.cache too short")
+		}
+		nlibs := binary.LittleEndian.Uint32(data[12:16])
+		offset := uint64(ldCacheOldHeaderLen) + uint64(nlibs)*ldCacheOldEntryLen
+		if offset > uint64(len(data)) {
+			return nil, fmt.Errorf("ld.so.cache too short for %d entries", nlibs)
+		}
+		// The new format follows aligned, if present.
+		newOffset := (offset + 7) &^ 7
+		if newOffset < uint64(len(data)) && bytes.HasPrefix(data[newOffset:], []byte(ldCacheMagic)) {
+			return parseLDCache(data[newOffset:])
+		}
+		return parseOldLDCache(data[ldCacheOldHeaderLen:offset], data[offset:])
+	}
+	if bytes.HasPrefix(data, []byte(ldCacheMagic)) {
+		return parseLDCache(data)
+	}
+	return nil, fmt.Errorf("not an ld.so.cache")
+}
+
+// parseLDCache parses the current ld.so.cache format. String offsets are
+// relative to the start of the given data.
+func parseLDCache(data []byte) (*LDCache, error) {
+	if len(data) < ldCacheHeaderLen {
+		return nil, fmt.Errorf("ld.so.cache too short")
+	}
+
+	var byteOrder binary.ByteOrder = binary.LittleEndian
+	if data[28]&ldCacheEndianMask == ldCacheEndianBig {
+		byteOrder = binary.BigEndian
+	}
+
+	nlibs := uint64(byteOrder.Uint32(data[20:24]))
+	if ldCacheHeaderLen+nlibs*ldCacheEntryLen > uint64(len(data)) {
+		return nil, fmt.Errorf("ld.so.cache too short for %d entries", nlibs)
+	}
+
+	cache := LDCache{Entries: make([]LDCacheEntry, 0, nlibs)}
+	for idx := uint64(0); idx < nlibs; idx++ {
+		entry := data[ldCacheHeaderLen+idx*ldCacheEntryLen:]
+		name, err := cString(data, byteOrder.Uint32(entry[4:8]))
+		if err != nil {
+			return nil, err
+		}
+		path, err := cString(data, byteOrder.Uint32(entry[8:12]))
+		if err != nil {
+			return nil, err
+		}
+		cache.Entries = append(cache.Entries, LDCacheEntry{
+			Name:  name,
+			Path:  path,
+			Flags: int32(byteOrder.Uint32(entry[0:4])),
+			HWCap: byteOrder.Uint64(entry[16:24]),
+		})
+	}
+
+	return &cache, nil
+}
+
+// parseOldLDCache parses the entries of the old ld.so.cache format. String
+// offsets are relative to the start of the string table.
+func parseOldLDCache(entries, strtab []byte) (*LDCache, error) {
+	var cache LDCache
+	for ; len(entries) >= ldCacheOldEntryLen; entries = entries[ldCacheOldEntryLen:] {
+		name, err := cString(strtab, binary.LittleEndian.Uint32(entries[4:8]))
+		if err != nil {
+			return nil, err
+		}
+		path, err := cString(strtab, binary.LittleEndian.Uint32(entries[8:12]))
+		if err != nil {
+			return nil, err
+		}
+		cache.Entries = append(cache.Entries, LDCacheEntry{
+			Name:  name,
+			Path:  path,
+			Flags: int32(binary.LittleEndian.Uint32(entries[0:4])),
+		})
+	}
+	return &cache, nil
+}
+
+// cString returns the NUL terminated string at the given offset.
+func cString(data []byte, offset uint32) (string, error) {
+	if uint64(offset) >= uint64(len(data)) {
+		return "", fmt.Errorf("ld.so.cache string offset out of range: %d", offset)
+	}
+	str := data[offset:]
+	end := bytes.IndexByte(str, 0)
+	if end < 0 {
+		return "", fmt.Errorf("ld.so.cache string not terminated at %d", offset)
+	}
+	return string(str[:end]), nil
+}
+
+// Lookup returns the paths of all libraries with the given name that are
+// compatible with ELF files with the given header, in the order of the cache.
+// Entries for glibc-hwcaps subdirectories are ignored.
+func (c *LDCache) Lookup(name string, header elf.FileHeader) []string {
+	flags, known := ldCacheFlags(header)
+
+	var paths []string
+	for _, entry := range c.Entries {
+		if entry.Name != name || entry.HWCap != 0 {
+			continue
+		}
+		if entry.Flags&ldCacheFlagTypeMask != ldCacheFlagELFLibc6 {
+			continue
+		}
+		if known && entry.Flags&ldCacheFlagArchMask != flags {
+			continue
+		}
+		paths = append(paths, entry.Path)
+	}
+	return paths
+}
+
+// ldCacheFlags returns the architecture flags of ld.so.cache entries
+// compatible with ELF files with the given header. It returns false, if
+// the machine is unknown.
+func ldCacheFlags(header elf.FileHeader) (int32, bool) {
+	is64 := header.Class == elf.ELFCLASS64
+
+	switch header.Machine {
+	case elf.EM_X86_64:
+		if is64 {
+			return ldCacheFlagX8664, true
+		}
+		return ldCacheFlagX32, true
+	case elf.EM_386, elf.EM_PPC:
+		return 0, true
+	case elf.EM_AARCH64:
+		return ldCacheFlagAArch64, true
+	case elf.EM_PPC64:
+		return ldCacheFlagPPC64, true
+	case elf.EM_S390:
+		if is64 {
+			return ldCacheFlagS390, true
+		}
+		return 0, true
+	case elf.EM_SPARCV9:
+		return ldCacheFlagSPARC64, true
+	case elf.EM_IA_64:
+		return ldCacheFlagIA64, true
+	case elf.EM_ARM:
+		// Depends on the float ABI in the ELF flags.
+		return 0, false
+	case elf.EM_RISCV:
+		if is64 {
+			return ldCacheFlagRISCVD, true
+		}
+		return 0, false
+	case elf.EM_MIPS:
+		if is64 {
+			return ldCacheFlagMIPS64N64, true
+		}
+		return 0, false
+	default:
+		return 0, false
+	}
+}
+
+// ReadLDConfig reads the library directories from the ld.so.conf file at the
+// given path in the given root directory of the file system. Files included
+// by "include" directives are read recursively. Relative include patterns are
+// relative to the directory of the including file. All paths are relative to
+// root. "hwcap" directives are ignored.
+func ReadLDConfig(fsys fs.FS, root, name string) ([]string, error) {
+	return readLDConfig(fsys, root, name, 0)
+}
+
+func readLDConfig(fsys fs.FS, root, name string, depth int) ([]string, error) {
+	if depth > ldCacheMaxIncludes {
+		return nil, fmt.Errorf("%s: too many nested includes", name)
+	}
+
+	data, err := fs.ReadFile(fsys, fsPath(filepath.Join(root, name)))
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ' ' || r == '\t' || r == ':' || r == ','
+		})
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "include":
+			for _, pattern := range fields[1:] {
+				if !path.IsAbs(pattern) {
+					pattern = path.Join(path.Dir(filepath.ToSlash(name)), pattern)
+				}
+				matches, err := fs.Glob(fsys, fsPath(path.Join(filepath.ToSlash(root), pattern)))
+				if err != nil {
+					return nil, fmt.Errorf("%s: %v", name, err)
+				}
+				for _, match := range matches {
+					if prefix := fsPath(root); prefix != "." {
+						match = strings.TrimPrefix(match, prefix)
+					}
+					included, err := readLDConfig(fsys, root, path.Join("/", match), depth+1)
+					if err != nil {
+						return nil, err
+					}
+					dirs = appendUnique(dirs, included...)
+				}
+			}
+		case "hwcap":
+		default:
+			for _, dir := range fields {
+				// Legacy "dir=TYPE" syntax.
+				dir, _, _ = strings.Cut(dir, "=")
+				dirs = appendUnique(dirs, path.Clean(dir))
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	return dirs, nil
+}
+
+// appendUnique appends all given values that are not present yet.
+func appendUnique(values []string, add ...string) []string {
+	for _, value := range add {
+		if !slices.Contains(values, value) {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// LoadLDConfig reads [LDConfigFile] and [LDCacheFile] in the root of the
+// [ELFLibResolver] and sets [ELFLibResolver.ConfigPaths] and
+// [ELFLibResolver.Cache]. Missing files are ignored.
+func (r *ELFLibResolver) LoadLDConfig() error {
+	fsys, root := r.FS, r.Root
+	if fsys == nil {
+		fsys, root = DirFS("/"), "/"
+		if r.Root != "" {
+			var err error
+			if root, err = filepath.Abs(r.Root); err != nil {
+				return err
+			}
+		}
+	}
+
+	configPaths, err := ReadLDConfig(fsys, root, LDConfigFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("read %s: %v", LDConfigFile, err)
+	}
+	r.ConfigPaths = configPaths
+
+	cachePath, err := EvalSymlinksIn(fsys, root, LDCacheFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read %s: %v", LDCacheFile, err)
+	}
+	data, err := fs.ReadFile(fsys, fsPath(cachePath))
+	if err != nil {
+		return fmt.Errorf("read %s: %v", LDCacheFile, err)
+	}
+	cache, err := ParseLDCache(data)
+	if err != nil {
+		return fmt.Errorf("read %s: %v", LDCacheFile, err)
+	}
+	r.Cache = cache
+
+	return nil
+}
@@ -0,0 +1,287 @@
+package files_test
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aibor/initramfs/internal/files"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ldCache encodes the given entries in the ld.so.cache format of glibc 2.32+
+// with the given byte order.
+func ldCache(byteOrder binary.ByteOrder, entries ...files.LDCacheEntry) []byte {
+	const headerLen, entryLen = 48, 24
+
+	strtab := headerLen + len(entries)*entryLen
+	var strs bytes.Buffer
+	str := func(s string) uint32 {
+		offset := strtab + strs.Len()
+		strs.WriteString(s)
+		strs.WriteByte(0)
+		return uint32(offset)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("glibc-ld.so.cache1.1")
+	_ = binary.Write(&buf, byteOrder, uint32(len(entries)))
+	_ = binary.Write(&buf, byteOrder, uint32(0))
+	flags := byte(2)
+	if byteOrder == binary.BigEndian {
+		flags = 3
+	}
+	buf.Write([]byte{flags, 0, 0, 0})
+	buf.Write(make([]byte, 16))
+	for _, entry := range entries {
+		_ = binary.Write(&buf, byteOrder, entry.Flags)
+		_ = binary.Write(&buf, byteOrder, str(entry.Name))
+		_ = binary.Write(&buf, byteOrder, str(entry.Path))
+		_ = binary.Write(&buf, byteOrder, uint32(0))
+		_ = binary.Write(&buf, byteOrder, entry.HWCap)
+	}
+	buf.Write(strs.Bytes())
+	return buf.Bytes()
+}
+
+// oldLDCache encodes the given entries in the old ld.so.cache format.
+func oldLDCache(entries ...files.LDCacheEntry) []byte {
+	var strs bytes.Buffer
+	str := func(s string) uint32 {
+		offset := strs.Len()
+		strs.WriteString(s)
+		strs.WriteByte(0)
+		return uint32(offset)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("ld.so-1.7.0\x00")
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(len(entries)))
+	for _, entry := range entries {
+		_ = binary.Write(&buf, binary.LittleEndian, entry.Flags)
+		_ = binary.Write(&buf, binary.LittleEndian, str(entry.Name))
+		_ = binary.Write(&buf, binary.LittleEndian, str(entry.Path))
+	}
+	buf.Write(strs.Bytes())
+	return buf.Bytes()
+}
+
+func TestParseLDCache(t *testing.T) {
+	entries := []files.LDCacheEntry{
+		{Name: "libc.so.6", Path: "/lib/x86_64-linux-gnu/libc.so.6", Flags: 0x0303},
+		{Name: "libm.so.6", Path: "/usr/lib64/libm.so.6", Flags: 0x0303, HWCap: 1 << 62},
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected []files.LDCacheEntry
+		errMsg   string
+	}{
+		{
+			name:     "little endian",
+			data:     ldCache(binary.LittleEndian, entries...),
+			expected: entries,
+		},
+		{
+			name:     "big endian",
+			data:     ldCache(binary.BigEndian, entries...),
+			expected: entries,
+		},
+		{
+			name: "old format",
+			data: oldLDCache(entries[0]),
+			expected: []files.LDCacheEntry{
+				entries[0],
+			},
+		},
+		{
+			name: "old format followed by new format",
+			// Without old entries, as the strings are shared.
+			data:     append(oldLDCache(), ldCache(binary.LittleEndian, entries...)...),
+			expected: entries,
+		},
+		{
+			name:   "unknown format",
+			data:   []byte("something else"),
+			errMsg: "not an ld.so.cache",
+		},
+		{
+			name:   "truncated",
+			data:   ldCache(binary.LittleEndian, entries...)[:60],
+			errMsg: "too short for 2 entries",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			cache, err := files.ParseLDCache(tt.data)
+			if tt.errMsg != "" {
+				assert.ErrorContains(t, err, tt.errMsg)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, cache.Entries)
+		})
+	}
+}
+
+func TestLDCacheLookup(t *testing.T) {
+	cache := files.LDCache{
+		Entries: []files.LDCacheEntry{
+			{Name: "libc.so.6", Path: "/glibc-hwcaps/x86-64-v3/libc.so.6", Flags: 0x0303, HWCap: 1 << 62},
+			{Name: "libc.so.6", Path: "/lib/aarch64-linux-gnu/libc.so.6", Flags: 0x0a03},
+			{Name: "libc.so.6", Path: "/lib/x86_64-linux-gnu/libc.so.6", Flags: 0x0303},
+			{Name: "libc.so.6", Path: "/lib/i386-linux-gnu/libc.so.6", Flags: 0x0003},
+			{Name: "libc.so.6", Path: "/usr/lib64/libc.so.6", Flags: 0x0303},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		lib      string
+		header   elf.FileHeader
+		expected []string
+	}{
+		{
+			name:   "x86_64",
+			lib:    "libc.so.6",
+			header: elf.FileHeader{Class: elf.ELFCLASS64, Machine: elf.EM_X86_64},
+			expected: []string{
+				"/lib/x86_64-linux-gnu/libc.so.6",
+				"/usr/lib64/libc.so.6",
+			},
+		},
+		{
+			name:     "aarch64",
+			lib:      "libc.so.6",
+			header:   elf.FileHeader{Class: elf.ELFCLASS64, Machine: elf.EM_AARCH64},
+			expected: []string{"/lib/aarch64-linux-gnu/libc.so.6"},
+		},
+		{
+			name:     "i386",
+			lib:      "libc.so.6",
+			header:   elf.FileHeader{Class: elf.ELFCLASS32, Machine: elf.EM_386},
+			expected: []string{"/lib/i386-linux-gnu/libc.so.6"},
+		},
+		{
+			name:   "unknown",
+			lib:    "libm.so.6",
+			header: elf.FileHeader{Class: elf.ELFCLASS64, Machine: elf.EM_X86_64},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, cache.Lookup(tt.lib, tt.header))
+		})
+	}
+}
+
+func TestReadLDConfig(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "sysroot")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "etc", "ld.so.conf.d"), 0755))
+	testFiles := map[string]string{
+		"etc/ld.so.conf": "# comment\n" +
+			"include /etc/ld.so.conf.d/*.conf\n" +
+			"/usr/local/lib  # trailing comment\n" +
+			"hwcap 0 nosegneg\n" +
+			"include extra.conf\n",
+		"etc/ld.so.conf.d/b.conf": "/opt/b/lib\n",
+		"etc/ld.so.conf.d/a.conf": "/opt/a/lib:/opt/a/lib64, /usr/local/lib\n",
+		"etc/extra.conf":          "/opt/extra/lib=libc6\n",
+		"etc/loop.conf":           "include loop.conf\n",
+	}
+	for name, content := range testFiles {
+		require.NoError(t, os.WriteFile(filepath.Join(root, name), []byte(content), 0644))
+	}
+	testFS := files.DirFS("/")
+
+	dirs, err := files.ReadLDConfig(testFS, root, "/etc/ld.so.conf")
+	require.NoError(t, err)
+	expected := []string{
+		"/opt/a/lib",
+		"/opt/a/lib64",
+		"/usr/local/lib",
+		"/opt/b/lib",
+		"/opt/extra/lib",
+	}
+	assert.Equal(t, expected, dirs)
+
+	_, err = files.ReadLDConfig(testFS, root, "/etc/nonexisting.conf")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = files.ReadLDConfig(testFS, root, "/etc/loop.conf")
+	assert.ErrorContains(t, err, "too many nested includes")
+}
+
+func TestELFLibResolverLoadLDConfig(t *testing.T) {
+	elfFile, err := filepath.Abs("testdata/bin/main")
+	require.NoError(t, err)
+
+	root := t.TempDir()
+	install := func(dir string, libs ...string) {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0755))
+		for _, lib := range libs {
+			data, err := os.ReadFile(filepath.Join("testdata/lib", lib))
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(filepath.Join(root, dir, lib), data, 0755))
+		}
+	}
+	install("/lib64", "ld-linux-x86-64.so.2")
+	install("/opt/cached", "libfunc2.so", "libfunc3.so")
+	install("/opt/conf", "libfunc1.so", "libfunc2.so")
+	// Default search paths come last.
+	install("/usr/lib", "libfunc1.so", "libfunc2.so", "libfunc3.so")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "etc"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "etc/ld.so.conf"), []byte("/opt/conf\n"), 0644))
+	cache := ldCache(binary.LittleEndian,
+		files.LDCacheEntry{Name: "libfunc2.so", Path: "/opt/cached/libfunc2.so", Flags: 0x0303},
+		files.LDCacheEntry{Name: "libfunc3.so", Path: "/opt/cached/libfunc3.so", Flags: 0x0303},
+	)
+	require.NoError(t, os.WriteFile(filepath.Join(root, "etc/ld.so.cache"), cache, 0644))
+
+	r := files.ELFLibResolver{
+		FS:   files.DirFS("/"),
+		Root: root,
+	}
+	require.NoError(t, r.LoadLDConfig())
+	assert.Equal(t, []string{"/opt/conf"}, r.ConfigPaths)
+	require.NotNil(t, r.Cache)
+	require.NoError(t, r.Resolve(elfFile))
+
+	expected := []string{
+		filepath.Join(root, "/opt/cached/libfunc2.so"),
+		filepath.Join(root, "/opt/cached/libfunc3.so"),
+		filepath.Join(root, "/opt/conf/libfunc1.so"),
+	}
+	assert.Equal(t, expected, r.Libs)
+
+	t.Run("missing files", func(t *testing.T) {
+		r := files.ELFLibResolver{
+			FS:   files.DirFS("/"),
+			Root: t.TempDir(),
+		}
+		require.NoError(t, r.LoadLDConfig())
+		assert.Nil(t, r.ConfigPaths)
+		assert.Nil(t, r.Cache)
+	})
+
+	t.Run("invalid cache", func(t *testing.T) {
+		root := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(root, "etc"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(root, "etc/ld.so.cache"), []byte("invalid"), 0644))
+		r := files.ELFLibResolver{
+			FS:   files.DirFS("/"),
+			Root: root,
+		}
+		assert.ErrorContains(t, r.LoadLDConfig(), "read /etc/ld.so.cache: not an ld.so.cache")
+	})
+}
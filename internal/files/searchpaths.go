@@ -0,0 +1,178 @@
+package files
+
+import (
+	"debug/elf"
+	"strings"
+)
+
+// emLoongArch is the ELF machine of LoongArch. It is not defined by
+// [debug/elf] of all supported Go versions.
+const emLoongArch elf.Machine = 258
+
+// MultiarchTriplets returns the Debian multiarch tuples used as library
+// directory names for ELF files with the given header. The first one is the
+// preferred. It returns nil for unknown machines.
+func MultiarchTriplets(header elf.FileHeader) []string {
+	is64 := header.Class == elf.ELFCLASS64
+	isLE := header.Data == elf.ELFDATA2LSB
+
+	switch header.Machine {
+	case elf.EM_X86_64:
+		if is64 {
+			return []string{"x86_64-linux-gnu"}
+		}
+		return []string{"x86_64-linux-gnux32"}
+	case elf.EM_386:
+		return []string{"i386-linux-gnu"}
+	case elf.EM_AARCH64:
+		if isLE {
+			return []string{"aarch64-linux-gnu"}
+		}
+		return []string{"aarch64_be-linux-gnu"}
+	case elf.EM_ARM:
+		return []string{"arm-linux-gnueabihf", "arm-linux-gnueabi"}
+	case elf.EM_RISCV:
+		if is64 {
+			return []string{"riscv64-linux-gnu"}
+		}
+		return []string{"riscv32-linux-gnu"}
+	case elf.EM_PPC64:
+		if isLE {
+			return []string{"powerpc64le-linux-gnu"}
+		}
+		return []string{"powerpc64-linux-gnu"}
+	case elf.EM_PPC:
+		return []string{"powerpc-linux-gnu"}
+	case elf.EM_S390:
+		if is64 {
+			return []string{"s390x-linux-gnu"}
+		}
+		return []string{"s390-linux-gnu"}
+	case elf.EM_MIPS:
+		switch {
+		case is64 && isLE:
+			return []string{"mips64el-linux-gnuabi64"}
+		case is64:
+			return []string{"mips64-linux-gnuabi64"}
+		case isLE:
+			return []string{"mipsel-linux-gnu"}
+		default:
+			return []string{"mips-linux-gnu"}
+		}
+	case elf.EM_SPARCV9:
+		return []string{"sparc64-linux-gnu"}
+	case emLoongArch:
+		return []string{"loongarch64-linux-gnu"}
+	default:
+		return nil
+	}
+}
+
+// DefaultSearchPaths returns the default library search paths for ELF files
+// with the given header. These are the multiarch directories of the machine,
+// followed by the directories for the word size of the machine and the
+// generic "/lib" and "/usr/lib".
+func DefaultSearchPaths(header elf.FileHeader) []string {
+	var paths []string
+	for _, triplet := range MultiarchTriplets(header) {
+		paths = append(paths, "/lib/"+triplet, "/usr/lib/"+triplet)
+	}
+
+	switch {
+	case header.Machine == elf.EM_X86_64 && header.Class == elf.ELFCLASS32:
+		paths = append(paths, "/libx32", "/usr/libx32")
+	case header.Class == elf.ELFCLASS64:
+		paths = append(paths, "/lib64", "/usr/lib64")
+	}
+
+	return append(paths, "/lib", "/usr/lib")
+}
+
+// libDirs returns the possible values of the dynamic string token $LIB for
+// ELF files with the given header. The actual value depends on how ld.so has
+// been built, like "lib/x86_64-linux-gnu" on Debian and "lib64" on Fedora.
+func libDirs(header elf.FileHeader) []string {
+	var dirs []string
+	for _, triplet := range MultiarchTriplets(header) {
+		dirs = append(dirs, "lib/"+triplet)
+	}
+	switch {
+	case header.Machine == elf.EM_X86_64 && header.Class == elf.ELFCLASS32:
+		dirs = append(dirs, "libx32")
+	case header.Class == elf.ELFCLASS64:
+		dirs = append(dirs, "lib64")
+	}
+	return append(dirs, "lib")
+}
+
+// platforms returns the possible values of the dynamic string token $PLATFORM
+// for ELF files with the given header. It returns nil for machines, whose
+// platform string depends on the actual CPU.
+func platforms(header elf.FileHeader) []string {
+	switch header.Machine {
+	case elf.EM_X86_64:
+		return []string{"x86_64"}
+	case elf.EM_386:
+		return []string{"i686", "i586", "i486", "i386"}
+	case elf.EM_AARCH64:
+		return []string{"aarch64"}
+	case elf.EM_ARM:
+		return []string{"v7l", "v6l", "v5l"}
+	case elf.EM_RISCV:
+		if header.Class == elf.ELFCLASS64 {
+			return []string{"riscv64"}
+		}
+		return []string{"riscv32"}
+	default:
+		return nil
+	}
+}
+
+// expandDST expands the dynamic string tokens $LIB and $PLATFORM, also in the
+// form ${LIB} and ${PLATFORM}, in the given DT_RPATH or DT_RUNPATH entry. As
+// their values depend on the system the file is run on, all possible values
+// are returned. If a token has no known value, the entry is dropped, like
+// ld.so drops entries with tokens it can not expand. $ORIGIN is not expanded,
+// see [cutOrigin].
+func expandDST(path string, header elf.FileHeader) []string {
+	tokens := []struct {
+		name   string
+		values []string
+	}{
+		{name: "LIB", values: libDirs(header)},
+		{name: "PLATFORM", values: platforms(header)},
+	}
+
+	paths := []string{path}
+	for _, token := range tokens {
+		var expanded []string
+		for _, path := range paths {
+			if !strings.Contains(path, "$"+token.name) &&
+				!strings.Contains(path, "${"+token.name+"}") {
+				expanded = append(expanded, path)
+				continue
+			}
+			for _, value := range token.values {
+				replacer := strings.NewReplacer(
+					"${"+token.name+"}", value,
+					"$"+token.name, value,
+				)
+				expanded = append(expanded, replacer.Replace(path))
+			}
+		}
+		paths = expanded
+	}
+
+	return paths
+}
+
+// cutOrigin returns the given path without leading $ORIGIN or ${ORIGIN}
+// token and if it has been found.
+func cutOrigin(path string) (string, bool) {
+	for _, token := range []string{"${ORIGIN}", "$ORIGIN"} {
+		if strings.HasPrefix(path, token) {
+			return "." + strings.TrimPrefix(path, token), true
+		}
+	}
+	return path, false
+}
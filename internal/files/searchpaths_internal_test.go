@@ -0,0 +1,101 @@
+package files
+
+import (
+	"debug/elf"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandDST(t *testing.T) {
+	x86_64 := elf.FileHeader{
+		Class:   elf.ELFCLASS64,
+		Data:    elf.ELFDATA2LSB,
+		Machine: elf.EM_X86_64,
+	}
+	s390x := elf.FileHeader{
+		Class:   elf.ELFCLASS64,
+		Data:    elf.ELFDATA2MSB,
+		Machine: elf.EM_S390,
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		header   elf.FileHeader
+		expected []string
+	}{
+		{
+			name:     "no tokens",
+			path:     "/opt/lib",
+			header:   x86_64,
+			expected: []string{"/opt/lib"},
+		},
+		{
+			name:     "origin",
+			path:     "$ORIGIN/../lib",
+			header:   x86_64,
+			expected: []string{"$ORIGIN/../lib"},
+		},
+		{
+			name:   "lib",
+			path:   "/usr/$LIB/app",
+			header: x86_64,
+			expected: []string{
+				"/usr/lib/x86_64-linux-gnu/app",
+				"/usr/lib64/app",
+				"/usr/lib/app",
+			},
+		},
+		{
+			name:     "platform in braces",
+			path:     "/opt/${PLATFORM}/lib",
+			header:   x86_64,
+			expected: []string{"/opt/x86_64/lib"},
+		},
+		{
+			name:     "unknown platform",
+			path:     "/opt/$PLATFORM/lib",
+			header:   s390x,
+			expected: nil,
+		},
+		{
+			name:   "multiple",
+			path:   "${ORIGIN}/$PLATFORM/$LIB",
+			header: x86_64,
+			expected: []string{
+				"${ORIGIN}/x86_64/lib/x86_64-linux-gnu",
+				"${ORIGIN}/x86_64/lib64",
+				"${ORIGIN}/x86_64/lib",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, expandDST(tt.path, tt.header))
+		})
+	}
+}
+
+func TestCutOrigin(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+		isOrigin bool
+	}{
+		{path: "$ORIGIN/../lib", expected: "./../lib", isOrigin: true},
+		{path: "${ORIGIN}", expected: ".", isOrigin: true},
+		{path: "/opt/$ORIGIN", expected: "/opt/$ORIGIN"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.path, func(t *testing.T) {
+			path, isOrigin := cutOrigin(tt.path)
+			assert.Equal(t, tt.expected, path)
+			assert.Equal(t, tt.isOrigin, isOrigin)
+		})
+	}
+}
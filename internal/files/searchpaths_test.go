@@ -0,0 +1,133 @@
+package files_test
+
+import (
+	"debug/elf"
+	"testing"
+
+	"github.com/aibor/initramfs/internal/files"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultSearchPaths(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   elf.FileHeader
+		expected []string
+	}{
+		{
+			name: "x86_64",
+			header: elf.FileHeader{
+				Class:   elf.ELFCLASS64,
+				Data:    elf.ELFDATA2LSB,
+				Machine: elf.EM_X86_64,
+			},
+			expected: []string{
+				"/lib/x86_64-linux-gnu",
+				"/usr/lib/x86_64-linux-gnu",
+				"/lib64",
+				"/usr/lib64",
+				"/lib",
+				"/usr/lib",
+			},
+		},
+		{
+			name: "aarch64",
+			header: elf.FileHeader{
+				Class:   elf.ELFCLASS64,
+				Data:    elf.ELFDATA2LSB,
+				Machine: elf.EM_AARCH64,
+			},
+			expected: []string{
+				"/lib/aarch64-linux-gnu",
+				"/usr/lib/aarch64-linux-gnu",
+				"/lib64",
+				"/usr/lib64",
+				"/lib",
+				"/usr/lib",
+			},
+		},
+		{
+			name: "riscv64",
+			header: elf.FileHeader{
+				Class:   elf.ELFCLASS64,
+				Data:    elf.ELFDATA2LSB,
+				Machine: elf.EM_RISCV,
+			},
+			expected: []string{
+				"/lib/riscv64-linux-gnu",
+				"/usr/lib/riscv64-linux-gnu",
+				"/lib64",
+				"/usr/lib64",
+				"/lib",
+				"/usr/lib",
+			},
+		},
+		{
+			name: "ppc64 big endian",
+			header: elf.FileHeader{
+				Class:   elf.ELFCLASS64,
+				Data:    elf.ELFDATA2MSB,
+				Machine: elf.EM_PPC64,
+			},
+			expected: []string{
+				"/lib/powerpc64-linux-gnu",
+				"/usr/lib/powerpc64-linux-gnu",
+				"/lib64",
+				"/usr/lib64",
+				"/lib",
+				"/usr/lib",
+			},
+		},
+		{
+			name: "arm",
+			header: elf.FileHeader{
+				Class:   elf.ELFCLASS32,
+				Data:    elf.ELFDATA2LSB,
+				Machine: elf.EM_ARM,
+			},
+			expected: []string{
+				"/lib/arm-linux-gnueabihf",
+				"/usr/lib/arm-linux-gnueabihf",
+				"/lib/arm-linux-gnueabi",
+				"/usr/lib/arm-linux-gnueabi",
+				"/lib",
+				"/usr/lib",
+			},
+		},
+		{
+			name: "x32",
+			header: elf.FileHeader{
+				Class:   elf.ELFCLASS32,
+				Data:    elf.ELFDATA2LSB,
+				Machine: elf.EM_X86_64,
+			},
+			expected: []string{
+				"/lib/x86_64-linux-gnux32",
+				"/usr/lib/x86_64-linux-gnux32",
+				"/libx32",
+				"/usr/libx32",
+				"/lib",
+				"/usr/lib",
+			},
+		},
+		{
+			name: "unknown",
+			header: elf.FileHeader{
+				Class:   elf.ELFCLASS32,
+				Data:    elf.ELFDATA2LSB,
+				Machine: elf.EM_68K,
+			},
+			expected: []string{
+				"/lib",
+				"/usr/lib",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, files.DefaultSearchPaths(tt.header))
+		})
+	}
+}
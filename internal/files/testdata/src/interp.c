@@ -0,0 +1 @@
+int interp() { return 0; }
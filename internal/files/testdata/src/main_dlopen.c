@@ -0,0 +1,4 @@
+#include "defs.h"
+
+// func3 is loaded at runtime, see dlopen.S.
+int main() { return func2(); }
@@ -83,8 +83,9 @@ func (t *Tree) Ln(target string, path string) error {
 type WalkFunc func(path string, entry *Entry) error
 
 // Walk walks the tree recursively, starting at the root, and runs the given
-// function for each entry. If the function returns an error, the recursion is
-// terminated immediately and the error is returned.
+// function for each entry. Entries are visited in lexical order, so the
+// order is deterministic for equal trees. If the function returns an error,
+// the recursion is terminated immediately and the error is returned.
 func (f *Tree) Walk(fn WalkFunc) error {
 	return f.GetRoot().walk(string(filepath.Separator), fn)
 }
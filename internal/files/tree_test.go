@@ -161,3 +161,36 @@ func TestTreeLn(t *testing.T) {
 		assert.Error(t, err)
 	})
 }
+
+func TestTreeWalk(t *testing.T) {
+	tree := Tree{}
+	for _, dir := range []string{"b/d", "a", "b/c"} {
+		_, err := tree.Mkdir(dir)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.Ln("target", "/0"))
+
+	t.Run("lexical order", func(t *testing.T) {
+		var paths []string
+		err := tree.Walk(func(path string, entry *Entry) error {
+			paths = append(paths, path)
+			return nil
+		})
+		require.NoError(t, err)
+		expected := []string{"/0", "/a", "/b", "/b/c", "/b/d"}
+		assert.Equal(t, expected, paths)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		var paths []string
+		err := tree.Walk(func(path string, entry *Entry) error {
+			paths = append(paths, path)
+			if path == "/b/c" {
+				return assert.AnError
+			}
+			return nil
+		})
+		assert.ErrorIs(t, err, assert.AnError)
+		assert.Equal(t, []string{"/0", "/a", "/b", "/b/c"}, paths)
+	})
+}
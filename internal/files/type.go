@@ -11,4 +11,14 @@ const (
 	TypeDirectory
 	// A symbolic link in the archive.
 	TypeLink
+	// A character device node with major and minor device number.
+	TypeCharDevice
+	// A block device node with major and minor device number.
+	TypeBlockDevice
+	// A named pipe.
+	TypeFIFO
+	// A unix domain socket file.
+	TypeSocket
+	// A hard link to a regular file in the same tree.
+	TypeHardLink
 )
@@ -0,0 +1,296 @@
+package initramfs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aibor/initramfs/internal/files"
+)
+
+// ConflictPolicy defines how [Archive.Merge] handles paths present in both
+// archives.
+type ConflictPolicy int
+
+const (
+	// ConflictError fails the merge.
+	ConflictError ConflictPolicy = iota
+	// ConflictKeep keeps the entry of the archive merged into.
+	ConflictKeep
+	// ConflictReplace replaces the entry with the one of the merged archive.
+	ConflictReplace
+)
+
+var conflictPolicyNames = map[ConflictPolicy]string{
+	ConflictError:   "error",
+	ConflictKeep:    "keep",
+	ConflictReplace: "replace",
+}
+
+// ParseConflictPolicy returns the [ConflictPolicy] for the given name. Valid
+// names are "error", "keep" and "replace".
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	for policy, policyName := range conflictPolicyNames {
+		if strings.EqualFold(name, policyName) {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown conflict policy: %s", name)
+}
+
+// String returns the name of the [ConflictPolicy].
+func (p ConflictPolicy) String() string {
+	if name, exists := conflictPolicyNames[p]; exists {
+		return name
+	}
+	return fmt.Sprintf("ConflictPolicy(%d)", int(p))
+}
+
+// NewFromImage creates a new [Archive] with all entries of the given [Image],
+// like for adding files on top of an existing image. The content of regular
+// files is read from the image when the archive is written. Mode, owner and
+// modification time of regular files are preserved, as well as hard links.
+// Additional source files are read from the host's file system.
+func NewFromImage(img *Image) (*Archive, error) {
+	return NewFromImageWithFS(img, files.DirFS("/"))
+}
+
+// NewFromImageWithFS creates a new [Archive] with all entries of the given
+// [Image], see [NewFromImage]. Additional source files are read from the
+// given file system, see [NewWithFS].
+func NewFromImageWithFS(img *Image, fsys fs.FS) (*Archive, error) {
+	a := &Archive{sourceFS: fsys}
+
+	imgEntries := img.Entries()
+	// Parents sort before their children.
+	sort.Slice(imgEntries, func(i, j int) bool {
+		return imgEntries[i].Path < imgEntries[j].Path
+	})
+
+	hardLinks := make(map[hardLinkID]string)
+	for _, imgEntry := range imgEntries {
+		if imgEntry.Path == "/" {
+			continue
+		}
+		entry := &files.Entry{
+			Owner: &files.Owner{UID: imgEntry.UID, GID: imgEntry.GID},
+		}
+		entry.SetMode(imgEntry.Mode & modeMask)
+		switch imgEntry.Mode.Type() {
+		case fs.ModeDir:
+			entry.Type = files.TypeDirectory
+		case fs.ModeSymlink:
+			entry.Type = files.TypeLink
+			entry.RelatedPath = imgEntry.LinkTarget
+			entry.Mode = nil
+		case fs.ModeDevice:
+			entry.Type = files.TypeBlockDevice
+			entry.Major, entry.Minor = imgEntry.Major, imgEntry.Minor
+		case fs.ModeDevice | fs.ModeCharDevice:
+			entry.Type = files.TypeCharDevice
+			entry.Major, entry.Minor = imgEntry.Major, imgEntry.Minor
+		case fs.ModeNamedPipe:
+			entry.Type = files.TypeFIFO
+		case fs.ModeSocket:
+			entry.Type = files.TypeSocket
+		default:
+			if imgEntry.NLink > 1 {
+				if target, exists := hardLinks[imgEntry.linkID]; exists {
+					entry = &files.Entry{Type: files.TypeHardLink, RelatedPath: target}
+					break
+				}
+				hardLinks[imgEntry.linkID] = imgEntry.Path
+			}
+			entry.Type = files.TypeRegular
+			name, size := fsPath(imgEntry.Path), imgEntry.Size
+			entry.Content = func() (io.ReadCloser, int64, error) {
+				file, err := img.Open(name)
+				if err != nil {
+					return nil, 0, err
+				}
+				return file, size, nil
+			}
+		}
+
+		dir, name := filepath.Split(imgEntry.Path)
+		dirEntry, err := a.fileTree.GetEntry(dir)
+		if err != nil {
+			return nil, fmt.Errorf("add %s: %v", imgEntry.Path, err)
+		}
+		if _, err := dirEntry.AddEntry(name, entry); err != nil {
+			return nil, fmt.Errorf("add %s: %v", imgEntry.Path, err)
+		}
+	}
+
+	return a, nil
+}
+
+// hardLinkFix is a hard link entry that must link to the given target entry.
+// If the target has been replaced by a merge, the hard link becomes a copy of
+// the target.
+type hardLinkFix struct {
+	link   *files.Entry
+	target *files.Entry
+}
+
+// Merge adds all entries of the other [Archive] to the [Archive]. Entries
+// present in both archives are handled according to the given
+// [ConflictPolicy], except for directories, which are merged recursively.
+// With [ConflictReplace], explicit modes and owners of directories of the
+// other archive replace the ones of the archive.
+//
+// Regular files of the other archive are read from its source file system
+// when the archive is written. Hard links whose target has not been merged
+// become copies of the target. Libraries should be resolved with
+// [Archive.ResolveLinkedLibs] before merging, as merged files are not
+// resolved.
+func (a *Archive) Merge(other *Archive, policy ConflictPolicy) error {
+	if _, exists := conflictPolicyNames[policy]; !exists {
+		return fmt.Errorf("unknown conflict policy: %s", policy)
+	}
+
+	// Check for conflicts first, so the archive is not modified on error.
+	if policy == ConflictError {
+		err := other.fileTree.Walk(func(path string, otherEntry *files.Entry) error {
+			existing, err := a.fileTree.GetEntry(path)
+			if err != nil || existing.IsDir() && otherEntry.IsDir() {
+				return nil
+			}
+			return fmt.Errorf("merge %s: %v", path, files.ErrEntryExists)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var fixes []hardLinkFix
+	err := a.fileTree.Walk(func(path string, entry *files.Entry) error {
+		if entry.Type != files.TypeHardLink {
+			return nil
+		}
+		target, err := a.fileTree.GetEntry(entry.RelatedPath)
+		if err != nil {
+			return fmt.Errorf("hard link %s: get target: %v", path, err)
+		}
+		fixes = append(fixes, hardLinkFix{link: entry, target: target})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var (
+		copies   = make(map[*files.Entry]*files.Entry)
+		skipped  []string
+		sourceFS = &mergedFS{other.sourceFS}
+	)
+	copyEntry := func(entry *files.Entry) *files.Entry {
+		if entryCopy, exists := copies[entry]; exists {
+			return entryCopy
+		}
+		entryCopy := cloneEntry(entry, sourceFS)
+		copies[entry] = entryCopy
+		return entryCopy
+	}
+
+	err = other.fileTree.Walk(func(path string, otherEntry *files.Entry) error {
+		for _, prefix := range skipped {
+			if strings.HasPrefix(path, prefix+string(filepath.Separator)) {
+				return nil
+			}
+		}
+
+		entryCopy := copyEntry(otherEntry)
+		if otherEntry.Type == files.TypeHardLink {
+			target, err := other.fileTree.GetEntry(otherEntry.RelatedPath)
+			if err != nil {
+				return fmt.Errorf("hard link %s: get target: %v", path, err)
+			}
+			fixes = append(fixes, hardLinkFix{link: entryCopy, target: copyEntry(target)})
+		}
+
+		dir, name := filepath.Split(path)
+		dirEntry, err := a.fileTree.GetEntry(dir)
+		if err != nil {
+			return fmt.Errorf("merge %s: %v", path, err)
+		}
+		existing, err := dirEntry.GetEntry(name)
+		if err == files.ErrEntryNotExists {
+			_, err = dirEntry.AddEntry(name, entryCopy)
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("merge %s: %v", path, err)
+		}
+
+		if existing.IsDir() && otherEntry.IsDir() {
+			if policy == ConflictReplace {
+				if otherEntry.Mode != nil {
+					existing.SetMode(*otherEntry.Mode)
+				}
+				if otherEntry.Owner != nil {
+					existing.Owner = entryCopy.Owner
+				}
+			}
+			return nil
+		}
+
+		if policy == ConflictKeep {
+			skipped = append(skipped, path)
+			return nil
+		}
+		if err := dirEntry.RemoveEntry(name); err != nil {
+			return fmt.Errorf("merge %s: %v", path, err)
+		}
+		_, err = dirEntry.AddEntry(name, entryCopy)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, fix := range fixes {
+		target, err := a.fileTree.GetEntry(fix.link.RelatedPath)
+		if err != nil || target != fix.target {
+			*fix.link = *fix.target
+		}
+	}
+
+	a.dependencies = append(a.dependencies, other.dependencies...)
+	return nil
+}
+
+// mergedFS is the source file system of a merged [Archive]. Entries refer to
+// it by pointer, as file systems, like [fstest.MapFS], are not necessarily
+// comparable.
+type mergedFS struct {
+	fs.FS
+}
+
+// cloneEntry returns a copy of the given entry without children. The source
+// file of regular files is read from the given file system, unless the entry
+// has its own already.
+func cloneEntry(entry *files.Entry, sourceFS fs.FS) *files.Entry {
+	entryCopy := &files.Entry{
+		Type:        entry.Type,
+		RelatedPath: entry.RelatedPath,
+		Content:     entry.Content,
+		SourceFS:    entry.SourceFS,
+		Major:       entry.Major,
+		Minor:       entry.Minor,
+	}
+	if entry.Mode != nil {
+		entryCopy.SetMode(*entry.Mode)
+	}
+	if entry.Owner != nil {
+		owner := *entry.Owner
+		entryCopy.Owner = &owner
+	}
+	if entry.Type == files.TypeRegular && entry.Content == nil && entry.SourceFS == nil {
+		entryCopy.SourceFS = sourceFS
+	}
+	return entryCopy
+}
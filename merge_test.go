@@ -0,0 +1,218 @@
+package initramfs
+
+import (
+	"bytes"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConflictPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected ConflictPolicy
+		errMsg   string
+	}{
+		{name: "error", expected: ConflictError},
+		{name: "Keep", expected: ConflictKeep},
+		{name: "replace", expected: ConflictReplace},
+		{name: "merge", errMsg: "unknown conflict policy: merge"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := ParseConflictPolicy(tt.name)
+			if tt.errMsg != "" {
+				assert.ErrorContains(t, err, tt.errMsg)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, policy)
+		})
+	}
+}
+
+func TestNewFromImage(t *testing.T) {
+	img, err := ReadImage(bytes.NewReader(buildImage(t, WithCompression(CompressionGzip))))
+	require.NoError(t, err)
+
+	testFS := fstest.MapFS{
+		"test": &fstest.MapFile{Data: []byte("test"), Mode: 0755, ModTime: time.Unix(10, 0)},
+	}
+	a, err := NewFromImageWithFS(img, testFS)
+	require.NoError(t, err)
+	require.NoError(t, a.AddFileAt("/bin/test", "/test"))
+
+	var b bytes.Buffer
+	require.NoError(t, a.WriteCPIO(&b))
+	written, err := ReadImage(&b)
+	require.NoError(t, err)
+
+	changes := DiffImages(img, written)
+	require.Len(t, changes, 1)
+	assert.Equal(t, ImageChange{Path: "/bin/test", Kind: ChangeAdded, New: changes[0].New}, changes[0])
+
+	for _, name := range []string{"init", "bin/sh"} {
+		info, err := written.Stat(name)
+		require.NoError(t, err)
+		entry := info.Sys().(*ImageEntry)
+		assert.EqualValues(t, 2, entry.NLink, "hard link %s", name)
+		assert.Equal(t, time.Unix(0, 0), info.ModTime(), name)
+	}
+	info, err := written.Stat("bin/test")
+	require.NoError(t, err)
+	assert.Equal(t, fs.FileMode(0755), info.Mode())
+	assert.Equal(t, time.Unix(10, 0), info.ModTime())
+}
+
+func TestArchiveMerge(t *testing.T) {
+	baseFS := fstest.MapFS{
+		"init":     &fstest.MapFile{Data: []byte("base init"), Mode: 0755},
+		"busybox":  &fstest.MapFile{Data: []byte("busybox"), Mode: 0755},
+		"hostname": &fstest.MapFile{Data: []byte("base")},
+	}
+	overlayFS := fstest.MapFS{
+		"init":   &fstest.MapFile{Data: []byte("overlay init"), Mode: 0700},
+		"test":   &fstest.MapFile{Data: []byte("test"), Mode: 0755},
+		"config": &fstest.MapFile{Data: []byte("config")},
+	}
+
+	newBase := func(t *testing.T) *Archive {
+		t.Helper()
+		a := NewWithFS(baseFS, "/init")
+		require.NoError(t, a.AddFileAt("/bin/busybox", "/busybox"))
+		require.NoError(t, a.AddHardLink("/bin/sh", "/bin/busybox"))
+		require.NoError(t, a.AddFileAt("/etc/hostname", "/hostname"))
+		require.NoError(t, a.AddFileAt("/etc/conf", "/hostname"))
+		return a
+	}
+	newOverlay := func(t *testing.T) *Archive {
+		t.Helper()
+		a := NewWithFS(overlayFS, "/init")
+		require.NoError(t, a.AddFileAt("/bin/test", "/test"))
+		// Replaces the hard link target of the base archive.
+		require.NoError(t, a.AddFileAt("/bin/busybox", "/test"))
+		// Replaces a file by a directory.
+		require.NoError(t, a.AddFileAt("/etc/conf/config", "/config"))
+		require.NoError(t, a.AddHardLink("/etc/conf/link", "/etc/conf/config"))
+		require.NoError(t, a.SetOwner("/etc", 1, 1))
+		return a
+	}
+	write := func(t *testing.T, a *Archive) *Image {
+		t.Helper()
+		var b bytes.Buffer
+		require.NoError(t, a.WriteCPIO(&b))
+		img, err := ReadImage(&b)
+		require.NoError(t, err)
+		return img
+	}
+
+	t.Run("replace", func(t *testing.T) {
+		a := newBase(t)
+		require.NoError(t, a.Merge(newOverlay(t), ConflictReplace))
+		img := write(t, a)
+
+		expected := map[string]string{
+			"init":            "overlay init",
+			"bin/busybox":     "test",
+			"bin/sh":          "busybox",
+			"bin/test":        "test",
+			"etc/hostname":    "base",
+			"etc/conf/config": "config",
+			"etc/conf/link":   "config",
+		}
+		for name, content := range expected {
+			actual, err := fs.ReadFile(img, name)
+			require.NoError(t, err, name)
+			assert.Equal(t, content, string(actual), name)
+		}
+		info, err := img.Stat("init")
+		require.NoError(t, err)
+		assert.Equal(t, fs.FileMode(0700), info.Mode())
+		info, err = img.Stat("etc")
+		require.NoError(t, err)
+		assert.Equal(t, 1, info.Sys().(*ImageEntry).UID)
+		info, err = img.Stat("etc/conf/link")
+		require.NoError(t, err)
+		assert.EqualValues(t, 2, info.Sys().(*ImageEntry).NLink)
+		// Merged files with the same source file are hard links.
+		info, err = img.Stat("bin/test")
+		require.NoError(t, err)
+		assert.EqualValues(t, 2, info.Sys().(*ImageEntry).NLink)
+	})
+
+	t.Run("keep", func(t *testing.T) {
+		a := newBase(t)
+		require.NoError(t, a.Merge(newOverlay(t), ConflictKeep))
+		img := write(t, a)
+
+		expected := map[string]string{
+			"init":         "base init",
+			"bin/busybox":  "busybox",
+			"bin/sh":       "busybox",
+			"bin/test":     "test",
+			"etc/conf":     "base",
+			"etc/hostname": "base",
+		}
+		for name, content := range expected {
+			actual, err := fs.ReadFile(img, name)
+			require.NoError(t, err, name)
+			assert.Equal(t, content, string(actual), name)
+		}
+		info, err := img.Stat("bin/sh")
+		require.NoError(t, err)
+		assert.EqualValues(t, 2, info.Sys().(*ImageEntry).NLink)
+		info, err = img.Stat("etc")
+		require.NoError(t, err)
+		assert.Equal(t, 0, info.Sys().(*ImageEntry).UID)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		a := newBase(t)
+		err := a.Merge(newOverlay(t), ConflictError)
+		assert.ErrorContains(t, err, "merge /bin/busybox: entry exists")
+		_, err = a.fileTree.GetEntry("/bin/test")
+		assert.Error(t, err, "archive not modified")
+	})
+
+	t.Run("no conflicts", func(t *testing.T) {
+		a := newBase(t)
+		other := NewSegmentWithFS(overlayFS)
+		require.NoError(t, other.AddFileAt("/bin/test", "/test"))
+		require.NoError(t, a.Merge(other, ConflictError))
+		actual, err := fs.ReadFile(write(t, a), "bin/test")
+		require.NoError(t, err)
+		assert.Equal(t, "test", string(actual))
+	})
+
+	t.Run("same source path", func(t *testing.T) {
+		a := newBase(t)
+		other := NewSegmentWithFS(overlayFS)
+		require.NoError(t, other.AddFileAt("/sbin/init", "/init"))
+		require.NoError(t, a.Merge(other, ConflictError))
+		img := write(t, a)
+
+		expected := map[string]string{
+			"init":      "base init",
+			"sbin/init": "overlay init",
+		}
+		for name, content := range expected {
+			actual, err := fs.ReadFile(img, name)
+			require.NoError(t, err, name)
+			assert.Equal(t, content, string(actual), name)
+			info, err := img.Stat(name)
+			require.NoError(t, err, name)
+			assert.EqualValues(t, 1, info.Sys().(*ImageEntry).NLink, name)
+		}
+	})
+
+	t.Run("unknown policy", func(t *testing.T) {
+		err := newBase(t).Merge(newOverlay(t), ConflictPolicy(42))
+		assert.ErrorContains(t, err, "unknown conflict policy: ConflictPolicy(42)")
+	})
+}
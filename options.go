@@ -0,0 +1,179 @@
+package initramfs
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aibor/initramfs/internal/archive"
+	"github.com/aibor/initramfs/internal/files"
+)
+
+// SourceDateEpochEnv is the environment variable that is used for the
+// modification time of all entries of reproducible archives.
+// See https://reproducible-builds.org/specs/source-date-epoch/.
+const SourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+// Compression defines the compression algorithm applied to the written
+// archive. All supported algorithms can be decompressed by the Linux kernel,
+// given it has been built with support for it.
+type Compression = archive.Compression
+
+const (
+	// CompressionNone writes the archive uncompressed.
+	CompressionNone = archive.CompressionNone
+	// CompressionGzip compresses with gzip.
+	CompressionGzip = archive.CompressionGzip
+	// CompressionZstd compresses with zstd.
+	CompressionZstd = archive.CompressionZstd
+	// CompressionXZ compresses with xz using CRC32 checksums.
+	CompressionXZ = archive.CompressionXZ
+	// CompressionLZ4 compresses with lz4 using the legacy frame format.
+	CompressionLZ4 = archive.CompressionLZ4
+)
+
+// ParseCompression returns the [Compression] for the given name. Valid names
+// are "none", "gzip", "zstd", "xz" and "lz4".
+func ParseCompression(name string) (Compression, error) {
+	return archive.ParseCompression(name)
+}
+
+// WriteOption modifies how an [Archive] is written by [Archive.WriteCPIO].
+type WriteOption func(*writeOptions)
+
+type writeOptions struct {
+	compression  Compression
+	reproducible bool
+}
+
+// WithCompression compresses the written archive with the given
+// [Compression]. Default is [CompressionNone].
+func WithCompression(compression Compression) WriteOption {
+	return func(o *writeOptions) {
+		o.compression = compression
+	}
+}
+
+// WithReproducible writes the archive in a deterministic way, so archives
+// built from the same input are byte-identical. Entries are always written in
+// lexical order with sequential inode numbers and without host specific
+// owners and device numbers. With this option, also the modification time of
+// all entries is set to the value of [SourceDateEpochEnv], or the Unix epoch if
+// it is not set.
+func WithReproducible() WriteOption {
+	return func(o *writeOptions) {
+		o.reproducible = true
+	}
+}
+
+// ResolveOption modifies how linked libraries are resolved by
+// [Archive.ResolveLinkedLibs].
+type ResolveOption func(*resolveOptions)
+
+type resolveOptions struct {
+	sysroot        string
+	ldConfig       bool
+	dlopenPriority string
+	hints          map[string][]string
+	keepGoing      bool
+	allowMissing   []string
+	scripts        bool
+}
+
+// WithSysroot resolves linked libraries inside the given directory of the
+// source file system instead of its root, like a sysroot used for building
+// images for another architecture. Library search paths and absolute symbolic
+// links are resolved relative to the directory. The files the libraries are
+// resolved for may still be outside of it.
+func WithSysroot(dir string) ResolveOption {
+	return func(o *resolveOptions) {
+		o.sysroot = dir
+	}
+}
+
+// WithLDConfig looks up linked libraries like the dynamic linker of the
+// source file system, or the sysroot if set, does: in the libraries listed in
+// "/etc/ld.so.cache" and in the directories listed in "/etc/ld.so.conf",
+// including files it includes. They are looked up before the default search
+// paths. Missing files are ignored.
+func WithLDConfig() ResolveOption {
+	return func(o *resolveOptions) {
+		o.ldConfig = true
+	}
+}
+
+// WithKeepGoing continues resolving, if libraries can not be resolved, and
+// adds all libraries that can be resolved. All unresolved libraries are
+// returned as [UnresolvedLibsError] afterwards.
+func WithKeepGoing() ResolveOption {
+	return func(o *resolveOptions) {
+		o.keepGoing = true
+	}
+}
+
+// WithAllowMissing allows libraries and program interpreters matching any of
+// the given patterns to be missing, like "linux-vdso.so.1". The patterns have
+// the syntax of [path.Match] and match the required name or its base name.
+func WithAllowMissing(patterns ...string) ResolveOption {
+	return func(o *resolveOptions) {
+		o.allowMissing = append(o.allowMissing, patterns...)
+	}
+}
+
+// WithScripts resolves the interpreters of scripts, given by their shebang
+// line like "#!/bin/sh". The interpreter is added at its exact path with its
+// linked libraries, unless the path is present in the [Archive] already.
+// Interpreters that are scripts themselves are resolved recursively. Programs
+// run by "/usr/bin/env" are not resolved.
+func WithScripts() ResolveOption {
+	return func(o *resolveOptions) {
+		o.scripts = true
+	}
+}
+
+// DLOpen priorities of libraries listed in .note.dlopen notes, see
+// [WithDLOpen].
+const (
+	DLOpenRequired    = files.DLOpenRequired
+	DLOpenRecommended = files.DLOpenRecommended
+	DLOpenSuggested   = files.DLOpenSuggested
+)
+
+// WithDLOpen resolves libraries loaded at runtime with dlopen as listed in
+// the .note.dlopen notes of the ELF files, as specified by
+// https://systemd.io/ELF_DLOPEN_METADATA/. Only entries with at least the
+// given priority are resolved: [DLOpenRequired], [DLOpenRecommended] or
+// [DLOpenSuggested]. Entries that can not be resolved are an error only, if
+// they are required. Notes that can not be parsed do not abort resolving,
+// they are returned as [UnresolvedLibsError] once all libraries are added.
+func WithDLOpen(priority string) ResolveOption {
+	return func(o *resolveOptions) {
+		o.dlopenPriority = priority
+	}
+}
+
+// WithHints resolves additional libraries for ELF files, like the libraries
+// they load at runtime with dlopen, such as NSS or PAM modules. The keys are
+// source paths of ELF files, including resolved libraries, or their base
+// names, like "libc.so.6". The values are library names that are looked up
+// like the DT_NEEDED entries of the file, or paths. They must be found.
+func WithHints(hints map[string][]string) ResolveOption {
+	return func(o *resolveOptions) {
+		o.hints = hints
+	}
+}
+
+// sourceDateEpoch returns the time set by [SourceDateEpochEnv]. If the
+// variable is not set, the Unix epoch is returned.
+func sourceDateEpoch() (time.Time, error) {
+	value := os.Getenv(SourceDateEpochEnv)
+	if value == "" {
+		return time.Unix(0, 0), nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return time.Time{}, fmt.Errorf("invalid %s: %s", SourceDateEpochEnv, value)
+	}
+	return time.Unix(seconds, 0), nil
+}
@@ -0,0 +1,18 @@
+package initramfs
+
+import (
+	"io/fs"
+	"syscall"
+
+	"github.com/aibor/initramfs/internal/archive"
+)
+
+// fileOwner returns the owner of the file described by the given
+// [fs.FileInfo]. Root is returned if the owner can not be determined.
+func fileOwner(info fs.FileInfo) archive.Owner {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return archive.Owner{}
+	}
+	return archive.Owner{UID: int(stat.Uid), GID: int(stat.Gid)}
+}
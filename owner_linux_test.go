@@ -0,0 +1,60 @@
+package initramfs
+
+import (
+	"syscall"
+	"testing"
+	"testing/fstest"
+
+	"github.com/aibor/initramfs/internal/archive"
+	"github.com/aibor/initramfs/internal/files"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveWriteToSourceOwner(t *testing.T) {
+	testFS := fstest.MapFS{
+		"input": &fstest.MapFile{Sys: &syscall.Stat_t{Uid: 1000, Gid: 100}},
+	}
+
+	tests := []struct {
+		name     string
+		owner    *files.Owner
+		options  writeOptions
+		expected archive.Owner
+	}{
+		{
+			name:     "source owner",
+			expected: archive.Owner{UID: 1000, GID: 100},
+		},
+		{
+			name:     "explicit owner",
+			owner:    &files.Owner{UID: 1, GID: 2},
+			expected: archive.Owner{UID: 1, GID: 2},
+		},
+		{
+			name:     "reproducible",
+			options:  writeOptions{reproducible: true},
+			expected: archive.Owner{},
+		},
+		{
+			name:     "reproducible with explicit owner",
+			owner:    &files.Owner{UID: 1, GID: 2},
+			options:  writeOptions{reproducible: true},
+			expected: archive.Owner{UID: 1, GID: 2},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			a := Archive{sourceFS: testFS}
+			entry, err := a.fileTree.GetRoot().AddFile("init", "/input")
+			require.NoError(t, err)
+			entry.Owner = tt.owner
+
+			mock := archive.MockWriter{}
+			require.NoError(t, a.writeTo(&mock, tt.options))
+			assert.Equal(t, tt.expected, mock.Owner)
+		})
+	}
+}
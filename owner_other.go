@@ -0,0 +1,15 @@
+//go:build !linux
+
+package initramfs
+
+import (
+	"io/fs"
+
+	"github.com/aibor/initramfs/internal/archive"
+)
+
+// fileOwner returns root as owner, as it can not be determined on this
+// platform.
+func fileOwner(_ fs.FileInfo) archive.Owner {
+	return archive.Owner{}
+}
@@ -0,0 +1,189 @@
+package initramfs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/aibor/initramfs/internal/files"
+)
+
+const (
+	// MicrocodeDir is the directory of the early segment the kernel loads CPU
+	// microcode updates from on x86, see [Archive.AddMicrocode].
+	MicrocodeDir = "/kernel/x86/microcode"
+	// ACPITablesDir is the directory of the early segment the kernel loads
+	// ACPI table overrides from, see [Archive.AddACPITable].
+	ACPITablesDir = "/kernel/firmware/acpi"
+)
+
+// CPU vendors of microcode updates, see [Archive.AddMicrocode].
+const (
+	MicrocodeIntel = "GenuineIntel"
+	MicrocodeAMD   = "AuthenticAMD"
+)
+
+// earlyDirs are the directories the kernel reads from the first uncompressed
+// segment of an image, before the image is unpacked.
+var earlyDirs = []string{MicrocodeDir, ACPITablesDir}
+
+// archiveName returns the name the entry with the given path is written with.
+// Entries in [earlyDirs] and their parent directories are written without
+// leading "/", as the kernel finds them by name prefix, like
+// "kernel/x86/microcode/".
+func archiveName(path string) string {
+	for _, dir := range earlyDirs {
+		if path == dir || strings.HasPrefix(path, dir+"/") || strings.HasPrefix(dir, path+"/") {
+			return strings.TrimPrefix(path, "/")
+		}
+	}
+	return path
+}
+
+// NewSegment creates a new empty [Archive] without init file, like for
+// additional segments of an image written by [WriteImage]. All source files
+// are read from the host's file system.
+func NewSegment() *Archive {
+	return NewSegmentWithFS(files.DirFS("/"))
+}
+
+// NewSegmentWithFS creates a new empty [Archive] without init file, like for
+// additional segments of an image written by [WriteImage]. All source files
+// are read from the given file system, see [NewWithFS].
+func NewSegmentWithFS(fsys fs.FS) *Archive {
+	return &Archive{sourceFS: fsys}
+}
+
+// AddMicrocode adds the given microcode update files for the CPUs of the
+// given vendor, like [MicrocodeIntel] or [MicrocodeAMD], to [MicrocodeDir].
+// The kernel loads a single file per vendor, so multiple files are
+// concatenated. The archive must be the first segment of the image and must
+// not be compressed, see [WriteImage].
+func (a *Archive) AddMicrocode(vendor string, paths ...string) error {
+	if vendor == "" || strings.Contains(vendor, "/") {
+		return fmt.Errorf("invalid microcode vendor: %q", vendor)
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no microcode files given for %s", vendor)
+	}
+
+	archivePath := path.Join(MicrocodeDir, vendor+".bin")
+	if len(paths) == 1 {
+		return a.AddFileAt(archivePath, paths[0])
+	}
+	return a.AddContentFunc(archivePath, func() (io.ReadCloser, int64, error) {
+		return a.concatSources(paths)
+	}, FileMode)
+}
+
+// AddACPITable adds the given ACPI table file, usually with ".aml" suffix, to
+// [ACPITablesDir], so it overrides the table of the firmware with the same
+// signature. The archive must be the first segment of the image and must not
+// be compressed, see [WriteImage].
+func (a *Archive) AddACPITable(path string) error {
+	return a.AddFileAt(ACPITablesDir+"/", path)
+}
+
+// concatSources returns a reader for the concatenated content of the given
+// source files and the total size.
+func (a *Archive) concatSources(paths []string) (io.ReadCloser, int64, error) {
+	var (
+		readers []io.Reader
+		closers multiCloser
+		size    int64
+	)
+	for _, path := range paths {
+		file, err := a.sourceFS.Open(strings.TrimPrefix(path, "/"))
+		if err != nil {
+			_ = closers.Close()
+			return nil, 0, err
+		}
+		closers = append(closers, file)
+		info, err := file.Stat()
+		if err != nil {
+			_ = closers.Close()
+			return nil, 0, err
+		}
+		readers = append(readers, file)
+		size += info.Size()
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(readers...), closers}, size, nil
+}
+
+// multiCloser closes all its closers and returns the first error.
+type multiCloser []io.Closer
+
+func (c multiCloser) Close() error {
+	var firstErr error
+	for _, closer := range c {
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// ImagePart is an [Archive] written as segment of an image by [WriteImage]
+// with its own [WriteOption]s, like its [Compression].
+type ImagePart struct {
+	Archive *Archive
+	Options []WriteOption
+}
+
+// WriteImage writes an image consisting of the given parts as concatenated
+// CPIO archives, each written like by [Archive.WriteCPIO] with its own
+// options. The kernel unpacks them in order, so later entries replace earlier
+// ones. Each part but the last one is padded to a multiple of 4 bytes, so
+// the image can be decompressed by other tools if it has a single part.
+//
+// Parts with entries in [MicrocodeDir] or [ACPITablesDir], which the kernel
+// reads before unpacking the image, must be the first part and uncompressed.
+func WriteImage(writer io.Writer, parts ...ImagePart) error {
+	for idx, part := range parts {
+		var options writeOptions
+		for _, opt := range part.Options {
+			opt(&options)
+		}
+		for _, dir := range earlyDirs {
+			if _, err := part.Archive.fileTree.GetEntry(dir); err != nil {
+				continue
+			}
+			if idx > 0 || options.compression != CompressionNone {
+				return fmt.Errorf("part %d: %s must be in the first, uncompressed part", idx, dir)
+			}
+		}
+	}
+
+	counter := &countingWriter{w: writer}
+	for idx, part := range parts {
+		if err := part.Archive.WriteCPIO(counter, part.Options...); err != nil {
+			return fmt.Errorf("part %d: %v", idx, err)
+		}
+		if idx == len(parts)-1 {
+			break
+		}
+		if padding := (4 - counter.n%4) % 4; padding > 0 {
+			if _, err := counter.Write(make([]byte, padding)); err != nil {
+				return fmt.Errorf("part %d: write padding: %v", idx, err)
+			}
+		}
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written to the underlying [io.Writer].
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
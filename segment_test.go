@@ -0,0 +1,196 @@
+package initramfs
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os/exec"
+	"testing"
+	"testing/fstest"
+
+	"github.com/cavaliergopher/cpio"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteImage(t *testing.T) {
+	testFS := fstest.MapFS{
+		"init":              &fstest.MapFile{Data: []byte("init"), Mode: 0755},
+		"intel/06-55-04":    &fstest.MapFile{Data: []byte("intel1")},
+		"intel/06-8f-08":    &fstest.MapFile{Data: []byte("intel2")},
+		"amd/microcode.bin": &fstest.MapFile{Data: []byte("amd")},
+		"acpi/dsdt.aml":     &fstest.MapFile{Data: []byte("DSDT")},
+	}
+
+	early := NewSegmentWithFS(testFS)
+	require.NoError(t, early.AddMicrocode(MicrocodeIntel, "/intel/06-55-04", "/intel/06-8f-08"))
+	require.NoError(t, early.AddMicrocode(MicrocodeAMD, "/amd/microcode.bin"))
+	require.NoError(t, early.AddACPITable("/acpi/dsdt.aml"))
+	main := NewWithFS(testFS, "/init")
+
+	var b bytes.Buffer
+	err := WriteImage(&b,
+		ImagePart{Archive: early},
+		ImagePart{Archive: main, Options: []WriteOption{WithCompression(CompressionGzip)}},
+	)
+	require.NoError(t, err)
+
+	img, err := ReadImage(&b)
+	require.NoError(t, err)
+	segments := img.Segments()
+	require.Len(t, segments, 2)
+	assert.Equal(t, CompressionNone, segments[0].Compression)
+	assert.Zero(t, segments[0].Offset)
+	assert.Equal(t, CompressionGzip, segments[1].Compression)
+	assert.Zero(t, segments[1].Offset%4)
+
+	expected := map[string]string{
+		"kernel/x86/microcode/GenuineIntel.bin": "intel1intel2",
+		"kernel/x86/microcode/AuthenticAMD.bin": "amd",
+		"kernel/firmware/acpi/dsdt.aml":         "DSDT",
+		"init":                                  "init",
+	}
+	for name, content := range expected {
+		actual, err := fs.ReadFile(img, name)
+		require.NoError(t, err, name)
+		assert.Equal(t, content, string(actual), name)
+	}
+	info, err := img.Stat("kernel/x86/microcode/GenuineIntel.bin")
+	require.NoError(t, err)
+	assert.Equal(t, 0, info.Sys().(*ImageEntry).Segment)
+}
+
+func TestWriteImageEarlyNames(t *testing.T) {
+	testFS := fstest.MapFS{
+		"init":     &fstest.MapFile{Data: []byte("init")},
+		"ucode":    &fstest.MapFile{Data: []byte("ucode")},
+		"dsdt.aml": &fstest.MapFile{Data: []byte("DSDT")},
+	}
+	early := NewSegmentWithFS(testFS)
+	require.NoError(t, early.AddMicrocode(MicrocodeIntel, "/ucode"))
+	require.NoError(t, early.AddACPITable("/dsdt.aml"))
+	require.NoError(t, early.AddFileAt("/etc/ucode", "/ucode"))
+	main := NewWithFS(testFS, "/init")
+
+	var b bytes.Buffer
+	err := WriteImage(&b,
+		ImagePart{Archive: early},
+		ImagePart{Archive: main, Options: []WriteOption{WithCompression(CompressionGzip)}},
+	)
+	require.NoError(t, err)
+
+	// The kernel matches the names of the raw headers of the first segment.
+	var names []string
+	reader := cpio.NewReader(&b)
+	for {
+		hdr, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+
+	expected := []string{
+		"/etc",
+		"kernel",
+		"kernel/firmware",
+		"kernel/firmware/acpi",
+		"kernel/firmware/acpi/dsdt.aml",
+		"kernel/x86",
+		"kernel/x86/microcode",
+		"kernel/x86/microcode/GenuineIntel.bin",
+		"/etc/ucode",
+	}
+	assert.ElementsMatch(t, expected, names)
+}
+
+func TestWriteImageSinglePart(t *testing.T) {
+	testFS := fstest.MapFS{
+		"init": &fstest.MapFile{Data: []byte("init"), Mode: 0755},
+	}
+
+	tests := []struct {
+		compression Compression
+		command     string
+	}{
+		{compression: CompressionGzip, command: "gzip"},
+		{compression: CompressionZstd, command: "zstd"},
+		{compression: CompressionXZ, command: "xz"},
+		{compression: CompressionLZ4, command: "lz4"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.command, func(t *testing.T) {
+			command, err := exec.LookPath(tt.command)
+			if err != nil {
+				t.Skipf("%s not found", tt.command)
+			}
+
+			var b bytes.Buffer
+			err = WriteImage(&b, ImagePart{
+				Archive: NewWithFS(testFS, "/init"),
+				Options: []WriteOption{WithCompression(tt.compression)},
+			})
+			require.NoError(t, err)
+
+			// Trailing data makes the decompressors fail.
+			cmd := exec.Command(command, "-dc")
+			cmd.Stdin = &b
+			output, err := cmd.Output()
+			require.NoError(t, err)
+
+			hdr, err := cpio.NewReader(bytes.NewReader(output)).Next()
+			require.NoError(t, err)
+			assert.Equal(t, "/init", hdr.Name)
+		})
+	}
+}
+
+func TestWriteImageEarlyParts(t *testing.T) {
+	testFS := fstest.MapFS{
+		"init":     &fstest.MapFile{Data: []byte("init")},
+		"ucode":    &fstest.MapFile{Data: []byte("ucode")},
+		"dsdt.aml": &fstest.MapFile{Data: []byte("DSDT")},
+	}
+	early := NewSegmentWithFS(testFS)
+	require.NoError(t, early.AddMicrocode(MicrocodeAMD, "/ucode"))
+	acpi := NewSegmentWithFS(testFS)
+	require.NoError(t, acpi.AddACPITable("/dsdt.aml"))
+	main := NewWithFS(testFS, "/init")
+
+	tests := []struct {
+		name   string
+		parts  []ImagePart
+		errMsg string
+	}{
+		{
+			name:   "compressed",
+			parts:  []ImagePart{{Archive: early, Options: []WriteOption{WithCompression(CompressionZstd)}}},
+			errMsg: "part 0: /kernel/x86/microcode must be in the first, uncompressed part",
+		},
+		{
+			name:   "not first",
+			parts:  []ImagePart{{Archive: main}, {Archive: acpi}},
+			errMsg: "part 1: /kernel/firmware/acpi must be in the first, uncompressed part",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			err := WriteImage(&b, tt.parts...)
+			assert.ErrorContains(t, err, tt.errMsg)
+			assert.Zero(t, b.Len())
+		})
+	}
+}
+
+func TestArchiveAddMicrocode(t *testing.T) {
+	a := NewSegmentWithFS(fstest.MapFS{})
+	assert.ErrorContains(t, a.AddMicrocode("", "/ucode"), "invalid microcode vendor")
+	assert.ErrorContains(t, a.AddMicrocode("../x", "/ucode"), "invalid microcode vendor")
+	assert.ErrorContains(t, a.AddMicrocode(MicrocodeIntel), "no microcode files given")
+}